@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"math/rand"
 	"time"
 
 	"github.com/digitalocean/droplet-agent/internal/log"
@@ -11,8 +12,25 @@ import (
 	"github.com/digitalocean/droplet-agent/internal/sysaccess"
 )
 
-func bgJobsRemoveExpiredDOTTYKeys(ctx context.Context, sshMgr *sysaccess.SSHManager, interval time.Duration) {
-	log.Info("[authorized_keys files updater] launched")
+// jitterRand returns a pseudo-random number in [0.0, 1.0), it's replaced in tests
+var jitterRand = rand.Float64
+
+// jitteredInterval randomly varies the given interval by up to the given fraction of it in either direction,
+// so that agents started at the same time do not run their jobs in lockstep
+func jitteredInterval(interval time.Duration, jitter float64, rnd func() float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	ret := time.Duration(float64(interval) * (1 + jitter*(2*rnd()-1)))
+	if ret <= 0 {
+		return interval
+	}
+	return ret
+}
+
+func bgJobsRemoveExpiredDOTTYKeys(ctx context.Context, sshMgr *sysaccess.SSHManager, interval time.Duration, jitter float64, reschedule <-chan expiryCheckSchedule) {
+	interval = jitteredInterval(interval, jitter, jitterRand)
+	log.Info("[authorized_keys files updater] launched, checking every %v", interval)
 	ticker := time.NewTicker(interval)
 loop:
 	for {
@@ -20,6 +38,10 @@ loop:
 		case <-ctx.Done():
 			log.Info("[authorized_keys files updater] agent closing")
 			break loop
+		case sched := <-reschedule:
+			interval = jitteredInterval(sched.interval, sched.jitter, jitterRand)
+			log.Info("[authorized_keys files updater] now checking every %v", interval)
+			ticker.Reset(interval)
 		case <-ticker.C:
 			log.Debug("[authorized_keys files updater] attempting to remove expired keys")
 			if err := sshMgr.RemoveExpiredKeys(); err != nil {
@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test_jitteredInterval(t *testing.T) {
+	interval := 2 * time.Minute
+	tests := []struct {
+		name   string
+		jitter float64
+		rnd    func() float64
+		want   time.Duration
+	}{
+		{"should not vary the interval without jitter", 0, func() float64 { return 0.9 }, interval},
+		{"should shorten the interval by up to the jitter", 0.1, func() float64 { return 0 }, 108 * time.Second},
+		{"should lengthen the interval by up to the jitter", 0.1, func() float64 { return 0.75 }, 126 * time.Second},
+		{"should keep the interval in the middle", 0.1, func() float64 { return 0.5 }, interval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jitteredInterval(interval, tt.jitter, tt.rnd); got != tt.want {
+				t.Errorf("jitteredInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_jitteredInterval_bounds(t *testing.T) {
+	interval := 2 * time.Minute
+	jitter := 0.1
+	lower := time.Duration(float64(interval) * (1 - jitter))
+	upper := time.Duration(float64(interval) * (1 + jitter))
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if got := jitteredInterval(interval, jitter, rnd.Float64); got < lower || got > upper {
+			t.Fatalf("jitteredInterval() = %v, want within [%v, %v]", got, lower, upper)
+		}
+	}
+}
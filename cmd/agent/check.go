@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+)
+
+// checkSSHDConfig prints the sshd settings the agent resolved, so that they can be verified before the agent is enabled.
+// It returns an error if sshd_config could not be fully parsed, or if the keys written by the agent cannot take effect.
+func checkSSHDConfig(w io.Writer, info *sysaccess.SSHDConfigInfo) error {
+	fmt.Fprintf(w, "sshd_config: %s\n", info.ConfigFile)
+	fmt.Fprintf(w, "sshd_port: %d\n", info.Port)
+	fmt.Fprintf(w, "authorized_keys_file: %s\n", info.AuthorizedKeysFilePattern)
+	for _, e := range info.ParseErrors {
+		fmt.Fprintf(w, "error: %v\n", e)
+	}
+	if len(info.ParseErrors) != 0 {
+		return fmt.Errorf("%d errors found in %s", len(info.ParseErrors), info.ConfigFile)
+	}
+	if info.AuthorizedKeysFileUnused {
+		return errors.New("AuthorizedKeysFile is none, the keys written by the agent will not take effect")
+	}
+	return nil
+}
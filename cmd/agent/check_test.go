@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_checkSSHDConfig(t *testing.T) {
+	log.Mute()
+	tests := []struct {
+		name       string
+		sshdConfig string
+		wantOutput []string
+		wantErr    bool
+	}{
+		{
+			"should print the resolved settings",
+			"Port 2222\nAuthorizedKeysFile .ssh/authorized_keys2\n",
+			[]string{
+				"sshd_port: 2222",
+				"authorized_keys_file: %h/.ssh/authorized_keys2",
+			},
+			false,
+		},
+		{
+			"should fall back to the defaults",
+			"PasswordAuthentication no\n",
+			[]string{
+				"sshd_port: 22",
+				"authorized_keys_file: %h/.ssh/authorized_keys",
+			},
+			false,
+		},
+		{
+			"should fail on parse errors",
+			"Port 2222\nInclude /nonexistent/[\n",
+			[]string{
+				"sshd_port: 2222",
+				"error: ",
+			},
+			true,
+		},
+		{
+			"should fail if the authorized_keys files are not used",
+			"AuthorizedKeysFile none\nAuthorizedKeysCommand /usr/bin/fetch-keys\n",
+			[]string{
+				"authorized_keys_file: ",
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfgFile := filepath.Join(t.TempDir(), "sshd_config")
+			if err := os.WriteFile(cfgFile, []byte(tt.sshdConfig), 0600); err != nil {
+				t.Fatalf("failed to write sshd_config: %v", err)
+			}
+			sshMgr, err := sysaccess.NewSSHManager(
+				sysaccess.WithCustomSSHDCfg(cfgFile),
+				sysaccess.WithMetricsRegisterer(prometheus.NewRegistry()),
+			)
+			if err != nil {
+				t.Fatalf("NewSSHManager() unexpected error = %v", err)
+			}
+
+			out := &bytes.Buffer{}
+			err = checkSSHDConfig(out, sshMgr.SSHDConfigInfo())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSSHDConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := out.String()
+			if !strings.Contains(got, "sshd_config: "+cfgFile+"\n") {
+				t.Errorf("checkSSHDConfig() output = %q, missing the sshd_config path", got)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(got, want) {
+					t.Errorf("checkSSHDConfig() output = %q, want it to contain %q", got, want)
+				}
+			}
+		})
+	}
+}
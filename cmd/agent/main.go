@@ -9,7 +9,7 @@ import (
 	_ "net/http/pprof" // #nosec G108
 	"os"
 	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/digitalocean/droplet-agent/internal/config"
@@ -19,19 +19,26 @@ import (
 	"github.com/digitalocean/droplet-agent/internal/metadata/updater"
 	"github.com/digitalocean/droplet-agent/internal/metadata/watcher"
 	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	log.Info("Launching %s", config.AppFullName)
 	cfg := config.Init()
+	if cfg.StructuredLog {
+		log.EnableStructured()
+	}
+	logLevel, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	log.SetLevel(logLevel)
 
-	log.Info("Config Loaded. Agent Starting (version:%s)", config.Version)
+	log.Info("Config Loaded. Agent Starting (version:%s, commit:%s)", config.Version, config.GitCommit)
 
 	if cfg.DebugMode {
 		log.EnableDebug()
-		go func() {
-			http.ListenAndServe(config.AppDebugAddr, nil) // #nosec G114
-		}()
 		log.Info("Debug mode enabled")
 	}
 	if cfg.UseSyslog {
@@ -39,108 +46,172 @@ func main() {
 			log.Error("failed to use syslog, using default logger instead. Error:%v", err)
 		}
 	}
-	sshMgrOpts := []sysaccess.SSHManagerOpt{sysaccess.WithoutManagingDropletKeys()}
+	signals, err := parseShutdownSignals(cfg.CleanShutdownSignals, cfg.ForcedShutdownSignals)
+	if err != nil {
+		log.Fatal("invalid shutdown signals: %v", err)
+	}
+	stoppedStatusUpdateAttempts = cfg.MetadataUpdateAttempts
+	shortTTLPolicy, err := sysaccess.ParseShortTTLPolicy(cfg.ShortTTLPolicy)
+	if err != nil {
+		log.Fatal("invalid short ttl policy: %v", err)
+	}
+	sshMgrOpts := []sysaccess.SSHManagerOpt{
+		sysaccess.WithoutManagingDropletKeys(),
+		sysaccess.WithKeySweepInterval(cfg.AuthorizedKeysCheckInterval, shortTTLPolicy),
+	}
 	if cfg.CustomSSHDPort != 0 {
 		sshMgrOpts = append(sshMgrOpts, sysaccess.WithCustomSSHDPort(cfg.CustomSSHDPort))
 	}
 	if cfg.CustomSSHDCfgFile != "" {
 		sshMgrOpts = append(sshMgrOpts, sysaccess.WithCustomSSHDCfg(cfg.CustomSSHDCfgFile))
 	}
+	if cfg.MaxKeyTTL > 0 {
+		sshMgrOpts = append(sshMgrOpts, sysaccess.WithMaxKeyTTL(cfg.MaxKeyTTL))
+		if cfg.RejectOverMaxKeyTTL {
+			sshMgrOpts = append(sshMgrOpts, sysaccess.WithRejectingKeysOverMaxTTL())
+		}
+	}
+	if cfg.StaticUsers != "" {
+		staticUsers, err := sysaccess.ParseStaticUsers(cfg.StaticUsers)
+		if err != nil {
+			log.Fatal("invalid static users: %v", err)
+		}
+		sshMgrOpts = append(sshMgrOpts, sysaccess.WithStaticUsers(staticUsers))
+	}
+	if cfg.DryRun {
+		sshMgrOpts = append(sshMgrOpts, sysaccess.WithDryRun())
+	}
+	if cfg.AllowSymlinkedKeysFile {
+		sshMgrOpts = append(sshMgrOpts, sysaccess.WithAllowSymlinkedAuthorizedKeys())
+	}
+	if cfg.MinFreeDiskSpace > 0 {
+		sshMgrOpts = append(sshMgrOpts, sysaccess.WithMinFreeDiskSpace(cfg.MinFreeDiskSpace))
+	}
+	if cfg.PreciseKeyExpiry {
+		sshMgrOpts = append(sshMgrOpts, sysaccess.WithPreciseKeyExpiry())
+	}
 	sshMgr, err := sysaccess.NewSSHManager(sshMgrOpts...)
 	if err != nil {
 		log.Fatal("failed to initialize SSHManager: %v", err)
 	}
+	if cfg.CheckMode {
+		if err := checkSSHDConfig(os.Stdout, sshMgr.SSHDConfigInfo()); err != nil {
+			log.Fatal("sshd_config check failed: %v", err)
+		}
+		os.Exit(0)
+	}
+	if cfg.VerifyMode {
+		if err := verifyAuthorizedKeys(os.Stdout, sshMgr, watcher.FetchMetadata); err != nil {
+			log.Fatal("authorized_keys verification failed: %v", err)
+		}
+		os.Exit(0)
+	}
+	if err := sshMgr.SSHDConfigErrors(); err != nil {
+		log.Error("errors encountered while parsing sshd_config, the affected settings fall back to their defaults: %v", err)
+	}
+	var serveDebugEndpointsOnce sync.Once
+	serveDebugEndpoints := func() {
+		serveDebugEndpointsOnce.Do(func() { serveDebugEndpoints(sshMgr) })
+	}
+	if cfg.DebugMode {
+		serveDebugEndpoints()
+	}
+
+	// remove the droplet keys rotated out while the agent was not running before watching for the key updates
+	pruneStaleDropletKeys(sshMgr, watcher.FetchMetadata, startupFetchTimeout)
 
 	doManagedKeysActioner := actioner.NewDOManagedKeysActioner(sshMgr)
 	metadataWatcher := newMetadataWatcher(&watcher.Conf{SSHPort: sshMgr.SSHDPort()})
 	metadataWatcher.RegisterActioner(doManagedKeysActioner)
+	metadataWatcher.RegisterActioner(actioner.NewRevokeKeysActioner(sshMgr))
 	infoUpdater := updater.NewAgentInfoUpdater()
 
 	// monitor sshd_config
-	go mustMonitorSSHDConfig(sshMgr)
+	shutdownRequests := make(chan shutdownMode, 1)
+	go mustMonitorSSHDConfig(sshMgr, shutdownRequests)
 
 	// Launch background jobs
 	bgJobsCtx, bgJobsCancel := context.WithCancel(context.Background())
-	go bgJobsRemoveExpiredDOTTYKeys(bgJobsCtx, sshMgr, cfg.AuthorizedKeysCheckInterval)
+	expiryCheckSched := make(chan expiryCheckSchedule, 1)
+	go bgJobsRemoveExpiredDOTTYKeys(bgJobsCtx, sshMgr, cfg.AuthorizedKeysCheckInterval, cfg.ExpiryCheckJitter, expiryCheckSched)
+
+	// reload the configuration on SIGHUP
+	go handleReload(bgJobsCtx, &configReloader{
+		cfg:              cfg,
+		load:             config.Reload,
+		setLogLevel:      log.SetLevel,
+		enableDebugMode:  serveDebugEndpoints,
+		expiryCheckSched: expiryCheckSched,
+	})
 
 	// handle shutdown
-	go handleShutdown(bgJobsCancel, metadataWatcher, infoUpdater, sshMgr)
+	go handleShutdown(signals, shutdownRequests, cfg.MaxLifetime, bgJobsCancel, metadataWatcher, infoUpdater, sshMgr)
 
 	// report agent status and ssh info
 	go updateMetadata(infoUpdater, &metadata.Metadata{
-		DOTTYStatus: metadata.RunningStatus,
-		SSHInfo:     &metadata.SSHInfo{Port: sshMgr.SSHDPort()},
-	}, true)
+		DOTTYStatus:  metadata.RunningStatus,
+		SSHInfo:      &metadata.SSHInfo{Port: sshMgr.SSHDPort()},
+		AgentVersion: config.Version,
+		AgentCommit:  config.GitCommit,
+	}, 0)
 
 	// launch the watcher
-	if err := metadataWatcher.Run(); err != nil {
+	if err := metadataWatcher.RunContext(bgJobsCtx); err != nil {
 		log.Fatal("Failed to run watcher... %v", err)
 	}
 	log.Info("Watcher finished")
 }
 
-func handleShutdown(bgJobsCancel context.CancelFunc, metadataWatcher watcher.MetadataWatcher, infoUpdater updater.AgentInfoUpdater, sshMgr *sysaccess.SSHManager) {
+func handleShutdown(signals shutdownSignals, shutdownRequests <-chan shutdownMode, maxLifetime time.Duration, bgJobsCancel context.CancelFunc, metadataWatcher watcher.MetadataWatcher, infoUpdater updater.AgentInfoUpdater, sshMgr *sysaccess.SSHManager) {
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGTSTP,
-		syscall.SIGQUIT,
-	)
-
-	c := <-signalChan
-	updateMetadata(infoUpdater, &metadata.Metadata{DOTTYStatus: metadata.StoppedStatus}, false)
-	switch c {
-	case syscall.SIGINT, syscall.SIGTERM:
-		log.Info("[%s] Shutting down", config.AppShortName)
-		bgJobsCancel()
-		metadataWatcher.Shutdown()
-		_ = sshMgr.Close()
-	case syscall.SIGTSTP, syscall.SIGQUIT:
-		log.Info("[%s] Forced to quit! You may lose jobs in progress", config.AppShortName)
-	default:
-		log.Error("unsupported signal, %d", c)
+	signal.Notify(signalChan, signals.signals()...)
+
+	lifetimeExpired := lifetimeTimer(maxLifetime, time.After)
+	if err := waitForShutdown(signalChan, shutdownRequests, lifetimeExpired, signals, bgJobsCancel, metadataWatcher, infoUpdater, sshMgr); err != nil {
+		log.Error("%v", err)
 		os.Exit(1)
 	}
 }
 
-func updateMetadata(infoUpdater updater.AgentInfoUpdater, md *metadata.Metadata, retry bool) {
-	fn := func() error { return infoUpdater.Update(md) }
-	sleepTime := time.Second * 5
-
-	if !retry {
-		err := fn()
-		if err != nil {
-			log.Error("error updating droplet metadata: %s", err)
-		}
+// updateMetadata updates the droplet metadata, retrying with a backoff until it succeeds, or until maxAttempts
+// attempts failed if maxAttempts is positive
+func updateMetadata(infoUpdater updater.AgentInfoUpdater, md *metadata.Metadata, maxAttempts int) {
+	log.Debug("updating metadata")
+	if err := updater.UpdateWithRetry(infoUpdater, md, maxAttempts); err != nil {
+		log.Error("error updating droplet metadata: %s", err)
 		return
 	}
+	jsonMD, _ := json.Marshal(md)
+	log.Info("droplet metadata updated to [%s]", string(jsonMD))
+}
 
-	for {
-		log.Debug("updating metadata")
-		err := fn()
-		if err == nil {
-			jsonMD, _ := json.Marshal(md)
-			log.Info("droplet metadata updated to [%s]", string(jsonMD))
-			return
-		}
-
-		time.Sleep(sleepTime)
-		log.Error("error updating droplet metadata: %s, retrying", err)
-	}
+// serveDebugEndpoints exposes the debug endpoints, including the recent changes made to the authorized_keys files,
+// for troubleshooting unexpected key loss
+func serveDebugEndpoints(sshMgr *sysaccess.SSHManager) {
+	http.HandleFunc("/debug/authorized_keys_diffs", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(sshMgr.RecentKeysFileDiffs())
+	})
+	http.HandleFunc("/debug/managed_keys", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(sshMgr.ListManagedKeys())
+	})
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		http.ListenAndServe(config.AppDebugAddr, nil) // #nosec G114
+	}()
 }
 
-func mustMonitorSSHDConfig(sshMgr *sysaccess.SSHManager) {
+func mustMonitorSSHDConfig(sshMgr *sysaccess.SSHManager, shutdownRequests chan<- shutdownMode) {
 	cfgChanged, err := sshMgr.WatchSSHDConfig()
 	if err != nil {
 		log.Fatal("Failed to watch for sshd_config changes. error: %v", err)
 	}
 	if _, ok := <-cfgChanged; ok {
-		// change detected, terminate the agent
-		// and the systemd will restart it
-		if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
-			log.Debug("Failed to send signal to process")
-			os.Exit(2)
-		}
+		// change detected, terminate the agent cleanly
+		// and the systemd will restart it.
+		// The shutdown is requested directly, since SIGTERM may not be mapped to a shutdown
+		log.Info("sshd_config changed, restarting")
+		shutdownRequests <- shutdownClean
 	}
 }
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+)
+
+// startupFetchTimeout bounds how long the metadata is waited for at startup to prune the stale droplet keys
+var startupFetchTimeout = 5 * time.Second
+
+type dropletKeysPruner interface {
+	PruneStaleDropletKeys(dropletKeys []*sysaccess.SSHKey) error
+}
+
+// pruneStaleDropletKeys removes the droplet keys no longer assigned to the droplet according to the current metadata,
+// if the droplet keys are managed by the agent. Nothing is pruned if the metadata cannot be fetched within the given
+// timeout, so that a stalled metadata service does not hold up the startup.
+func pruneStaleDropletKeys(sshMgr dropletKeysPruner, fetchMetadata func() (*metadata.Metadata, error), timeout time.Duration) {
+	md, err := fetchMetadataWithTimeout(fetchMetadata, timeout)
+	if err != nil {
+		log.Error("failed to fetch metadata, stale droplet keys not pruned: %v", err)
+		return
+	}
+	if md.ManagedKeysEnabled == nil || !*md.ManagedKeysEnabled {
+		log.Debug("droplet keys not managed, skip pruning")
+		return
+	}
+	keyParser := metadata.NewSSHKeyParser()
+	dropletKeys := make([]*sysaccess.SSHKey, 0, len(md.PublicKeys))
+	for _, keyRaw := range md.PublicKeys {
+		k, err := keyParser.FromPublicKey(keyRaw)
+		if err != nil {
+			// the key would be pruned as if it was stale
+			log.Error("invalid public key object, stale droplet keys not pruned: %v", err)
+			return
+		}
+		dropletKeys = append(dropletKeys, k)
+	}
+	if err := sshMgr.PruneStaleDropletKeys(dropletKeys); err != nil {
+		log.Error("failed to prune stale droplet keys: %v", err)
+	}
+}
+
+// fetchMetadataWithTimeout fetches the metadata, giving up if that does not finish within the given timeout
+func fetchMetadataWithTimeout(fetchMetadata func() (*metadata.Metadata, error), timeout time.Duration) (*metadata.Metadata, error) {
+	type result struct {
+		md  *metadata.Metadata
+		err error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		md, err := fetchMetadata()
+		resultChan <- result{md, err}
+	}()
+	select {
+	case r := <-resultChan:
+		return r.md, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %v", timeout)
+	}
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+)
+
+type fakeDropletKeysPruner struct {
+	pruned  bool
+	gotKeys []string
+}
+
+func (f *fakeDropletKeysPruner) PruneStaleDropletKeys(dropletKeys []*sysaccess.SSHKey) error {
+	f.pruned = true
+	for _, k := range dropletKeys {
+		f.gotKeys = append(f.gotKeys, k.PublicKey)
+	}
+	return nil
+}
+
+func Test_pruneStaleDropletKeys(t *testing.T) {
+	log.Mute()
+	enabled := true
+	disabled := false
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := []struct {
+		name          string
+		fetchMetadata func() (*metadata.Metadata, error)
+		wantPruned    bool
+		wantKeys      []string
+	}{
+		{
+			"should prune the keys no longer assigned to the droplet",
+			func() (*metadata.Metadata, error) {
+				return &metadata.Metadata{PublicKeys: []string{"ssh-rsa AAAA-droplet-key"}, ManagedKeysEnabled: &enabled}, nil
+			},
+			true,
+			[]string{"ssh-rsa AAAA-droplet-key"},
+		},
+		{
+			"should not prune if the droplet keys are not managed",
+			func() (*metadata.Metadata, error) {
+				return &metadata.Metadata{PublicKeys: []string{"ssh-rsa AAAA-droplet-key"}, ManagedKeysEnabled: &disabled}, nil
+			},
+			false,
+			nil,
+		},
+		{
+			"should not prune if the metadata cannot be fetched",
+			func() (*metadata.Metadata, error) {
+				return nil, errors.New("fetch-err")
+			},
+			false,
+			nil,
+		},
+		{
+			"should give up if fetching the metadata hangs",
+			func() (*metadata.Metadata, error) {
+				<-release
+				return &metadata.Metadata{ManagedKeysEnabled: &enabled}, nil
+			},
+			false,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pruner := &fakeDropletKeysPruner{}
+			done := make(chan struct{})
+			go func() {
+				pruneStaleDropletKeys(pruner, tt.fetchMetadata, 10*time.Millisecond)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("pruneStaleDropletKeys() did not return")
+			}
+			if pruner.pruned != tt.wantPruned {
+				t.Errorf("pruneStaleDropletKeys() pruned = %v, want %v", pruner.pruned, tt.wantPruned)
+			}
+			if !reflect.DeepEqual(pruner.gotKeys, tt.wantKeys) {
+				t.Errorf("pruneStaleDropletKeys() keys = %v, want %v", pruner.gotKeys, tt.wantKeys)
+			}
+		})
+	}
+}
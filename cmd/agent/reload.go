@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/config"
+	"github.com/digitalocean/droplet-agent/internal/log"
+)
+
+// expiryCheckSchedule describes how often the expired DOTTY keys are removed
+type expiryCheckSchedule struct {
+	interval time.Duration
+	jitter   float64
+}
+
+// configReloader re-reads the configuration and applies the settings that can be changed without restarting the agent,
+// i.e. the log level, the debug mode and the schedule of the expired keys removal
+type configReloader struct {
+	cfg *config.Conf
+
+	load             func() (*config.Conf, error)
+	setLogLevel      func(l log.Level)
+	enableDebugMode  func()
+	expiryCheckSched chan expiryCheckSchedule // buffered, only the latest schedule matters
+}
+
+// reload applies the reloaded configuration. The current configuration is kept if the new one is invalid.
+func (r *configReloader) reload() error {
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+	logLevel, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	prev := r.cfg
+	r.cfg = cfg
+
+	if cfg.DebugMode {
+		logLevel = log.LevelDebug
+		if !prev.DebugMode {
+			r.enableDebugMode()
+		}
+	} else if prev.DebugMode {
+		log.Warn("[config reloader] the debug endpoints stay enabled until the agent restarts")
+	}
+	r.setLogLevel(logLevel)
+	log.Info("[config reloader] log level set to [%s], debug mode: %v", cfg.LogLevel, cfg.DebugMode)
+
+	if cfg.AuthorizedKeysCheckInterval != prev.AuthorizedKeysCheckInterval || cfg.ExpiryCheckJitter != prev.ExpiryCheckJitter {
+		log.Info("[config reloader] checking expired keys every %v, with jitter %v", cfg.AuthorizedKeysCheckInterval, cfg.ExpiryCheckJitter)
+		select {
+		case <-r.expiryCheckSched:
+			// replace the schedule not applied yet
+		default:
+		}
+		r.expiryCheckSched <- expiryCheckSchedule{interval: cfg.AuthorizedKeysCheckInterval, jitter: cfg.ExpiryCheckJitter}
+	}
+
+	// the other settings are only read when the agent starts
+	unchanged := *cfg
+	unchanged.LogLevel, unchanged.DebugMode = prev.LogLevel, prev.DebugMode
+	unchanged.AuthorizedKeysCheckInterval, unchanged.ExpiryCheckJitter = prev.AuthorizedKeysCheckInterval, prev.ExpiryCheckJitter
+	if !reflect.DeepEqual(&unchanged, prev) {
+		log.Warn("[config reloader] some of the changed settings only take effect once the agent restarts")
+	}
+	return nil
+}
+
+// handleReload reloads the configuration every time the agent receives a SIGHUP
+func handleReload(ctx context.Context, r *configReloader) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+	defer signal.Stop(signalChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signalChan:
+			log.Info("[config reloader] SIGHUP received, reloading the configuration")
+			if err := r.reload(); err != nil {
+				log.Error("[config reloader] failed to reload the configuration, keeping the current one: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/config"
+	"github.com/digitalocean/droplet-agent/internal/log"
+)
+
+func Test_configReloader_reload(t *testing.T) {
+	log.Mute()
+	current := &config.Conf{LogLevel: "info", AuthorizedKeysCheckInterval: 2 * time.Minute}
+	loadErr := errors.New("load-err")
+
+	tests := []struct {
+		name          string
+		loaded        *config.Conf
+		loadErr       error
+		wantErr       bool
+		wantLogLevel  *log.Level
+		wantSchedule  *expiryCheckSchedule
+		wantDebugMode bool
+	}{
+		{
+			"should update the log level and the expiry check interval",
+			&config.Conf{LogLevel: "warn", AuthorizedKeysCheckInterval: 30 * time.Second, ExpiryCheckJitter: 0.1},
+			nil,
+			false,
+			levelPtr(log.LevelWarn),
+			&expiryCheckSchedule{interval: 30 * time.Second, jitter: 0.1},
+			false,
+		},
+		{
+			"should not reschedule the expiry check if unchanged",
+			&config.Conf{LogLevel: "error", AuthorizedKeysCheckInterval: 2 * time.Minute},
+			nil,
+			false,
+			levelPtr(log.LevelError),
+			nil,
+			false,
+		},
+		{
+			"should log debug messages and enable the debug endpoints in debug mode",
+			&config.Conf{LogLevel: "info", DebugMode: true, AuthorizedKeysCheckInterval: 2 * time.Minute},
+			nil,
+			false,
+			levelPtr(log.LevelDebug),
+			nil,
+			true,
+		},
+		{
+			"should keep the current settings if the config cannot be loaded",
+			nil,
+			loadErr,
+			true,
+			nil,
+			nil,
+			false,
+		},
+		{
+			"should keep the current settings if the log level is invalid",
+			&config.Conf{LogLevel: "verbose", AuthorizedKeysCheckInterval: 30 * time.Second},
+			nil,
+			true,
+			nil,
+			nil,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotLogLevel *log.Level
+			gotDebugMode := false
+			r := &configReloader{
+				cfg: current,
+				load: func() (*config.Conf, error) {
+					return tt.loaded, tt.loadErr
+				},
+				setLogLevel: func(l log.Level) {
+					gotLogLevel = &l
+				},
+				enableDebugMode: func() {
+					gotDebugMode = true
+				},
+				expiryCheckSched: make(chan expiryCheckSchedule, 1),
+			}
+			if err := r.reload(); (err != nil) != tt.wantErr {
+				t.Fatalf("reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (gotLogLevel == nil) != (tt.wantLogLevel == nil) || (gotLogLevel != nil && *gotLogLevel != *tt.wantLogLevel) {
+				t.Errorf("reload() log level = %v, want %v", gotLogLevel, tt.wantLogLevel)
+			}
+			if gotDebugMode != tt.wantDebugMode {
+				t.Errorf("reload() debug mode = %v, want %v", gotDebugMode, tt.wantDebugMode)
+			}
+			select {
+			case got := <-r.expiryCheckSched:
+				if tt.wantSchedule == nil || got != *tt.wantSchedule {
+					t.Errorf("reload() schedule = %+v, want %+v", got, tt.wantSchedule)
+				}
+			default:
+				if tt.wantSchedule != nil {
+					t.Errorf("reload() schedule not updated, want %+v", *tt.wantSchedule)
+				}
+			}
+			if tt.wantErr && r.cfg != current {
+				t.Errorf("reload() should keep the current config on errors")
+			}
+		})
+	}
+}
+
+func levelPtr(l log.Level) *log.Level {
+	return &l
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/config"
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/metadata/updater"
+	"github.com/digitalocean/droplet-agent/internal/metadata/watcher"
+)
+
+// shutdownMode describes how the agent reacts to a shutdown signal
+type shutdownMode int
+
+const (
+	// shutdownClean stops the background jobs and the watcher, which removes the DOTTY keys, before quitting
+	shutdownClean shutdownMode = iota + 1
+	// shutdownForced quits without waiting for the jobs in progress, only making a bounded attempt to remove the DOTTY keys
+	shutdownForced
+)
+
+// supportedSignals contains the signals that can be mapped to a shutdown mode
+var supportedSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGTSTP": syscall.SIGTSTP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// shutdownSignals maps a signal to the shutdown mode it triggers
+type shutdownSignals map[os.Signal]shutdownMode
+
+// signals returns all signals that trigger a shutdown
+func (s shutdownSignals) signals() []os.Signal {
+	ret := make([]os.Signal, 0, len(s))
+	for sig := range s {
+		ret = append(ret, sig)
+	}
+	return ret
+}
+
+// parseShutdownSignals builds the signal mapping from comma separated lists of signal names, such as "SIGINT,SIGTERM".
+// The "SIG" prefix is optional and names are case-insensitive.
+func parseShutdownSignals(clean, forced string) (shutdownSignals, error) {
+	ret := make(shutdownSignals)
+	add := func(names string, mode shutdownMode) error {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if !strings.HasPrefix(name, "SIG") {
+				name = "SIG" + name
+			}
+			sig, ok := supportedSignals[name]
+			if !ok {
+				return fmt.Errorf("unsupported signal: %s", name)
+			}
+			if _, dup := ret[sig]; dup {
+				return fmt.Errorf("signal %s is mapped more than once", name)
+			}
+			ret[sig] = mode
+		}
+		return nil
+	}
+	if err := add(clean, shutdownClean); err != nil {
+		return nil, err
+	}
+	if err := add(forced, shutdownForced); err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no shutdown signal configured")
+	}
+	return ret, nil
+}
+
+// forcedCleanupTimeout bounds how long a forced shutdown waits for the DOTTY keys to be removed
+var forcedCleanupTimeout = 5 * time.Second
+
+// stoppedStatusUpdateAttempts bounds how many times reporting the stopped status is attempted when shutting down,
+// it is set from the metadata_update_attempts option
+var stoppedStatusUpdateAttempts = 1
+
+// sshManager is the part of the SSHManager needed when shutting down
+type sshManager interface {
+	RemoveDOTTYKeys() error
+	Close() error
+}
+
+// shutdownAgent performs the shutdown triggered by the given signal, following the given signal mapping
+func shutdownAgent(sig os.Signal, signals shutdownSignals, bgJobsCancel context.CancelFunc, metadataWatcher watcher.MetadataWatcher, infoUpdater updater.AgentInfoUpdater, sshMgr sshManager) error {
+	mode, ok := signals[sig]
+	if !ok {
+		return fmt.Errorf("unsupported signal, %v", sig)
+	}
+	shutdownWithMode(mode, bgJobsCancel, metadataWatcher, infoUpdater, sshMgr)
+	return nil
+}
+
+// waitForShutdown blocks until a shutdown signal is received, a shutdown is requested by the agent itself, e.g. on an
+// sshd_config change, or the max lifetime of the agent is reached, then shuts the agent down accordingly.
+// Reaching the max lifetime triggers a clean shutdown.
+func waitForShutdown(signalChan <-chan os.Signal, shutdownRequests <-chan shutdownMode, lifetimeExpired <-chan time.Time, signals shutdownSignals, bgJobsCancel context.CancelFunc, metadataWatcher watcher.MetadataWatcher, infoUpdater updater.AgentInfoUpdater, sshMgr sshManager) error {
+	select {
+	case sig := <-signalChan:
+		return shutdownAgent(sig, signals, bgJobsCancel, metadataWatcher, infoUpdater, sshMgr)
+	case mode := <-shutdownRequests:
+		shutdownWithMode(mode, bgJobsCancel, metadataWatcher, infoUpdater, sshMgr)
+		return nil
+	case <-lifetimeExpired:
+		log.Info("[%s] Max lifetime reached", config.AppShortName)
+		shutdownWithMode(shutdownClean, bgJobsCancel, metadataWatcher, infoUpdater, sshMgr)
+		return nil
+	}
+}
+
+// lifetimeTimer returns a channel that fires once the given max lifetime elapses,
+// or nil, which never fires, if the lifetime is not limited
+func lifetimeTimer(maxLifetime time.Duration, after func(d time.Duration) <-chan time.Time) <-chan time.Time {
+	if maxLifetime <= 0 {
+		return nil
+	}
+	return after(maxLifetime)
+}
+
+func shutdownWithMode(mode shutdownMode, bgJobsCancel context.CancelFunc, metadataWatcher watcher.MetadataWatcher, infoUpdater updater.AgentInfoUpdater, sshMgr sshManager) {
+	updateMetadata(infoUpdater, &metadata.Metadata{DOTTYStatus: metadata.StoppedStatus}, stoppedStatusUpdateAttempts)
+	switch mode {
+	case shutdownClean:
+		log.Info("[%s] Shutting down", config.AppShortName)
+		bgJobsCancel()
+		metadataWatcher.Shutdown()
+		_ = sshMgr.Close()
+	case shutdownForced:
+		log.Info("[%s] Forced to quit! You may lose jobs in progress", config.AppShortName)
+		// jobs in progress are not waited for, but still try not to leave the temporary keys behind
+		if err := removeDOTTYKeys(sshMgr, forcedCleanupTimeout); err != nil {
+			log.Error("[%s] failed to remove DOTTY keys: %v", config.AppShortName, err)
+		}
+	}
+}
+
+// removeDOTTYKeys removes the DOTTY keys, giving up if that does not finish within the given timeout
+func removeDOTTYKeys(sshMgr sshManager, timeout time.Duration) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- sshMgr.RemoveDOTTYKeys()
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
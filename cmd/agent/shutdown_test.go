@@ -0,0 +1,330 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/metadata/actioner"
+)
+
+type shutdownRecorder struct {
+	bgJobsCancelled  bool
+	watcherShutdown  bool
+	sshMgrClosed     bool
+	dottyKeysRemoved bool
+	updatedStatus    []metadata.AgentStatus
+}
+
+func (r *shutdownRecorder) cancel() {
+	r.bgJobsCancelled = true
+}
+
+func (r *shutdownRecorder) RegisterActioner(_ actioner.MetadataActioner) {}
+
+func (r *shutdownRecorder) Run() error {
+	return nil
+}
+
+func (r *shutdownRecorder) RunContext(_ context.Context) error {
+	return nil
+}
+
+func (r *shutdownRecorder) Shutdown() {
+	r.watcherShutdown = true
+}
+
+func (r *shutdownRecorder) Update(md *metadata.Metadata) error {
+	r.updatedStatus = append(r.updatedStatus, md.DOTTYStatus)
+	return nil
+}
+
+func (r *shutdownRecorder) RemoveDOTTYKeys() error {
+	r.dottyKeysRemoved = true
+	return nil
+}
+
+func (r *shutdownRecorder) Close() error {
+	r.sshMgrClosed = true
+	return nil
+}
+
+func Test_parseShutdownSignals(t *testing.T) {
+	tests := []struct {
+		name    string
+		clean   string
+		forced  string
+		want    shutdownSignals
+		wantErr bool
+	}{
+		{
+			"should parse the default mapping",
+			"SIGINT,SIGTERM",
+			"SIGTSTP,SIGQUIT",
+			shutdownSignals{
+				syscall.SIGINT:  shutdownClean,
+				syscall.SIGTERM: shutdownClean,
+				syscall.SIGTSTP: shutdownForced,
+				syscall.SIGQUIT: shutdownForced,
+			},
+			false,
+		},
+		{
+			"should accept names without the SIG prefix, in any case, with spaces",
+			" int, Term ,quit",
+			"tstp",
+			shutdownSignals{
+				syscall.SIGINT:  shutdownClean,
+				syscall.SIGTERM: shutdownClean,
+				syscall.SIGQUIT: shutdownClean,
+				syscall.SIGTSTP: shutdownForced,
+			},
+			false,
+		},
+		{
+			"should allow an empty forced list",
+			"SIGTERM",
+			"",
+			shutdownSignals{
+				syscall.SIGTERM: shutdownClean,
+			},
+			false,
+		},
+		{
+			"should reject unsupported signals",
+			"SIGTERM,SIGKILL",
+			"",
+			nil,
+			true,
+		},
+		{
+			"should reject a signal mapped to both modes",
+			"SIGTERM,SIGQUIT",
+			"SIGQUIT",
+			nil,
+			true,
+		},
+		{
+			"should reject an empty mapping",
+			"",
+			" , ",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseShutdownSignals(tt.clean, tt.forced)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseShutdownSignals() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseShutdownSignals() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_shutdownAgent(t *testing.T) {
+	log.Mute()
+	signals := shutdownSignals{
+		syscall.SIGTERM: shutdownClean,
+		syscall.SIGQUIT: shutdownClean,
+		syscall.SIGINT:  shutdownForced,
+	}
+	tests := []struct {
+		name    string
+		sig     os.Signal
+		want    *shutdownRecorder
+		wantErr bool
+	}{
+		{
+			"should clean up if the signal is mapped to a clean shutdown",
+			syscall.SIGTERM,
+			&shutdownRecorder{
+				bgJobsCancelled: true,
+				watcherShutdown: true,
+				sshMgrClosed:    true,
+				updatedStatus:   []metadata.AgentStatus{metadata.StoppedStatus},
+			},
+			false,
+		},
+		{
+			"should honor a custom mapping of a signal to a clean shutdown",
+			syscall.SIGQUIT,
+			&shutdownRecorder{
+				bgJobsCancelled: true,
+				watcherShutdown: true,
+				sshMgrClosed:    true,
+				updatedStatus:   []metadata.AgentStatus{metadata.StoppedStatus},
+			},
+			false,
+		},
+		{
+			"should only remove DOTTY keys if the signal is mapped to a forced shutdown",
+			syscall.SIGINT,
+			&shutdownRecorder{
+				dottyKeysRemoved: true,
+				updatedStatus:    []metadata.AgentStatus{metadata.StoppedStatus},
+			},
+			false,
+		},
+		{
+			"should return error if the signal is not mapped",
+			syscall.SIGTSTP,
+			&shutdownRecorder{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &shutdownRecorder{}
+			err := shutdownAgent(tt.sig, signals, r.cancel, r, r, r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("shutdownAgent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(r, tt.want) {
+				t.Errorf("shutdownAgent() got = %+v, want %+v", r, tt.want)
+			}
+		})
+	}
+}
+
+func Test_lifetimeTimer(t *testing.T) {
+	t.Run("should not fire if the lifetime is not limited", func(t *testing.T) {
+		after := func(d time.Duration) <-chan time.Time {
+			t.Errorf("lifetimeTimer() should not start a timer")
+			return nil
+		}
+		if got := lifetimeTimer(0, after); got != nil {
+			t.Errorf("lifetimeTimer() = %v, want nil", got)
+		}
+	})
+	t.Run("should fire after the configured lifetime", func(t *testing.T) {
+		var gotLifetime time.Duration
+		fired := make(chan time.Time)
+		after := func(d time.Duration) <-chan time.Time {
+			gotLifetime = d
+			return fired
+		}
+		if got := lifetimeTimer(24*time.Hour, after); got != fired {
+			t.Errorf("lifetimeTimer() should return the timer channel")
+		}
+		if gotLifetime != 24*time.Hour {
+			t.Errorf("lifetimeTimer() started timer for %v, want %v", gotLifetime, 24*time.Hour)
+		}
+	})
+}
+
+func Test_waitForShutdown(t *testing.T) {
+	log.Mute()
+	signals := shutdownSignals{
+		syscall.SIGTERM: shutdownClean,
+		syscall.SIGINT:  shutdownForced,
+	}
+	t.Run("should cleanly shut down once the max lifetime is reached", func(t *testing.T) {
+		r := &shutdownRecorder{}
+		fired := make(chan time.Time, 1)
+		lifetimeExpired := lifetimeTimer(time.Hour, func(_ time.Duration) <-chan time.Time {
+			return fired
+		})
+		fired <- time.Now()
+		if err := waitForShutdown(make(chan os.Signal), nil, lifetimeExpired, signals, r.cancel, r, r, r); err != nil {
+			t.Errorf("waitForShutdown() unexpected error = %v", err)
+		}
+		want := &shutdownRecorder{
+			bgJobsCancelled: true,
+			watcherShutdown: true,
+			sshMgrClosed:    true,
+			updatedStatus:   []metadata.AgentStatus{metadata.StoppedStatus},
+		}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("waitForShutdown() got = %+v, want %+v", r, want)
+		}
+	})
+	t.Run("should follow the signal mapping if a signal arrives before the max lifetime", func(t *testing.T) {
+		r := &shutdownRecorder{}
+		signalChan := make(chan os.Signal, 1)
+		signalChan <- syscall.SIGINT
+		if err := waitForShutdown(signalChan, nil, make(chan time.Time), signals, r.cancel, r, r, r); err != nil {
+			t.Errorf("waitForShutdown() unexpected error = %v", err)
+		}
+		want := &shutdownRecorder{
+			dottyKeysRemoved: true,
+			updatedStatus:    []metadata.AgentStatus{metadata.StoppedStatus},
+		}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("waitForShutdown() got = %+v, want %+v", r, want)
+		}
+	})
+	t.Run("should keep waiting for signals if the lifetime is not limited", func(t *testing.T) {
+		r := &shutdownRecorder{}
+		signalChan := make(chan os.Signal, 1)
+		signalChan <- syscall.SIGTERM
+		if err := waitForShutdown(signalChan, nil, lifetimeTimer(0, nil), signals, r.cancel, r, r, r); err != nil {
+			t.Errorf("waitForShutdown() unexpected error = %v", err)
+		}
+		if !r.sshMgrClosed {
+			t.Errorf("waitForShutdown() should cleanly shut down on SIGTERM")
+		}
+	})
+	t.Run("should shut down as requested even if SIGTERM is not mapped", func(t *testing.T) {
+		r := &shutdownRecorder{}
+		shutdownRequests := make(chan shutdownMode, 1)
+		shutdownRequests <- shutdownClean
+		noSIGTERM := shutdownSignals{syscall.SIGINT: shutdownForced}
+		if err := waitForShutdown(make(chan os.Signal), shutdownRequests, nil, noSIGTERM, r.cancel, r, r, r); err != nil {
+			t.Errorf("waitForShutdown() unexpected error = %v", err)
+		}
+		want := &shutdownRecorder{
+			bgJobsCancelled: true,
+			watcherShutdown: true,
+			sshMgrClosed:    true,
+			updatedStatus:   []metadata.AgentStatus{metadata.StoppedStatus},
+		}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("waitForShutdown() got = %+v, want %+v", r, want)
+		}
+	})
+}
+
+type blockingSSHManager struct {
+	release chan struct{}
+	err     error
+}
+
+func (m *blockingSSHManager) RemoveDOTTYKeys() error {
+	<-m.release
+	return m.err
+}
+
+func (m *blockingSSHManager) Close() error {
+	return nil
+}
+
+func Test_removeDOTTYKeys(t *testing.T) {
+	removeErr := errors.New("remove-err")
+	t.Run("should return the error of removing the keys", func(t *testing.T) {
+		m := &blockingSSHManager{release: make(chan struct{}), err: removeErr}
+		close(m.release)
+		if err := removeDOTTYKeys(m, time.Second); !errors.Is(err, removeErr) {
+			t.Errorf("removeDOTTYKeys() error = %v, want %v", err, removeErr)
+		}
+	})
+	t.Run("should give up once timed out", func(t *testing.T) {
+		m := &blockingSSHManager{release: make(chan struct{})}
+		defer close(m.release)
+		if err := removeDOTTYKeys(m, 10*time.Millisecond); err == nil {
+			t.Errorf("removeDOTTYKeys() should fail once timed out")
+		}
+	})
+}
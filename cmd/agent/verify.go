@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+)
+
+type keysVerifier interface {
+	EnableManagedDropletKeys()
+	Verify(keys []*sysaccess.SSHKey) ([]sysaccess.DriftReport, error)
+}
+
+// verifyAuthorizedKeys fetches the keys assigned to the droplet and prints how each authorized_keys file differs from
+// the content the agent would write for them, in a diff-like format: lines prefixed with "-" would be removed by the
+// next update, and lines prefixed with "+" are missing from the file. It returns an error if any file drifted.
+func verifyAuthorizedKeys(w io.Writer, sshMgr keysVerifier, fetchMetadata func() (*metadata.Metadata, error)) error {
+	md, err := fetchMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+	if md.ManagedKeysEnabled != nil && *md.ManagedKeysEnabled {
+		sshMgr.EnableManagedDropletKeys()
+	}
+	keyParser := metadata.NewSSHKeyParser()
+	keys := make([]*sysaccess.SSHKey, 0, len(md.PublicKeys)+len(md.DOTTYKeys))
+	for _, keyRaw := range md.PublicKeys {
+		k, err := keyParser.FromPublicKey(keyRaw)
+		if err != nil {
+			// the agent would not write the key either
+			log.Error("invalid public key object. %v", err)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	for _, keyRaw := range md.DOTTYKeys {
+		k, err := keyParser.FromDOTTYKey(keyRaw)
+		if err != nil {
+			log.Error("invalid ssh key object. %v", err)
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	reports, err := sshMgr.Verify(keys)
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		fmt.Fprintln(w, "all authorized_keys files match the keys assigned to the droplet")
+		return nil
+	}
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s (user %s):\n", r.File, r.OSUser)
+		for _, l := range r.Unexpected {
+			fmt.Fprintf(w, "- %s\n", l)
+		}
+		for _, l := range r.Missing {
+			fmt.Fprintf(w, "+ %s\n", l)
+		}
+	}
+	return fmt.Errorf("%d authorized_keys files drifted from the keys assigned to the droplet", len(reports))
+}
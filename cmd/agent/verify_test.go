@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+)
+
+type fakeKeysVerifier struct {
+	managedDropletKeys bool
+	gotKeys            []*sysaccess.SSHKey
+	reports            []sysaccess.DriftReport
+	err                error
+}
+
+func (f *fakeKeysVerifier) EnableManagedDropletKeys() {
+	f.managedDropletKeys = true
+}
+
+func (f *fakeKeysVerifier) Verify(keys []*sysaccess.SSHKey) ([]sysaccess.DriftReport, error) {
+	f.gotKeys = keys
+	return f.reports, f.err
+}
+
+func Test_verifyAuthorizedKeys(t *testing.T) {
+	log.Mute()
+	enabled := true
+	fetchErr := errors.New("fetch-err")
+	verifyErr := errors.New("verify-err")
+	md := &metadata.Metadata{
+		PublicKeys:         []string{"ssh-rsa AAAA-droplet-key"},
+		DOTTYKeys:          []string{`{"os_user":"root","ssh_key":"ssh-rsa AAAA-dotty-key","actor_email":"actor@email.com","ttl":1800}`, "invalid"},
+		ManagedKeysEnabled: &enabled,
+	}
+	tests := []struct {
+		name                   string
+		md                     *metadata.Metadata
+		fetchErr               error
+		verifier               *fakeKeysVerifier
+		wantOutput             []string
+		wantErr                bool
+		wantErrIs              error
+		wantManagedDropletKeys bool
+		wantKeys               []string
+	}{
+		{
+			"should report no drift",
+			md,
+			nil,
+			&fakeKeysVerifier{reports: []sysaccess.DriftReport{}},
+			[]string{"all authorized_keys files match"},
+			false,
+			nil,
+			true,
+			[]string{"ssh-rsa AAAA-droplet-key", "ssh-rsa AAAA-dotty-key"},
+		},
+		{
+			"should print the drifts and fail",
+			&metadata.Metadata{DOTTYKeys: md.DOTTYKeys},
+			nil,
+			&fakeKeysVerifier{reports: []sysaccess.DriftReport{{
+				OSUser:     "root",
+				File:       "/root/.ssh/authorized_keys",
+				Missing:    []string{"missing-line"},
+				Unexpected: []string{"unexpected-line"},
+			}}},
+			[]string{
+				"/root/.ssh/authorized_keys (user root):\n",
+				"- unexpected-line\n",
+				"+ missing-line\n",
+			},
+			true,
+			nil,
+			false,
+			[]string{"ssh-rsa AAAA-dotty-key"},
+		},
+		{
+			"should fail if the metadata cannot be fetched",
+			nil,
+			fetchErr,
+			&fakeKeysVerifier{},
+			nil,
+			true,
+			fetchErr,
+			false,
+			nil,
+		},
+		{
+			"should fail if the files cannot be verified",
+			md,
+			nil,
+			&fakeKeysVerifier{err: verifyErr},
+			nil,
+			true,
+			verifyErr,
+			true,
+			[]string{"ssh-rsa AAAA-droplet-key", "ssh-rsa AAAA-dotty-key"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := verifyAuthorizedKeys(out, tt.verifier, func() (*metadata.Metadata, error) {
+				return tt.md, tt.fetchErr
+			})
+			if (err != nil) != tt.wantErr || (tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs)) {
+				t.Errorf("verifyAuthorizedKeys() error = %v, wantErr %v, wantErrIs %v", err, tt.wantErr, tt.wantErrIs)
+			}
+			got := out.String()
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(got, want) {
+					t.Errorf("verifyAuthorizedKeys() output = %q, want it to contain %q", got, want)
+				}
+			}
+			if tt.verifier.managedDropletKeys != tt.wantManagedDropletKeys {
+				t.Errorf("verifyAuthorizedKeys() managed droplet keys = %v, want %v", tt.verifier.managedDropletKeys, tt.wantManagedDropletKeys)
+			}
+			var gotKeys []string
+			for _, k := range tt.verifier.gotKeys {
+				gotKeys = append(gotKeys, k.PublicKey)
+			}
+			if !reflect.DeepEqual(gotKeys, tt.wantKeys) {
+				t.Errorf("verifyAuthorizedKeys() verified keys = %v, want %v", gotKeys, tt.wantKeys)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import "fmt"
+
+// Build information, injected at build time through -ldflags "-X ..."
+var (
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// VersionInfo returns the human readable version and build information of the agent
+func VersionInfo() string {
+	return fmt.Sprintf("%s %s (commit: %s, built at: %s)", AppFullName, Version, GitCommit, BuildDate)
+}
@@ -4,10 +4,14 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffyaml"
 )
 
 const (
@@ -18,34 +22,139 @@ const (
 	UserAgent = "Droplet-Agent/" + Version
 
 	backgroundJobInterval = 120 * time.Second
+
+	defaultCleanShutdownSignals   = "SIGINT,SIGTERM"
+	defaultForcedShutdownSignals  = "SIGTSTP,SIGQUIT"
+	defaultShortTTLPolicy         = "warn"
+	defaultLogLevel               = "info"
+	defaultMetadataUpdateAttempts = 3
+
+	envVarPrefix = "DROPLET_AGENT"
 )
 
-// Conf contains the configurations needed to run the agent
+// Conf contains the configurations needed to run the agent.
+// Each configuration is set by the command line flag named in its `flag` tag, or else by the environment variable named
+// in its `env` tag, i.e. the flag name in upper case prefixed with DROPLET_AGENT_, or else by the config file.
 type Conf struct {
-	UseSyslog bool
-	DebugMode bool
+	CheckMode     bool   `flag:"check_sshd" env:"DROPLET_AGENT_CHECK_SSHD"`
+	VerifyMode    bool   `flag:"verify" env:"DROPLET_AGENT_VERIFY"`
+	UseSyslog     bool   `flag:"syslog" env:"DROPLET_AGENT_SYSLOG"`
+	DebugMode     bool   `flag:"debug" env:"DROPLET_AGENT_DEBUG"`
+	StructuredLog bool   `flag:"structured_log" env:"DROPLET_AGENT_STRUCTURED_LOG"`
+	LogLevel      string `flag:"log_level" env:"DROPLET_AGENT_LOG_LEVEL"`
+
+	CustomSSHDPort              int           `flag:"sshd_port" env:"DROPLET_AGENT_SSHD_PORT"`
+	CustomSSHDCfgFile           string        `flag:"sshd_config" env:"DROPLET_AGENT_SSHD_CONFIG"`
+	AuthorizedKeysCheckInterval time.Duration `flag:"auth_keys_check_interval" env:"DROPLET_AGENT_AUTH_KEYS_CHECK_INTERVAL"`
+	ExpiryCheckJitter           float64       `flag:"expiry_check_jitter" env:"DROPLET_AGENT_EXPIRY_CHECK_JITTER"`
+	PreciseKeyExpiry            bool          `flag:"precise_key_expiry" env:"DROPLET_AGENT_PRECISE_KEY_EXPIRY"`
+	DryRun                      bool          `flag:"dry_run" env:"DROPLET_AGENT_DRY_RUN"`
+	AllowSymlinkedKeysFile      bool          `flag:"allow_symlinked_authorized_keys" env:"DROPLET_AGENT_ALLOW_SYMLINKED_AUTHORIZED_KEYS"`
+	MinFreeDiskSpace            uint64        `flag:"min_free_disk_space" env:"DROPLET_AGENT_MIN_FREE_DISK_SPACE"`
+	ShortTTLPolicy              string        `flag:"short_ttl_policy" env:"DROPLET_AGENT_SHORT_TTL_POLICY"`
+	MaxKeyTTL                   time.Duration `flag:"max_key_ttl" env:"DROPLET_AGENT_MAX_KEY_TTL"`
+	RejectOverMaxKeyTTL         bool          `flag:"reject_over_max_key_ttl" env:"DROPLET_AGENT_REJECT_OVER_MAX_KEY_TTL"`
+	StaticUsers                 string        `flag:"static_users" env:"DROPLET_AGENT_STATIC_USERS"`
 
-	CustomSSHDPort              int
-	CustomSSHDCfgFile           string
-	AuthorizedKeysCheckInterval time.Duration
+	CleanShutdownSignals   string        `flag:"shutdown_signals" env:"DROPLET_AGENT_SHUTDOWN_SIGNALS"`
+	ForcedShutdownSignals  string        `flag:"forced_shutdown_signals" env:"DROPLET_AGENT_FORCED_SHUTDOWN_SIGNALS"`
+	MaxLifetime            time.Duration `flag:"max_lifetime" env:"DROPLET_AGENT_MAX_LIFETIME"`
+	MetadataUpdateAttempts int           `flag:"metadata_update_attempts" env:"DROPLET_AGENT_METADATA_UPDATE_ATTEMPTS"`
 }
 
 // Init initializes the agent's configuration
 func Init() *Conf {
-	cfg := Conf{
-		AuthorizedKeysCheckInterval: backgroundJobInterval,
+	if versionRequested(os.Args[1:]) {
+		fmt.Println(VersionInfo())
+		os.Exit(0)
+	}
+	cfg, err := parse(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// versionRequested tells whether the -version flag is among the given command line arguments. It is looked up before
+// the other flags are parsed, and only on the command line: unlike the other flags, it must not be set through the
+// environment or the config file, otherwise the agent would keep exiting right after starting.
+func versionRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "version" {
+			continue
+		}
+		if !hasValue {
+			return true
+		}
+		v, err := strconv.ParseBool(value)
+		return err == nil && v
+	}
+	return false
+}
+
+// Reload reads the configuration again, e.g. after the config file is modified. Unlike Init, it returns the error
+// instead of exiting if the configuration is invalid.
+func Reload() (*Conf, error) {
+	return parse(os.Args[1:])
+}
+
+// parse builds the configuration from the given command line arguments, the environment variables and the optional
+// config file, in decreasing order of precedence
+func parse(args []string) (*Conf, error) {
+	cfg := Conf{}
+	fs := newFlagSet(&cfg)
+	if err := ff.Parse(fs, args,
+		ff.WithEnvVarPrefix(envVarPrefix),
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(ffyaml.Parser),
+	); err != nil {
+		return nil, err
+	}
+	if cfg.AuthorizedKeysCheckInterval <= 0 {
+		return nil, fmt.Errorf("invalid auth_keys_check_interval: %v", cfg.AuthorizedKeysCheckInterval)
+	}
+	if cfg.ExpiryCheckJitter < 0 || cfg.ExpiryCheckJitter >= 1 {
+		return nil, fmt.Errorf("invalid expiry_check_jitter: %v, must be in [0, 1)", cfg.ExpiryCheckJitter)
 	}
+	if cfg.MetadataUpdateAttempts <= 0 {
+		return nil, fmt.Errorf("invalid metadata_update_attempts: %d", cfg.MetadataUpdateAttempts)
+	}
+
+	return &cfg, nil
+}
 
+// newFlagSet defines the flags setting the given configuration
+func newFlagSet(cfg *Conf) *flag.FlagSet {
 	fs := flag.NewFlagSet("droplet-agent", flag.ExitOnError)
+	fs.String("config", "", "Path to a YAML config file, mapping the option names to their values")
 
+	fs.BoolVar(&cfg.CheckMode, "check_sshd", false, "Check that sshd_config can be parsed, print the resolved settings, then exit")
+	fs.BoolVar(&cfg.VerifyMode, "verify", false, "Check the authorized_keys files against the keys in the metadata, print the drifts, then exit")
 	fs.BoolVar(&cfg.UseSyslog, "syslog", false, "Use syslog service for logging")
 	fs.BoolVar(&cfg.DebugMode, "debug", false, "Turn on debug mode")
+	fs.BoolVar(&cfg.StructuredLog, "structured_log", false, "Write logs as key=value pairs")
+	fs.StringVar(&cfg.LogLevel, "log_level", defaultLogLevel, "The minimum level of the messages to log: debug, info, warn or error")
 	fs.IntVar(&cfg.CustomSSHDPort, "sshd_port", 0, "The port sshd is binding to")
 	fs.StringVar(&cfg.CustomSSHDCfgFile, "sshd_config", "", "The location of sshd_config")
+	fs.DurationVar(&cfg.AuthorizedKeysCheckInterval, "auth_keys_check_interval", backgroundJobInterval, "How often expired temporary keys are removed")
+	fs.Float64Var(&cfg.ExpiryCheckJitter, "expiry_check_jitter", 0, "Randomly vary auth_keys_check_interval by up to this fraction, e.g. 0.1 for +/-10%")
+	fs.StringVar(&cfg.CleanShutdownSignals, "shutdown_signals", defaultCleanShutdownSignals, "Comma separated signals that trigger a clean shutdown")
+	fs.StringVar(&cfg.ForcedShutdownSignals, "forced_shutdown_signals", defaultForcedShutdownSignals, "Comma separated signals that trigger a forced shutdown")
+	fs.DurationVar(&cfg.MaxLifetime, "max_lifetime", 0, "Cleanly shut down the agent after running for this long, 0 means run forever")
+	fs.IntVar(&cfg.MetadataUpdateAttempts, "metadata_update_attempts", defaultMetadataUpdateAttempts, "How many times the agent status is reported on shutdown before giving up, with a backoff in between")
+	fs.BoolVar(&cfg.PreciseKeyExpiry, "precise_key_expiry", false, "Record the expiry time of temporary keys with nanosecond precision")
+	fs.BoolVar(&cfg.DryRun, "dry_run", false, "Only log the changes that would be made to the authorized_keys files")
+	fs.BoolVar(&cfg.AllowSymlinkedKeysFile, "allow_symlinked_authorized_keys", false, "Write through authorized_keys files that are symlinks to files owned by the same user")
+	fs.Uint64Var(&cfg.MinFreeDiskSpace, "min_free_disk_space", 0, "Skip updating the authorized_keys files when their filesystem has fewer free bytes than this, 0 means no check")
+	fs.DurationVar(&cfg.MaxKeyTTL, "max_key_ttl", 0, "The max TTL of temporary keys, 0 means no limit")
+	fs.BoolVar(&cfg.RejectOverMaxKeyTTL, "reject_over_max_key_ttl", false, "Reject temporary keys with a TTL longer than max_key_ttl instead of capping it")
+	fs.StringVar(&cfg.StaticUsers, "static_users", "", "Comma separated name:uid:gid:home_dir entries for users that cannot be resolved through the system")
+	fs.StringVar(&cfg.ShortTTLPolicy, "short_ttl_policy", defaultShortTTLPolicy, "How to handle temporary keys with a TTL shorter than the key check interval: warn, clamp or reject")
 
-	ff.Parse(fs, os.Args[1:],
-		ff.WithEnvVarPrefix("DROPLET_AGENT"),
-	)
-
-	return &cfg
+	return fs
 }
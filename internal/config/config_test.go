@@ -0,0 +1,246 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parse(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "droplet-agent.yaml")
+	content := "# sample config\n" +
+		"debug: true\n" +
+		"sshd_port: 1030\n" +
+		"max_key_ttl: 4h\n" +
+		"static_users: \"app:1001:1001:/home/app\"\n"
+	if err := os.WriteFile(cfgFile, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    *Conf
+		wantErr bool
+	}{
+		{
+			"should keep the defaults without a config file",
+			[]string{"-sshd_port", "2222"},
+			&Conf{
+				CustomSSHDPort:              2222,
+				AuthorizedKeysCheckInterval: backgroundJobInterval,
+				ShortTTLPolicy:              defaultShortTTLPolicy,
+				LogLevel:                    defaultLogLevel,
+				CleanShutdownSignals:        defaultCleanShutdownSignals,
+				ForcedShutdownSignals:       defaultForcedShutdownSignals,
+				MetadataUpdateAttempts:      defaultMetadataUpdateAttempts,
+			},
+			false,
+		},
+		{
+			"should load values from the config file",
+			[]string{"-config", cfgFile},
+			&Conf{
+				DebugMode:                   true,
+				CustomSSHDPort:              1030,
+				AuthorizedKeysCheckInterval: backgroundJobInterval,
+				MaxKeyTTL:                   4 * time.Hour,
+				StaticUsers:                 "app:1001:1001:/home/app",
+				ShortTTLPolicy:              defaultShortTTLPolicy,
+				LogLevel:                    defaultLogLevel,
+				CleanShutdownSignals:        defaultCleanShutdownSignals,
+				ForcedShutdownSignals:       defaultForcedShutdownSignals,
+				MetadataUpdateAttempts:      defaultMetadataUpdateAttempts,
+			},
+			false,
+		},
+		{
+			"should let the flags win over the config file",
+			[]string{"-config", cfgFile, "-sshd_port", "2222", "-max_key_ttl", "1h"},
+			&Conf{
+				DebugMode:                   true,
+				CustomSSHDPort:              2222,
+				AuthorizedKeysCheckInterval: backgroundJobInterval,
+				MaxKeyTTL:                   time.Hour,
+				StaticUsers:                 "app:1001:1001:/home/app",
+				ShortTTLPolicy:              defaultShortTTLPolicy,
+				LogLevel:                    defaultLogLevel,
+				CleanShutdownSignals:        defaultCleanShutdownSignals,
+				ForcedShutdownSignals:       defaultForcedShutdownSignals,
+				MetadataUpdateAttempts:      defaultMetadataUpdateAttempts,
+			},
+			false,
+		},
+		{
+			"should enable the sshd_config check",
+			[]string{"-check_sshd", "-sshd_config", "/etc/ssh/custom_sshd_config"},
+			&Conf{
+				CheckMode:                   true,
+				CustomSSHDCfgFile:           "/etc/ssh/custom_sshd_config",
+				AuthorizedKeysCheckInterval: backgroundJobInterval,
+				ShortTTLPolicy:              defaultShortTTLPolicy,
+				LogLevel:                    defaultLogLevel,
+				CleanShutdownSignals:        defaultCleanShutdownSignals,
+				ForcedShutdownSignals:       defaultForcedShutdownSignals,
+				MetadataUpdateAttempts:      defaultMetadataUpdateAttempts,
+			},
+			false,
+		},
+		{
+			"should fail if the config file does not exist",
+			[]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.want != nil && *got != *tt.want {
+				t.Errorf("parse() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parse_envVars(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want func(cfg *Conf) bool
+	}{
+		{
+			"should set the configs from env vars",
+			map[string]string{
+				"DROPLET_AGENT_SSHD_PORT":                "2222",
+				"DROPLET_AGENT_DEBUG":                    "true",
+				"DROPLET_AGENT_AUTH_KEYS_CHECK_INTERVAL": "30s",
+			},
+			nil,
+			func(cfg *Conf) bool {
+				return cfg.CustomSSHDPort == 2222 && cfg.DebugMode && cfg.AuthorizedKeysCheckInterval == 30*time.Second
+			},
+		},
+		{
+			"should let the flags win over env vars",
+			map[string]string{
+				"DROPLET_AGENT_SSHD_PORT":                "2222",
+				"DROPLET_AGENT_AUTH_KEYS_CHECK_INTERVAL": "30s",
+			},
+			[]string{"-sshd_port", "1030"},
+			func(cfg *Conf) bool {
+				return cfg.CustomSSHDPort == 1030 && cfg.AuthorizedKeysCheckInterval == 30*time.Second
+			},
+		},
+		{
+			"should keep the defaults if neither set",
+			nil,
+			nil,
+			func(cfg *Conf) bool {
+				return cfg.CustomSSHDPort == 0 && !cfg.DebugMode && cfg.AuthorizedKeysCheckInterval == backgroundJobInterval
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			got, err := parse(tt.args)
+			if err != nil {
+				t.Fatalf("parse() unexpected error = %v", err)
+			}
+			if !tt.want(got) {
+				t.Errorf("parse() unexpected config: %+v", got)
+			}
+		})
+	}
+}
+
+func Test_parse_invalidCheckInterval(t *testing.T) {
+	if _, err := parse([]string{"-auth_keys_check_interval", "0s"}); err == nil {
+		t.Errorf("parse() should reject a non-positive auth_keys_check_interval")
+	}
+}
+
+func Test_parse_invalidExpiryCheckJitter(t *testing.T) {
+	for _, jitter := range []string{"-0.1", "1"} {
+		if _, err := parse([]string{"-expiry_check_jitter", jitter}); err == nil {
+			t.Errorf("parse() should reject expiry_check_jitter [%s]", jitter)
+		}
+	}
+}
+
+func Test_versionRequested(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{"should find -version", []string{"-debug", "-version"}, true},
+		{"should find --version", []string{"--version"}, true},
+		{"should accept an explicit value", []string{"-version=true"}, true},
+		{"should honor -version=false", []string{"-version=false"}, false},
+		{"should ignore the arguments after --", []string{"--", "-version"}, false},
+		{"should ignore values", []string{"-log_level", "version"}, false},
+		{"should ignore other flags", []string{"-versions"}, false},
+		{"should not be requested by default", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := versionRequested(tt.args); got != tt.want {
+				t.Errorf("versionRequested() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parse_versionEnv(t *testing.T) {
+	// the version is only printed when requested on the command line, the environment must neither break the parsing
+	// nor make the agent exit
+	t.Setenv("DROPLET_AGENT_VERSION", "1.2.3")
+	if _, err := parse(nil); err != nil {
+		t.Errorf("parse() unexpected error = %v", err)
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	got := VersionInfo()
+	for _, want := range []string{AppFullName, Version, GitCommit, BuildDate} {
+		if !strings.Contains(got, want) {
+			t.Errorf("VersionInfo() = %s, missing %s", got, want)
+		}
+	}
+}
+
+func TestConf_tags(t *testing.T) {
+	fs := newFlagSet(&Conf{})
+	typ := reflect.TypeOf(Conf{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		flagName := field.Tag.Get("flag")
+		if fs.Lookup(flagName) == nil {
+			t.Errorf("field %s: flag [%s] is not defined", field.Name, flagName)
+		}
+		wantEnv := envVarPrefix + "_" + strings.ToUpper(flagName)
+		if env := field.Tag.Get("env"); env != wantEnv {
+			t.Errorf("field %s: env tag = [%s], want [%s]", field.Name, env, wantEnv)
+		}
+	}
+}
+
+func Test_parse_invalidMetadataUpdateAttempts(t *testing.T) {
+	if _, err := parse([]string{"-metadata_update_attempts", "0"}); err == nil {
+		t.Errorf("parse() should reject a non-positive metadata_update_attempts")
+	}
+}
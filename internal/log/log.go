@@ -6,6 +6,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -13,41 +19,149 @@ const (
 )
 
 var (
-	logDebug  logger = log.New(os.Stdout, "DEBUG:", logFlags)
-	logInfo   logger = log.New(os.Stdout, "INFO:", logFlags)
-	logErr    logger = log.New(os.Stderr, "ERROR:", logFlags)
-	debugMode        = false
+	logDebug       logger = log.New(os.Stdout, "DEBUG:", logFlags)
+	logInfo        logger = log.New(os.Stdout, "INFO:", logFlags)
+	logWarn        logger = log.New(os.Stdout, "WARN:", logFlags)
+	logErr         logger = log.New(os.Stderr, "ERROR:", logFlags)
+	level                 = int32(LevelInfo) // accessed atomically, as it can be changed while logging
+	structuredMode        = false
+
+	timeNow = time.Now
 )
 
 type logger interface {
 	Output(calldepth int, s string) error
 }
 
+// Level is the minimum severity of the messages to log
+type Level int
+
+// Supported levels, in increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]Level{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+// ParseLevel returns the level of the given name, which is one of debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	l, ok := levelNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return LevelInfo, fmt.Errorf("invalid log level: %s", name)
+	}
+	return l, nil
+}
+
+// SetLevel sets the minimum severity of the messages to log. Messages of lower severities are dropped.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func currentLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
 // EnableDebug enables logging debug messages
 func EnableDebug() {
-	debugMode = true
+	SetLevel(LevelDebug)
+}
+
+// EnableStructured switches to the structured logging format, where each message is written as a single line of
+// key=value pairs, e.g. `ts=2023-10-01T10:00:00Z level=info caller=main.go:29 msg="Agent Starting" version=1.0`
+func EnableStructured() {
+	structuredMode = true
+	for _, l := range []logger{logDebug, logInfo, logWarn, logErr} {
+		plainLogger(l)
+	}
+}
+
+// plainLogger drops the prefix and the header of the given logger if it's a standard one,
+// since the structured format carries the same information
+func plainLogger(l logger) {
+	if stdLogger, ok := l.(*log.Logger); ok {
+		stdLogger.SetPrefix("")
+		stdLogger.SetFlags(0)
+	}
 }
 
 // Debug prints a debug message. If syslog is enabled then LOG_NOTICE is used
 func Debug(format string, params ...interface{}) {
-	if !debugMode {
+	if currentLevel() > LevelDebug {
 		return
 	}
-	if err := logDebug.Output(2, fmt.Sprintf(format, params...)); err != nil {
+	if err := output(logDebug, "debug", fmt.Sprintf(format, params...)); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR writing debug log output: %+v", err)
 	}
 }
 
 // Info prints a message. If syslog is enabled then LOG_NOTICE is used
 func Info(format string, params ...interface{}) {
-	if err := logInfo.Output(2, fmt.Sprintf(format, params...)); err != nil {
+	if currentLevel() > LevelInfo {
+		return
+	}
+	if err := output(logInfo, "info", fmt.Sprintf(format, params...)); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR writing info log output: %+v", err)
 	}
 }
 
+// Warn prints a warning message. If syslog is enabled then LOG_WARNING is used
+func Warn(format string, params ...interface{}) {
+	if currentLevel() > LevelWarn {
+		return
+	}
+	if err := output(logWarn, "warn", fmt.Sprintf(format, params...)); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR writing warn log output: %+v", err)
+	}
+}
+
 // Error prints an error message. If syslog is enabled then LOG_ERR is used
 func Error(format string, params ...interface{}) {
-	if err := logErr.Output(2, fmt.Sprintf(format, params...)); err != nil {
+	if err := output(logErr, "error", fmt.Sprintf(format, params...)); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR writing error log output: %+v", err)
+	}
+}
+
+// Debugw prints a debug message with the given key/value pairs as additional fields
+func Debugw(msg string, keysAndValues ...interface{}) {
+	if currentLevel() > LevelDebug {
+		return
+	}
+	if err := output(logDebug, "debug", msg, keysAndValues...); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR writing debug log output: %+v", err)
+	}
+}
+
+// Infow prints a message with the given key/value pairs as additional fields
+func Infow(msg string, keysAndValues ...interface{}) {
+	if currentLevel() > LevelInfo {
+		return
+	}
+	if err := output(logInfo, "info", msg, keysAndValues...); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR writing info log output: %+v", err)
+	}
+}
+
+// Warnw prints a warning message with the given key/value pairs as additional fields
+func Warnw(msg string, keysAndValues ...interface{}) {
+	if currentLevel() > LevelWarn {
+		return
+	}
+	if err := output(logWarn, "warn", msg, keysAndValues...); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR writing warn log output: %+v", err)
+	}
+}
+
+// Errorw prints an error message with the given key/value pairs as additional fields
+func Errorw(msg string, keysAndValues ...interface{}) {
+	if err := output(logErr, "error", msg, keysAndValues...); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR writing error log output: %+v", err)
 	}
 }
@@ -57,3 +171,45 @@ func Fatal(format string, params ...interface{}) {
 	Error(format, params...)
 	os.Exit(1)
 }
+
+// output writes the message in the configured format. It must be called directly by the exported logging functions,
+// so that the caller of these functions is reported.
+func output(l logger, level, msg string, keysAndValues ...interface{}) error {
+	const calldepth = 3
+	if !structuredMode {
+		return l.Output(calldepth, msg+formatFields(keysAndValues))
+	}
+	caller := "???"
+	if _, file, line, ok := runtime.Caller(calldepth - 1); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	fields := []interface{}{
+		"ts", timeNow().UTC().Format(time.RFC3339Nano),
+		"level", level,
+		"caller", caller,
+		"msg", msg,
+	}
+	return l.Output(calldepth, strings.TrimPrefix(formatFields(append(fields, keysAndValues...)), " "))
+}
+
+// formatFields formats the given key/value pairs as ` key=value` items, quoting values when needed.
+// A key without a value is paired with a `(MISSING)` placeholder.
+func formatFields(keysAndValues []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		val := "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			val = fmt.Sprint(keysAndValues[i+1])
+		}
+		b.WriteString(" " + key + "=" + quoteIfNeeded(val))
+	}
+	return b.String()
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
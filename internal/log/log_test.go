@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package log
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	callerLine   = regexp.MustCompile(`log_test\.go:\d+`)
+	callerPrefix = regexp.MustCompile(`log_test\.go:\d+: `)
+)
+
+func captureOutput(t *testing.T, structured bool, fn func()) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	origDebug, origInfo, origWarn, origErr := logDebug, logInfo, logWarn, logErr
+	origLevel, origStructured, origTimeNow := level, structuredMode, timeNow
+	defer func() {
+		logDebug, logInfo, logWarn, logErr = origDebug, origInfo, origWarn, origErr
+		level, structuredMode, timeNow = origLevel, origStructured, origTimeNow
+	}()
+	logDebug = log.New(buf, "DEBUG:", log.Lshortfile)
+	logInfo = log.New(buf, "INFO:", log.Lshortfile)
+	logWarn = log.New(buf, "WARN:", log.Lshortfile)
+	logErr = log.New(buf, "ERROR:", log.Lshortfile)
+	SetLevel(LevelDebug)
+	structuredMode = false
+	timeNow = func() time.Time {
+		return time.Date(2023, 10, 1, 10, 0, 0, 0, time.UTC)
+	}
+	if structured {
+		EnableStructured()
+	}
+	fn()
+	return buf.String()
+}
+
+func TestOutput(t *testing.T) {
+	tests := []struct {
+		name       string
+		structured bool
+		fn         func()
+		want       string
+	}{
+		{
+			"should keep the classic format by default",
+			false,
+			func() { Info("Agent Starting (version:%s)", "1.0") },
+			"INFO:log_test.go:N: Agent Starting (version:1.0)\n",
+		},
+		{
+			"should append fields in the classic format",
+			false,
+			func() { Errorw("failed to update keys", "user", "root", "err", "permission denied") },
+			"ERROR:log_test.go:N: failed to update keys user=root err=\"permission denied\"\n",
+		},
+		{
+			"should write key=value pairs in the structured format",
+			true,
+			func() { Info("Agent Starting (version:%s)", "1.0") },
+			"ts=2023-10-01T10:00:00Z level=info caller=log_test.go:N msg=\"Agent Starting (version:1.0)\"\n",
+		},
+		{
+			"should write additional fields in the structured format",
+			true,
+			func() { Infow("keys updated", "user", "root", "count", 2) },
+			"ts=2023-10-01T10:00:00Z level=info caller=log_test.go:N msg=\"keys updated\" user=root count=2\n",
+		},
+		{
+			"should mark a key without value",
+			true,
+			func() { Debugw("dangling", "key") },
+			"ts=2023-10-01T10:00:00Z level=debug caller=log_test.go:N msg=dangling key=(MISSING)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the line number is not checked, only that the caller of the logging function is reported
+			got := callerLine.ReplaceAllString(captureOutput(t, tt.structured, tt.fn), "log_test.go:N")
+			if got != tt.want {
+				t.Errorf("output got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	logAll := func() {
+		Debug("debug")
+		Info("info")
+		Warn("warn")
+		Errorw("error")
+	}
+	tests := []struct {
+		name  string
+		level Level
+		want  string
+	}{
+		{"should log everything at debug level", LevelDebug, "DEBUG:debug\nINFO:info\nWARN:warn\nERROR:error\n"},
+		{"should drop debug messages at info level", LevelInfo, "INFO:info\nWARN:warn\nERROR:error\n"},
+		{"should only log warnings and errors at warn level", LevelWarn, "WARN:warn\nERROR:error\n"},
+		{"should only log errors at error level", LevelError, "ERROR:error\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := captureOutput(t, false, func() {
+				SetLevel(tt.level)
+				logAll()
+			})
+			got = callerPrefix.ReplaceAllString(got, "")
+			if got != tt.want {
+				t.Errorf("output got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{" Warn ", LevelWarn, false},
+		{"ERROR", LevelError, false},
+		{"verbose", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLevel() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
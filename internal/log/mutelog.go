@@ -13,6 +13,7 @@ func Mute() {
 	muteOnce.Do(func() {
 		logDebug = &muteLogger{}
 		logInfo = &muteLogger{}
+		logWarn = &muteLogger{}
 		logErr = &muteLogger{}
 	})
 }
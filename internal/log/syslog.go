@@ -31,6 +31,12 @@ func UseSysLog() error {
 			return
 		}
 
+		wl, e := syslog.NewLogger(syslog.LOG_WARNING, syslogFlags)
+		if e != nil {
+			err = fmt.Errorf("failed to use syslog: %w", e)
+			return
+		}
+
 		el, e := syslog.NewLogger(syslog.LOG_ERR, syslogFlags)
 		if e != nil {
 			err = fmt.Errorf("failed to use syslog: %w", e)
@@ -38,7 +44,13 @@ func UseSysLog() error {
 		}
 		logDebug = dl
 		logInfo = il
+		logWarn = wl
 		logErr = el
+		if structuredMode {
+			for _, l := range []logger{logDebug, logInfo, logWarn, logErr} {
+				plainLogger(l)
+			}
+		}
 	})
 	return err
 }
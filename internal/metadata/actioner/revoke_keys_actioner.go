@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package actioner
+
+import (
+	"sync"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess"
+)
+
+// NewRevokeKeysActioner returns a new actioner revoking the DOTTY keys listed in the metadata
+func NewRevokeKeysActioner(sshMgr *sysaccess.SSHManager) MetadataActioner {
+	return &revokeKeysActioner{
+		keyRevoker: sshMgr,
+	}
+}
+
+type keyRevoker interface {
+	RevokeKeys(fingerprints []string) error
+}
+
+type revokeKeysActioner struct {
+	keyRevoker    keyRevoker
+	activeActions sync.WaitGroup
+}
+
+func (ra *revokeKeysActioner) Do(metadata *metadata.Metadata) {
+	ra.activeActions.Add(1)
+	defer ra.activeActions.Done()
+	if len(metadata.Revoke) != 0 {
+		log.Info("[Revoke Keys Actioner] Revoking keys matching %d entries", len(metadata.Revoke))
+	}
+	// always pass the list along, so that the keys no longer listed are not refused anymore
+	if err := ra.keyRevoker.RevokeKeys(metadata.Revoke); err != nil {
+		log.Error("[Revoke Keys Actioner] failed to revoke keys: %v", err)
+	}
+}
+
+func (ra *revokeKeysActioner) Shutdown() {
+	log.Info("[Revoke Keys Actioner] Shutting down")
+	ra.activeActions.Wait()
+	log.Info("[Revoke Keys Actioner] Bye-bye")
+}
@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package actioner
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/metadata/actioner/internal/mocks"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_revokeKeysActioner_Do(t *testing.T) {
+	log.Mute()
+
+	tests := []struct {
+		name     string
+		metadata *metadata.Metadata
+		prepare  func(revoker *mocks.MockkeyRevoker)
+	}{
+		{
+			"should revoke the listed keys",
+			&metadata.Metadata{Revoke: []string{"SHA256:fpt", "actor@email.com"}},
+			func(revoker *mocks.MockkeyRevoker) {
+				revoker.EXPECT().RevokeKeys([]string{"SHA256:fpt", "actor@email.com"}).Return(nil)
+			},
+		},
+		{
+			"should clear the revoked keys if none is listed",
+			&metadata.Metadata{},
+			func(revoker *mocks.MockkeyRevoker) {
+				revoker.EXPECT().RevokeKeys(nil).Return(nil)
+			},
+		},
+		{
+			"should not panic if failed to revoke keys",
+			&metadata.Metadata{Revoke: []string{"SHA256:fpt"}},
+			func(revoker *mocks.MockkeyRevoker) {
+				revoker.EXPECT().RevokeKeys([]string{"SHA256:fpt"}).Return(errors.New("oops"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			revokerMock := mocks.NewMockkeyRevoker(mockCtl)
+			tt.prepare(revokerMock)
+
+			ra := &revokeKeysActioner{keyRevoker: revokerMock}
+			ra.Do(tt.metadata)
+			ra.Shutdown()
+		})
+	}
+}
@@ -30,6 +30,11 @@ type Metadata struct {
 	DOTTYStatus        AgentStatus `json:"dotty_status,omitempty"`
 	SSHInfo            *SSHInfo    `json:"ssh_info,omitempty"`
 	ManagedKeysEnabled *bool       `json:"managed_keys_enabled,omitempty"`
+	// Revoke lists the DOTTY keys that must be removed right away, by fingerprint or by actor email
+	Revoke []string `json:"revoke,omitempty"`
+	// AgentVersion and AgentCommit identify the build of the agent running on the droplet
+	AgentVersion string `json:"agent_version,omitempty"`
+	AgentCommit  string `json:"agent_commit,omitempty"`
 }
 
 // SSHInfo contains the information of the sshd service running on the droplet
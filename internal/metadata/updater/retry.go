@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package updater
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+)
+
+const (
+	initialRetryDelay = 5 * time.Second
+	maxRetryDelay     = 60 * time.Second
+)
+
+// UpdateWithRetry updates the metadata, retrying with an exponential backoff (5s, 10s, 20s, ... capped at 60s)
+// until it succeeds or maxAttempts updates have failed, in which case the last error is returned.
+// A maxAttempts of 0 or less keeps retrying until the update succeeds.
+func UpdateWithRetry(u AgentInfoUpdater, md *metadata.Metadata, maxAttempts int) error {
+	return updateWithRetry(u, md, maxAttempts, time.Sleep)
+}
+
+func updateWithRetry(u AgentInfoUpdater, md *metadata.Metadata, maxAttempts int, sleep func(d time.Duration)) error {
+	for attempt := 1; ; attempt++ {
+		err := u.Update(md)
+		if err == nil {
+			return nil
+		}
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+		delay := retryDelay(attempt)
+		log.Error("error updating droplet metadata: %s, retrying in %v", err, delay)
+		sleep(delay)
+	}
+}
+
+// retryDelay returns how long to wait after the given number of failed attempts
+func retryDelay(failedAttempts int) time.Duration {
+	delay := initialRetryDelay
+	for i := 1; i < failedAttempts; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return delay
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package updater
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+)
+
+type fakeUpdater struct {
+	results []error
+	calls   int
+}
+
+func (f *fakeUpdater) Update(_ *metadata.Metadata) error {
+	f.calls++
+	return f.results[f.calls-1]
+}
+
+func Test_retryDelay(t *testing.T) {
+	want := []time.Duration{
+		5 * time.Second,
+		10 * time.Second,
+		20 * time.Second,
+		40 * time.Second,
+		60 * time.Second,
+		60 * time.Second,
+	}
+	for i, w := range want {
+		if got := retryDelay(i + 1); got != w {
+			t.Errorf("retryDelay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	if got := retryDelay(1000); got != maxRetryDelay {
+		t.Errorf("retryDelay(1000) = %v, want %v", got, maxRetryDelay)
+	}
+}
+
+func Test_updateWithRetry(t *testing.T) {
+	log.Mute()
+	md := &metadata.Metadata{DOTTYStatus: metadata.RunningStatus}
+	updateErr := errors.New("update-err")
+
+	tests := []struct {
+		name        string
+		results     []error
+		maxAttempts int
+		wantSleeps  []time.Duration
+		wantErr     error
+	}{
+		{
+			"should not retry if the update succeeded",
+			[]error{nil},
+			0,
+			nil,
+			nil,
+		},
+		{
+			"should back off until the update succeeds if not bounded",
+			[]error{updateErr, updateErr, updateErr, nil},
+			0,
+			[]time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second},
+			nil,
+		},
+		{
+			"should give up after max attempts",
+			[]error{updateErr, updateErr, updateErr},
+			3,
+			[]time.Duration{5 * time.Second, 10 * time.Second},
+			updateErr,
+		},
+		{
+			"should not retry if only one attempt is allowed",
+			[]error{updateErr},
+			1,
+			nil,
+			updateErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &fakeUpdater{results: tt.results}
+			var sleeps []time.Duration
+			err := updateWithRetry(u, md, tt.maxAttempts, func(d time.Duration) {
+				sleeps = append(sleeps, d)
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("updateWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(sleeps, tt.wantSleeps) {
+				t.Errorf("updateWithRetry() sleeps = %v, want %v", sleeps, tt.wantSleeps)
+			}
+			if u.calls != len(tt.results) {
+				t.Errorf("updateWithRetry() updated %d times, want %d", u.calls, len(tt.results))
+			}
+		})
+	}
+}
@@ -19,6 +19,11 @@ func newMetadataFetcher() metadataFetcher {
 	return &metadataFetcherImpl{}
 }
 
+// FetchMetadata fetches the current metadata of the droplet once
+func FetchMetadata() (*metadata.Metadata, error) {
+	return newMetadataFetcher().fetchMetadata()
+}
+
 type metadataFetcherImpl struct {
 }
 
@@ -2,12 +2,18 @@
 
 package watcher
 
-import "github.com/digitalocean/droplet-agent/internal/metadata/actioner"
+import (
+	"context"
+
+	"github.com/digitalocean/droplet-agent/internal/metadata/actioner"
+)
 
 // MetadataWatcher watches for metadata changes of the given droplet,
 // It notifies every registered actioner when it detects any metadata changes.
 type MetadataWatcher interface {
 	RegisterActioner(actioner actioner.MetadataActioner)
 	Run() error
+	// RunContext runs the watcher until it is shut down or the given context is cancelled
+	RunContext(ctx context.Context) error
 	Shutdown()
 }
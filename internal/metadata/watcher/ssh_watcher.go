@@ -3,6 +3,7 @@
 package watcher
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -48,6 +49,11 @@ func (w *sshWatcher) RegisterActioner(actioner actioner.MetadataActioner) {
 
 // Run launches the watcher
 func (w *sshWatcher) Run() error {
+	return w.RunContext(context.Background())
+}
+
+// RunContext launches the watcher, which runs until it is shut down or the given context is cancelled
+func (w *sshWatcher) RunContext(ctx context.Context) error {
 	log.Info("[SSH Watcher] Running")
 	packetChan, err := w.sniffer.Capture(&netutil.TCPPacketIdentifier{
 		TargetPort: w.sshdPort,
@@ -83,6 +89,9 @@ func (w *sshWatcher) Run() error {
 		case <-w.done:
 			log.Info("[SSH Watcher] Stopped")
 			return nil
+		case <-ctx.Done():
+			log.Info("[SSH Watcher] Context cancelled, stopped")
+			return nil
 		}
 	}
 }
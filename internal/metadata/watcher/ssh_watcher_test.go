@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/metadata"
+	"github.com/digitalocean/droplet-agent/internal/metadata/actioner"
+	"github.com/digitalocean/droplet-agent/internal/netutil"
+	"golang.org/x/time/rate"
+)
+
+type fakeSniffer struct {
+	packets chan *netutil.TCPPacket
+	stopped bool
+}
+
+func (s *fakeSniffer) Capture(_ *netutil.TCPPacketIdentifier) (<-chan *netutil.TCPPacket, error) {
+	return s.packets, nil
+}
+
+func (s *fakeSniffer) Stop() {
+	s.stopped = true
+}
+
+type noopActioner struct{}
+
+func (noopActioner) Do(_ *metadata.Metadata) {}
+func (noopActioner) Shutdown()               {}
+
+func Test_sshWatcher_RunContext(t *testing.T) {
+	log.Mute()
+	sniffer := &fakeSniffer{packets: make(chan *netutil.TCPPacket)}
+	w := &sshWatcher{
+		sniffer:             sniffer,
+		limiter:             rate.NewLimiter(rate.Every(time.Second/maxFetchPerSecond), 1),
+		registeredActioners: []actioner.MetadataActioner{noopActioner{}},
+		done:                make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- w.RunContext(ctx)
+	}()
+	cancel()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Errorf("RunContext() unexpected error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext() did not return after the context was cancelled")
+	}
+	if !sniffer.stopped {
+		t.Error("RunContext() should stop the sniffer when returning")
+	}
+}
@@ -40,6 +40,11 @@ func (w *webBasedWatcher) RegisterActioner(actioner actioner.MetadataActioner) {
 
 // Run launches the watcher
 func (w *webBasedWatcher) Run() error {
+	return w.RunContext(context.Background())
+}
+
+// RunContext launches the watcher, which runs until it is shut down or the given context is cancelled
+func (w *webBasedWatcher) RunContext(ctx context.Context) error {
 	log.Info("[Web Based Watcher] Running")
 	if len(w.registeredActioners) == 0 {
 		return ErrNoRegisteredActioner
@@ -68,6 +73,11 @@ func (w *webBasedWatcher) Run() error {
 		Handler:           r,
 		ReadHeaderTimeout: 3 * time.Second,
 	}
+	stopOnCancel := context.AfterFunc(ctx, func() {
+		log.Info("[Web Based Watcher] Context cancelled, stopping")
+		_ = w.server.Close()
+	})
+	defer stopOnCancel()
 	if err := w.server.ListenAndServe(); err != nil {
 		if errors.Is(err, http.ErrServerClosed) {
 			log.Info("http server closed")
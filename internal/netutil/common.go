@@ -24,10 +24,12 @@ type TCPPacketSniffer interface {
 
 // Possible return errors
 var (
-	ErrInvalidIdentifier = errors.New("invalid tcp packet identifier")
-	ErrCreateSocket      = errors.New("failed to create socket")
-	ErrApplyFilter       = errors.New("failed to apply bpf filter")
-	ErrMessageTooShort   = errors.New("input message is too short")
+	ErrInvalidIdentifier   = errors.New("invalid tcp packet identifier")
+	ErrCreateSocket        = errors.New("failed to create socket")
+	ErrApplyFilter         = errors.New("failed to apply bpf filter")
+	ErrSetReadTimeout      = errors.New("failed to set socket read timeout")
+	ErrMessageTooShort     = errors.New("input message is too short")
+	ErrUnsupportedPlatform = errors.New("tcp packet sniffing is not supported on this platform")
 )
 
 // TCPPacketIdentifier provides instructions for filtering the packets
@@ -69,6 +69,20 @@ func (mr *MockdependentFnsMockRecorder) Close(fd any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockdependentFns)(nil).Close), fd)
 }
 
+// SetsockoptTimeval mocks base method.
+func (m *MockdependentFns) SetsockoptTimeval(fd, level, opt int, tv *unix.Timeval) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetsockoptTimeval", fd, level, opt, tv)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetsockoptTimeval indicates an expected call of SetsockoptTimeval.
+func (mr *MockdependentFnsMockRecorder) SetsockoptTimeval(fd, level, opt, tv any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetsockoptTimeval", reflect.TypeOf((*MockdependentFns)(nil).SetsockoptTimeval), fd, level, opt, tv)
+}
+
 // SockCreate mocks base method.
 func (m *MockdependentFns) SockCreate(domain, typ, proto int) (int, error) {
 	m.ctrl.T.Helper()
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package netutil
+
+import "time"
+
+// maxPacketBuf is the default maximum number of bytes captured from each packet
+const maxPacketBuf = 512
+
+// minPacketBuf is the minimum number of bytes needed to parse a packet, i.e. len(IP packet header) + len(minimum TCP header)
+const minPacketBuf = 40
+
+// defaultReadTimeout is how long a read from the socket blocks at most by default
+const defaultReadTimeout = time.Second
+
+type snifferOpts struct {
+	captureLen  uint32
+	readTimeout time.Duration
+}
+
+// SnifferOpt allows creating the TCPPacketSniffer instance with designated options
+type SnifferOpt func(opt *snifferOpts)
+
+// WithCaptureLength sets the maximum number of bytes captured from each packet.
+// Lengths shorter than the minimum IPv4 + TCP headers are ignored.
+func WithCaptureLength(n uint32) SnifferOpt {
+	return func(opt *snifferOpts) {
+		if n >= minPacketBuf {
+			opt.captureLen = n
+		}
+	}
+}
+
+// WithReadTimeout sets how long a read from the socket blocks at most before the sniffer checks whether it's stopped.
+// A timeout of 0 makes the reads block until a packet arrives.
+func WithReadTimeout(timeout time.Duration) SnifferOpt {
+	return func(opt *snifferOpts) {
+		if timeout >= 0 {
+			opt.readTimeout = timeout
+		}
+	}
+}
+
+func defaultSnifferOpts() *snifferOpts {
+	return &snifferOpts{
+		captureLen:  maxPacketBuf,
+		readTimeout: defaultReadTimeout,
+	}
+}
@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package netutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithCaptureLength(t *testing.T) {
+	tests := []struct {
+		name string
+		n    uint32
+		want uint32
+	}{
+		{"should set the capture length", 9000, 9000},
+		{"should accept the minimum length", minPacketBuf, minPacketBuf},
+		{"should ignore lengths too short to hold the headers", minPacketBuf - 1, maxPacketBuf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := defaultSnifferOpts()
+			WithCaptureLength(tt.n)(opts)
+			if opts.captureLen != tt.want {
+				t.Errorf("WithCaptureLength() got = %v, want %v", opts.captureLen, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithReadTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"should set the read timeout", 500 * time.Millisecond, 500 * time.Millisecond},
+		{"should allow disabling the read timeout", 0, 0},
+		{"should ignore negative timeouts", -time.Second, defaultReadTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := defaultSnifferOpts()
+			WithReadTimeout(tt.timeout)(opts)
+			if opts.readTimeout != tt.want {
+				t.Errorf("WithReadTimeout() got = %v, want %v", opts.readTimeout, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+// +build !linux
+
+package netutil
+
+// NewTCPPacketSniffer returns a new TCP packet sniffer
+// Capturing packets relies on linux raw sockets, therefore for non-linux environment the sniffer always fails
+func NewTCPPacketSniffer(opts ...SnifferOpt) TCPPacketSniffer {
+	return &unsupportedSniffer{}
+}
+
+type unsupportedSniffer struct{}
+
+func (s *unsupportedSniffer) Capture(identifier *TCPPacketIdentifier) (<-chan *TCPPacket, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func (s *unsupportedSniffer) Stop() {}
@@ -0,0 +1,23 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+// +build !linux
+
+package netutil
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewTCPPacketSniffer_unsupportedPlatform(t *testing.T) {
+	s := NewTCPPacketSniffer()
+	got, err := s.Capture(&TCPPacketIdentifier{TargetPort: 22})
+	if !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("Capture() error = %v, want %v", err, ErrUnsupportedPlatform)
+	}
+	if got != nil {
+		t.Errorf("Capture() got = %v, want nil", got)
+	}
+	s.Stop()
+}
@@ -5,6 +5,9 @@ package netutil
 import (
 	"encoding/binary"
 	"fmt"
+	"reflect"
+	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -12,9 +15,11 @@ import (
 	"golang.org/x/net/bpf"
 )
 
-func newTCPPacketSnifferHelper() tcpPacketSnifferHelper {
+func newTCPPacketSnifferHelper(captureLen uint32, readTimeout time.Duration) tcpPacketSnifferHelper {
 	return &tcpSnifferHelperImpl{
 		dependentFns: &dependentFnsImpl{},
+		captureLen:   captureLen,
+		readTimeout:  readTimeout,
 	}
 }
 
@@ -22,6 +27,7 @@ type dependentFns interface {
 	SockCreate(domain, typ, proto int) (fd int, err error)
 	BPFAssemble(insts []bpf.Instruction) ([]bpf.RawInstruction, error)
 	Syscall6(trap, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err unix.Errno)
+	SetsockoptTimeval(fd, level, opt int, tv *unix.Timeval) (err error)
 	Close(fd int) (err error)
 }
 
@@ -37,12 +43,24 @@ func (f *dependentFnsImpl) BPFAssemble(insts []bpf.Instruction) ([]bpf.RawInstru
 func (f *dependentFnsImpl) Syscall6(trap, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err unix.Errno) {
 	return unix.Syscall6(trap, a1, a2, a3, a4, a5, a6)
 }
+func (f *dependentFnsImpl) SetsockoptTimeval(fd, level, opt int, tv *unix.Timeval) (err error) {
+	return unix.SetsockoptTimeval(fd, level, opt, tv)
+}
 func (f *dependentFnsImpl) Close(fd int) (err error) {
 	return unix.Close(fd)
 }
 
 type tcpSnifferHelperImpl struct {
 	dependentFns
+
+	captureLen  uint32        // maximum bytes captured from each packet, default to maxPacketBuf if not set
+	readTimeout time.Duration // how long a read from the socket blocks at most, 0 means no limit
+
+	// the most recently assembled filter, which is reused as long as the sniffer captures the same packets,
+	// i.e. the TCPPacketIdentifier the filter is generated for does not change
+	assembledLock sync.Mutex
+	lastFilter    []bpf.Instruction
+	lastAssembled []bpf.RawInstruction
 }
 
 // ToBpfFilters generates corresponding BPF filter for the given identifier
@@ -79,8 +97,12 @@ func (h *tcpSnifferHelperImpl) ToBpfFilters(identifier *TCPPacketIdentifier) ([]
 	if len(filter) == 0 {
 		return nil, ErrInvalidIdentifier
 	}
+	captureLen := h.captureLen
+	if captureLen == 0 {
+		captureLen = maxPacketBuf
+	}
 	filter = append(filter, []bpf.Instruction{
-		bpf.RetConstant{Val: maxPacketBuf}, // return maximum `maxPacketBuf` bytes (or less) from packet
+		bpf.RetConstant{Val: captureLen}, // return maximum `captureLen` bytes (or less) from packet
 		bpf.RetConstant{Val: 0x0},
 	}...)
 	// Calculate relative offset for the jmp instructions
@@ -106,7 +128,7 @@ func (h *tcpSnifferHelperImpl) SocketWithBPFFilter(filter []bpf.Instruction) (re
 		}
 	}()
 	// Applying the BPF instructions
-	assembled, err := h.BPFAssemble(filter)
+	assembled, err := h.assemble(filter)
 	if err != nil {
 		return 0, fmt.Errorf("%w:%v", ErrApplyFilter, err)
 	}
@@ -126,9 +148,32 @@ func (h *tcpSnifferHelperImpl) SocketWithBPFFilter(filter []bpf.Instruction) (re
 	if errno != 0 {
 		return 0, fmt.Errorf("%w:%s", ErrApplyFilter, errno.Error())
 	}
+	if h.readTimeout > 0 {
+		// make the reads return periodically, so that the sniffer loop can notice it's stopped
+		tv := unix.NsecToTimeval(h.readTimeout.Nanoseconds())
+		if err := h.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return 0, fmt.Errorf("%w:%v", ErrSetReadTimeout, err)
+		}
+	}
 	return fd, nil
 }
 
+// assemble assembles the given BPF filter, reusing the previously assembled program if the filter is unchanged
+func (h *tcpSnifferHelperImpl) assemble(filter []bpf.Instruction) ([]bpf.RawInstruction, error) {
+	h.assembledLock.Lock()
+	defer h.assembledLock.Unlock()
+	if h.lastAssembled != nil && reflect.DeepEqual(filter, h.lastFilter) {
+		return h.lastAssembled, nil
+	}
+	assembled, err := h.BPFAssemble(filter)
+	if err != nil {
+		return nil, err
+	}
+	h.lastFilter = append([]bpf.Instruction(nil), filter...)
+	h.lastAssembled = assembled
+	return assembled, nil
+}
+
 func (h *tcpSnifferHelperImpl) UnmarshalTCPPacket(in []byte) (*TCPPacket, error) {
 	if len(in) < 20 {
 		return nil, ErrMessageTooShort
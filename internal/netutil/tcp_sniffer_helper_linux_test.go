@@ -12,6 +12,7 @@ import (
 	"reflect"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/digitalocean/droplet-agent/internal/netutil/internal/mocks"
@@ -23,6 +24,7 @@ import (
 func Test_tcpSnifferHelperImpl_ToBpfFilters(t *testing.T) {
 	tests := []struct {
 		name       string
+		captureLen uint32
 		identifier *TCPPacketIdentifier
 		want       []bpf.Instruction
 		wantErr    error
@@ -113,10 +115,24 @@ func Test_tcpSnifferHelperImpl_ToBpfFilters(t *testing.T) {
 			},
 			wantErr: nil,
 		},
+		{
+			name:       "should return the configured capture length",
+			captureLen: 9000,
+			identifier: &TCPPacketIdentifier{
+				TargetPort: 22,
+			},
+			want: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 22, Size: 2},
+				bpf.JumpIf{Val: 22, SkipFalse: 1},
+				bpf.RetConstant{Val: 9000},
+				bpf.RetConstant{Val: 0x0},
+			},
+			wantErr: nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &tcpSnifferHelperImpl{}
+			h := &tcpSnifferHelperImpl{captureLen: tt.captureLen}
 			got, err := h.ToBpfFilters(tt.identifier)
 			if (err != nil) && !errors.Is(err, tt.wantErr) {
 				t.Errorf("ToBpfFilters() error = %v, wantErr %v", err, tt.wantErr)
@@ -137,10 +153,11 @@ func Test_tcpSnifferHelperImpl_SocketWithBPFFilter(t *testing.T) {
 	sampleFD := 255
 
 	tests := []struct {
-		name    string
-		prepare func(fn *mocks.MockdependentFns)
-		want    int
-		wantErr error
+		name        string
+		readTimeout time.Duration
+		prepare     func(fn *mocks.MockdependentFns)
+		want        int
+		wantErr     error
 	}{
 		{
 			name: "should return ErrCreateSocket if failed to create socket",
@@ -205,6 +222,33 @@ func Test_tcpSnifferHelperImpl_SocketWithBPFFilter(t *testing.T) {
 			want:    sampleFD,
 			wantErr: nil,
 		},
+		{
+			name:        "should return ErrSetReadTimeout if failed to set the read timeout",
+			readTimeout: time.Second,
+			prepare: func(fn *mocks.MockdependentFns) {
+				fn.EXPECT().SockCreate(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP).Return(sampleFD, nil)
+				fn.EXPECT().BPFAssemble(bpfFilter).Return(assembledFilter, nil)
+				fn.EXPECT().Syscall6(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(uintptr(0), uintptr(0), syscall.Errno(0))
+				fn.EXPECT().SetsockoptTimeval(sampleFD, unix.SOL_SOCKET, unix.SO_RCVTIMEO, gomock.Any()).Return(errors.New("err-set-timeout"))
+				fn.EXPECT().Close(sampleFD).Return(nil)
+			},
+			want:    0,
+			wantErr: ErrSetReadTimeout,
+		},
+		{
+			name:        "should set the configured read timeout",
+			readTimeout: 1500 * time.Millisecond,
+			prepare: func(fn *mocks.MockdependentFns) {
+				fn.EXPECT().SockCreate(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP).Return(sampleFD, nil)
+				fn.EXPECT().BPFAssemble(bpfFilter).Return(assembledFilter, nil)
+				fn.EXPECT().Syscall6(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(uintptr(0), uintptr(0), syscall.Errno(0))
+				fn.EXPECT().SetsockoptTimeval(sampleFD, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1, Usec: 500000}).Return(nil)
+			},
+			want:    sampleFD,
+			wantErr: nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -218,6 +262,7 @@ func Test_tcpSnifferHelperImpl_SocketWithBPFFilter(t *testing.T) {
 
 			h := &tcpSnifferHelperImpl{
 				dependentFns: dependentFnsMock,
+				readTimeout:  tt.readTimeout,
 			}
 			got, err := h.SocketWithBPFFilter(bpfFilter)
 			if (err != nil) && !errors.Is(err, tt.wantErr) {
@@ -231,6 +276,36 @@ func Test_tcpSnifferHelperImpl_SocketWithBPFFilter(t *testing.T) {
 	}
 }
 
+func Test_tcpSnifferHelperImpl_SocketWithBPFFilter_reusesAssembledFilter(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	dependentFnsMock := mocks.NewMockdependentFns(mockCtl)
+	h := &tcpSnifferHelperImpl{
+		dependentFns: dependentFnsMock,
+	}
+	filter1, err := h.ToBpfFilters(&TCPPacketIdentifier{TargetPort: 22})
+	if err != nil {
+		t.Fatalf("ToBpfFilters() unexpected error = %v", err)
+	}
+	filter2, err := h.ToBpfFilters(&TCPPacketIdentifier{TargetPort: 2222})
+	if err != nil {
+		t.Fatalf("ToBpfFilters() unexpected error = %v", err)
+	}
+
+	dependentFnsMock.EXPECT().SockCreate(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP).Return(255, nil).Times(3)
+	dependentFnsMock.EXPECT().Syscall6(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(uintptr(0), uintptr(0), syscall.Errno(0)).Times(3)
+	// the filter is assembled once for the same identifier, and again once the identifier changes
+	dependentFnsMock.EXPECT().BPFAssemble(filter1).Return([]bpf.RawInstruction{{}}, nil).Times(1)
+	dependentFnsMock.EXPECT().BPFAssemble(filter2).Return([]bpf.RawInstruction{{}}, nil).Times(1)
+
+	for _, filter := range [][]bpf.Instruction{filter1, filter1, filter2} {
+		if _, err := h.SocketWithBPFFilter(filter); err != nil {
+			t.Fatalf("SocketWithBPFFilter() unexpected error = %v", err)
+		}
+	}
+}
+
 func Test_tcpSnifferHelperImpl_UnmarshalTCPPacket(t *testing.T) {
 	examplePacket := &TCPPacket{
 		Source:      1234,
@@ -3,6 +3,8 @@
 package netutil
 
 import (
+	"errors"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/digitalocean/droplet-agent/internal/log"
@@ -26,12 +28,15 @@ const (
 	lenIPHeader = 20
 )
 
-const maxPacketBuf = 512
-
 // NewTCPPacketSniffer returns a new TCP packet sniffer
-func NewTCPPacketSniffer() TCPPacketSniffer {
+func NewTCPPacketSniffer(opts ...SnifferOpt) TCPPacketSniffer {
+	defaultOpts := defaultSnifferOpts()
+	for _, opt := range opts {
+		opt(defaultOpts)
+	}
 	return &tcpPacketSniffer{
-		tcpPacketSnifferHelper: newTCPPacketSnifferHelper(),
+		tcpPacketSnifferHelper: newTCPPacketSnifferHelper(defaultOpts.captureLen, defaultOpts.readTimeout),
+		captureLen:             defaultOpts.captureLen,
 	}
 }
 
@@ -45,7 +50,9 @@ type tcpPacketSnifferHelper interface {
 type tcpPacketSniffer struct {
 	tcpPacketSnifferHelper
 
-	fd int
+	fd         int
+	captureLen uint32
+	stopped    atomic.Bool
 }
 
 func (s *tcpPacketSniffer) Capture(identifier *TCPPacketIdentifier) (<-chan *TCPPacket, error) {
@@ -59,23 +66,37 @@ func (s *tcpPacketSniffer) Capture(identifier *TCPPacketIdentifier) (<-chan *TCP
 		return nil, err
 	}
 	s.fd = fd
+	s.stopped.Store(false)
 	packetChan := make(chan *TCPPacket)
 	go s.snifferLoop(packetChan)
 	return packetChan, nil
 }
 
 func (s *tcpPacketSniffer) Stop() {
+	s.stopped.Store(true)
 	if s.fd != 0 {
 		_ = syscall.Close(s.fd)
 	}
 }
 
 func (s *tcpPacketSniffer) snifferLoop(packetChan chan<- *TCPPacket) {
-	buffer := make([]byte, maxPacketBuf)
+	bufLen := s.captureLen
+	if bufLen == 0 {
+		bufLen = maxPacketBuf
+	}
+	buffer := make([]byte, bufLen)
 	minMsgLen := lenIPHeader + offOption
 	for {
 		n, err := syscall.Read(s.fd, buffer)
+		if s.stopped.Load() {
+			log.Info("Sniffer quit")
+			return
+		}
 		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				// the read timed out or was interrupted without receiving any packet
+				continue
+			}
 			log.Error("failed to read from socket. %v", err)
 			continue
 		}
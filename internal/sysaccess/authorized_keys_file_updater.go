@@ -3,11 +3,13 @@
 package sysaccess
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/digitalocean/droplet-agent/internal/log"
 	"github.com/digitalocean/droplet-agent/internal/sysutil"
@@ -15,6 +17,7 @@ import (
 
 type authorizedKeysFileUpdater interface {
 	updateAuthorizedKeysFile(osUsername string, managedKeys []*SSHKey) error
+	pruneAuthorizedKeysFile(osUsername string, dropletKeys []*SSHKey) error
 }
 
 type updaterImpl struct {
@@ -24,11 +27,17 @@ type updaterImpl struct {
 }
 
 func (u *updaterImpl) updateAuthorizedKeysFile(osUsername string, managedKeys []*SSHKey) error {
-	osUser, err := u.sshMgr.sysMgr.GetUserByName(osUsername)
+	osUser, err := u.sshMgr.lookupUser(osUsername)
 	if err != nil {
 		return err
 	}
 	authorizedKeysFile := u.sshMgr.authorizedKeysFile(osUser)
+	linked := false
+	if u.sshMgr.allowSymlinkedKeysFile {
+		if authorizedKeysFile, linked, err = u.resolveKeysFile(authorizedKeysFile, osUser); err != nil {
+			return err
+		}
+	}
 
 	// We must make sure we are exclusively accessing the authorized_keys file
 	keysFileLockRaw, _ := u.keysFileLocks.LoadOrStore(authorizedKeysFile, &sync.Mutex{})
@@ -37,15 +46,22 @@ func (u *updaterImpl) updateAuthorizedKeysFile(osUsername string, managedKeys []
 	defer keysFileLock.Unlock()
 
 	dir := filepath.Dir(authorizedKeysFile)
-	log.Debug("ensuring dir [%s] exists for user [%s]", dir, osUser.Name)
-	if err = u.sshMgr.sysMgr.MkDirIfNonExist(dir, osUser, 0700); err != nil {
-		return err
+	// the directory of a link target already exists, and is not the agent's to create or fix
+	if !u.sshMgr.dryRun && !linked {
+		log.Debug("ensuring dir [%s] exists for user [%s]", dir, osUser.Name)
+		if err = u.sshMgr.sysMgr.MkDirIfNonExist(dir, osUser, 0700); err != nil {
+			return err
+		}
+		if err = u.sshMgr.fixSSHDirPermissions(osUser, authorizedKeysFile); err != nil {
+			// sshd may refuse the keys, but they can still be updated
+			log.Error("failed to fix the permissions of [%s]: %v", dir, err)
+		}
 	}
 	fileExist := true
-	localKeysRaw, err := u.sshMgr.sysMgr.ReadFile(authorizedKeysFile)
+	localKeysRaw, err := u.readKeysFile(authorizedKeysFile, osUser, linked)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			return fmt.Errorf("%w:%v", ErrReadAuthorizedKeysFileFailed, err)
+			return err
 		}
 		fileExist = false
 	}
@@ -53,12 +69,235 @@ func (u *updaterImpl) updateAuthorizedKeysFile(osUsername string, managedKeys []
 	if localKeysRaw != nil {
 		localKeys = strings.Split(strings.TrimRight(string(localKeysRaw), "\n"), "\n")
 	}
+	managedKeys = u.sshMgr.skipKeysInSecondaryFiles(osUser, managedKeys)
 	updatedKeys := u.sshMgr.prepareAuthorizedKeys(localKeys, managedKeys)
-	return u.do(authorizedKeysFile, osUser, updatedKeys, fileExist)
+	if u.sshMgr.dryRun {
+		removed, added := diffLines(localKeys, updatedKeys)
+		log.Info("[dry run] [%s] not updated, would remove lines: %q, would add lines: %q", authorizedKeysFile, removed, added)
+		return nil
+	}
+	if err = u.do(authorizedKeysFile, osUser, updatedKeys, fileExist, linked, len(localKeysRaw)); err != nil {
+		return err
+	}
+	u.recordDiff(authorizedKeysFile, localKeys, updatedKeys)
+	return nil
+}
+
+// pruneAuthorizedKeysFile removes the stale droplet keys from the authorized_keys file of the given user, i.e. the
+// ones no longer among the given droplet keys. Unlike updateAuthorizedKeysFile, the other keys are left untouched, and
+// the file is neither created nor rewritten if there is nothing to remove.
+func (u *updaterImpl) pruneAuthorizedKeysFile(osUsername string, dropletKeys []*SSHKey) error {
+	osUser, err := u.sshMgr.lookupUser(osUsername)
+	if err != nil {
+		return err
+	}
+	authorizedKeysFile := u.sshMgr.authorizedKeysFile(osUser)
+	linked := false
+	if u.sshMgr.allowSymlinkedKeysFile {
+		if authorizedKeysFile, linked, err = u.resolveKeysFile(authorizedKeysFile, osUser); err != nil {
+			return err
+		}
+	}
+
+	keysFileLockRaw, _ := u.keysFileLocks.LoadOrStore(authorizedKeysFile, &sync.Mutex{})
+	keysFileLock := keysFileLockRaw.(*sync.Mutex)
+	keysFileLock.Lock()
+	defer keysFileLock.Unlock()
+
+	localKeysRaw, err := u.readKeysFile(authorizedKeysFile, osUser, linked)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	localKeys := strings.Split(strings.TrimRight(string(localKeysRaw), "\n"), "\n")
+	prunedKeys := pruneStaleDropletKeys(localKeys, dropletKeys)
+	if len(prunedKeys) == len(localKeys) {
+		log.Debug("no stale droplet keys in [%s]", authorizedKeysFile)
+		return nil
+	}
+	if u.sshMgr.dryRun {
+		removed, _ := diffLines(localKeys, prunedKeys)
+		log.Info("[dry run] [%s] not pruned, would remove lines: %q", authorizedKeysFile, removed)
+		return nil
+	}
+	if err = u.do(authorizedKeysFile, osUser, prunedKeys, true, linked, len(localKeysRaw)); err != nil {
+		return err
+	}
+	u.recordDiff(authorizedKeysFile, localKeys, prunedKeys)
+	return nil
+}
+
+// lookupUser returns the os user of the given name, falling back to the static users if it cannot be resolved
+// through the system
+func (s *SSHManager) lookupUser(username string) (*sysutil.User, error) {
+	user, err := s.sysMgr.GetUserByName(username)
+	if err != nil {
+		staticUser, ok := s.staticUsers[username]
+		if !ok {
+			return nil, err
+		}
+		log.Info("failed to get user [%s] from the system, using the static user instead: %v", username, err)
+		return staticUser, nil
+	}
+	return user, nil
+}
+
+// skipKeysInSecondaryFiles drops the droplet keys that are already present in the other files listed by the
+// AuthorizedKeysFile, since sshd accepts them from there already, writing them to the primary file would only
+// duplicate them
+func (s *SSHManager) skipKeysInSecondaryFiles(user *sysutil.User, managedKeys []*SSHKey) []*SSHKey {
+	if len(managedKeys) == 0 {
+		return managedKeys
+	}
+	patterns := s.secondaryAuthorizedKeysFilePatternsFor(user)
+	if len(patterns) == 0 {
+		return managedKeys
+	}
+	existingKeys := make(map[string]bool)
+	for _, pattern := range patterns {
+		file := expandAuthorizedKeysFilePattern(pattern, user)
+		content, err := s.sysMgr.ReadFile(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Error("failed to read [%s], its keys will not be deduplicated: %v", file, err)
+			}
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if fpt, err := keyFingerprint(strings.Trim(line, " \t")); err == nil {
+				existingKeys[fpt] = true
+			}
+		}
+	}
+	if len(existingKeys) == 0 {
+		return managedKeys
+	}
+	ret := make([]*SSHKey, 0, len(managedKeys))
+	for _, key := range managedKeys {
+		if key.Type == SSHKeyTypeDroplet && existingKeys[key.fingerprint] {
+			log.Debug("droplet key [%s] of user [%s] is already present in a secondary authorized_keys file, skipped", key.fingerprint, user.Name)
+			continue
+		}
+		ret = append(ret, key)
+	}
+	return ret
+}
+
+// resolveKeysFile returns the file the given authorized_keys file links to, so that it's updated in place of the link,
+// and whether it's a link at all. The link target must be owned by the user, otherwise the user could have the agent
+// write to any file. Since the user may also control the directories leading to the target, and swap one of them for
+// a symlink once resolved, the target must then only be accessed through readKeysFile and do.
+func (u *updaterImpl) resolveKeysFile(authorizedKeysFile string, user *sysutil.User) (string, bool, error) {
+	target, err := u.sshMgr.sysMgr.EvalSymlinks(authorizedKeysFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nothing to resolve, the file will be created
+			return authorizedKeysFile, false, nil
+		}
+		return "", false, fmt.Errorf("%w:%v", ErrReadAuthorizedKeysFileFailed, err)
+	}
+	if target == authorizedKeysFile {
+		return authorizedKeysFile, false, nil
+	}
+	owner, err := u.sshMgr.sysMgr.FileOwnerUID(target)
+	if err != nil {
+		return "", false, fmt.Errorf("%w:%v", ErrReadAuthorizedKeysFileFailed, err)
+	}
+	if owner != user.UID {
+		return "", false, fmt.Errorf("%w: [%s] links to [%s], which is owned by uid [%d] instead of user [%s]",
+			ErrUnsafeAuthorizedKeysFileLink, authorizedKeysFile, target, owner, user.Name)
+	}
+	log.Debug("[%s] links to [%s], updating the link target", authorizedKeysFile, target)
+	return target, true, nil
+}
+
+// readKeysFile reads the authorized_keys file. A link target is read without following symlinks, through directories
+// owned by root or the user only.
+func (u *updaterImpl) readKeysFile(authorizedKeysFile string, user *sysutil.User, linked bool) ([]byte, error) {
+	if !linked {
+		content, err := u.sshMgr.sysMgr.ReadFile(authorizedKeysFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w:%v", ErrReadAuthorizedKeysFileFailed, err)
+		}
+		return content, err
+	}
+	content, err := u.sshMgr.sysMgr.ReadFileNoFollow(authorizedKeysFile, user)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w:%v", linkTargetErr(err, ErrReadAuthorizedKeysFileFailed), err)
+	}
+	return content, err
+}
+
+// linkTargetErr returns the error to report when a link target cannot be accessed, which is
+// ErrUnsafeAuthorizedKeysFileLink if the target is reached in an unsafe way
+func linkTargetErr(err, fallback error) error {
+	if errors.Is(err, sysutil.ErrUnsafePath) {
+		return ErrUnsafeAuthorizedKeysFileLink
+	}
+	return fallback
+}
+
+// recordDiff keeps a trail of the lines removed and added by an update, so that an unexpected key loss can be analyzed
+func (u *updaterImpl) recordDiff(authorizedKeysFile string, before, after []string) {
+	removed, added := diffLines(before, after)
+	log.Debug("[%s] updated, removed lines: %q, added lines: %q", authorizedKeysFile, removed, added)
+	u.sshMgr.keysFileDiffs.record(&KeysFileDiff{
+		File:      authorizedKeysFile,
+		UpdatedAt: time.Now(),
+		Removed:   removed,
+		Added:     added,
+	})
+}
+
+// contentSize returns the size of the authorized_keys file made of the given lines
+func contentSize(lines []string) int {
+	size := 0
+	for _, l := range lines {
+		size += len(l) + 1
+	}
+	return size
+}
+
+// checkFreeSpace makes sure the filesystem of the given dir has at least the configured free space left.
+// The update proceeds if the free space cannot be determined.
+func (u *updaterImpl) checkFreeSpace(dir string) error {
+	if u.sshMgr.minFreeDiskSpace == 0 {
+		return nil
+	}
+	free, err := u.sshMgr.sysMgr.FreeSpace(dir)
+	if err != nil {
+		log.Error("failed to get the free space of [%s], updating anyway: %v", dir, err)
+		return nil
+	}
+	if free < u.sshMgr.minFreeDiskSpace {
+		return fmt.Errorf("%w: [%s] has %d bytes free, at least %d required", ErrInsufficientDiskSpace, dir, free, u.sshMgr.minFreeDiskSpace)
+	}
+	return nil
 }
 
-func (u *updaterImpl) do(authorizedKeysFile string, user *sysutil.User, lines []string, srcFileExist bool) (retErr error) {
+// do replaces the content of the authorized_keys file with the given lines, currentSize is the size of its current
+// content in bytes. A link target is replaced relative to its directory, opened without following symlinks.
+func (u *updaterImpl) do(authorizedKeysFile string, user *sysutil.User, lines []string, srcFileExist, linked bool, currentSize int) (retErr error) {
 	log.Debug("updating [%s]", authorizedKeysFile)
+	// updates that do not grow the file, e.g. removing expired or revoked keys, must not be blocked by a full disk
+	if contentSize(lines) > currentSize {
+		if err := u.checkFreeSpace(filepath.Dir(authorizedKeysFile)); err != nil {
+			return err
+		}
+	}
+	if linked {
+		content := &strings.Builder{}
+		for _, l := range lines {
+			fmt.Fprintf(content, "%s\n", l)
+		}
+		if err := u.sshMgr.sysMgr.ReplaceFileNoFollow(authorizedKeysFile, user, []byte(content.String()), 0600); err != nil {
+			return fmt.Errorf("%w:%v", linkTargetErr(err, ErrWriteAuthorizedKeysFileFailed), err)
+		}
+		log.Debug("[%s] updated", authorizedKeysFile)
+		return nil
+	}
 	tmpFilePath := authorizedKeysFile + ".dotty"
 	tmpFile, err := u.sshMgr.sysMgr.CreateFileForWrite(tmpFilePath, user, 0600)
 	if err != nil {
@@ -73,7 +312,16 @@ func (u *updaterImpl) do(authorizedKeysFile string, user *sysutil.User, lines []
 	}()
 
 	for _, l := range lines {
-		_, _ = fmt.Fprintf(tmpFile, "%s\n", l)
+		if _, err := fmt.Fprintf(tmpFile, "%s\n", l); err != nil {
+			return fmt.Errorf("%w: failed to write tmp file: %v", ErrWriteAuthorizedKeysFileFailed, err)
+		}
+	}
+	// the content must reach the disk before the tmp file replaces the authorized_keys file,
+	// otherwise a crash may leave an empty or partially written authorized_keys file behind
+	if syncer, ok := tmpFile.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return fmt.Errorf("%w: failed to sync tmp file: %v", ErrWriteAuthorizedKeysFileFailed, err)
+		}
 	}
 
 	if srcFileExist {
@@ -87,5 +335,9 @@ func (u *updaterImpl) do(authorizedKeysFile string, user *sysutil.User, lines []
 	if err := u.sshMgr.sysMgr.RenameFile(tmpFilePath, authorizedKeysFile); err != nil {
 		return fmt.Errorf("%w:failed to rename:%v", ErrWriteAuthorizedKeysFileFailed, err)
 	}
+	// persist the rename itself
+	if err := u.sshMgr.sysMgr.SyncDir(filepath.Dir(authorizedKeysFile)); err != nil {
+		return fmt.Errorf("%w:failed to sync dir:%v", ErrWriteAuthorizedKeysFileFailed, err)
+	}
 	return nil
 }
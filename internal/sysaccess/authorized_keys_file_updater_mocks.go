@@ -51,3 +51,17 @@ func (mr *MockauthorizedKeysFileUpdaterMockRecorder) updateAuthorizedKeysFile(os
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "updateAuthorizedKeysFile", reflect.TypeOf((*MockauthorizedKeysFileUpdater)(nil).updateAuthorizedKeysFile), osUsername, managedKeys)
 }
+
+// pruneAuthorizedKeysFile mocks base method.
+func (m *MockauthorizedKeysFileUpdater) pruneAuthorizedKeysFile(osUsername string, dropletKeys []*SSHKey) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "pruneAuthorizedKeysFile", osUsername, dropletKeys)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// pruneAuthorizedKeysFile indicates an expected call of pruneAuthorizedKeysFile.
+func (mr *MockauthorizedKeysFileUpdaterMockRecorder) pruneAuthorizedKeysFile(osUsername, dropletKeys any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "pruneAuthorizedKeysFile", reflect.TypeOf((*MockauthorizedKeysFileUpdater)(nil).pruneAuthorizedKeysFile), osUsername, dropletKeys)
+}
@@ -14,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/digitalocean/droplet-agent/internal/log"
 	"github.com/digitalocean/droplet-agent/internal/sysaccess/internal/mocks"
@@ -175,6 +176,7 @@ func Test_updaterImpl_updateAuthorizedKeysFile(t *testing.T) {
 				sysMgr.EXPECT().CreateFileForWrite(tmpFile, validUser1, os.FileMode(0600)).Return(recorder, nil)
 				sysMgr.EXPECT().CopyFileAttribute(authorizedKeyFile, tmpFile).Return(nil)
 				sysMgr.EXPECT().RenameFile(tmpFile, authorizedKeyFile).Return(nil)
+				sysMgr.EXPECT().SyncDir(authorizedKeyFileDir).Return(nil)
 			},
 			[]*SSHKey{
 				validKey1,
@@ -201,6 +203,7 @@ func Test_updaterImpl_updateAuthorizedKeysFile(t *testing.T) {
 				sysMgr.EXPECT().CreateFileForWrite(tmpFile, validUser1, os.FileMode(0600)).Return(recorder, nil)
 				sysMgr.EXPECT().CopyFileAttribute(authorizedKeyFile, tmpFile).Return(nil)
 				sysMgr.EXPECT().RenameFile(tmpFile, authorizedKeyFile).Return(nil)
+				sysMgr.EXPECT().SyncDir(authorizedKeyFileDir).Return(nil)
 			},
 			[]*SSHKey{
 				validKey1,
@@ -223,6 +226,7 @@ func Test_updaterImpl_updateAuthorizedKeysFile(t *testing.T) {
 				sshHelper.EXPECT().prepareAuthorizedKeys([]string{}, []*SSHKey{validKey1}).Return([]string{"line1", "line2"})
 				sysMgr.EXPECT().CreateFileForWrite(tmpFile, validUser1, os.FileMode(0600)).Return(recorder, nil)
 				sysMgr.EXPECT().RenameFile(tmpFile, authorizedKeyFile).Return(nil)
+				sysMgr.EXPECT().SyncDir(authorizedKeyFileDir).Return(nil)
 			},
 			[]*SSHKey{
 				validKey1,
@@ -315,10 +319,12 @@ func Test_updaterImpl_updateAuthorizedKeysFile_threadSafe(t *testing.T) {
 			keysFile := fmt.Sprintf("/home/%s/.ssh/authorized_keys", strUser)
 			sshHelperMock.EXPECT().authorizedKeysFile(user).Return(keysFile).Times(concurrentUpdatePerUser)
 			sysMgrMock.EXPECT().MkDirIfNonExist(filepath.Dir(keysFile), user, os.FileMode(0700)).Return(nil).Times(concurrentUpdatePerUser)
+			sysMgrMock.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, nil).Times(concurrentUpdatePerUser)
 
 			tmpFilePath := keysFile + ".dotty"
 			sysMgrMock.EXPECT().CopyFileAttribute(keysFile, tmpFilePath).Return(nil).Times(concurrentUpdatePerUser)
 			sysMgrMock.EXPECT().RenameFile(tmpFilePath, keysFile).Return(nil).Times(concurrentUpdatePerUser)
+			sysMgrMock.EXPECT().SyncDir(filepath.Dir(keysFile)).Return(nil).Times(concurrentUpdatePerUser)
 
 			originalFile := ""
 			for j := 0; j != concurrentUpdatePerUser; j++ {
@@ -372,3 +378,527 @@ func Test_updaterImpl_updateAuthorizedKeysFile_threadSafe(t *testing.T) {
 		}
 	})
 }
+
+func Test_updaterImpl_updateAuthorizedKeysFile_recordsDiffs(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+	sshHelperMock := NewMocksshHelper(mockCtl)
+
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	tmpFilePath := keysFile + ".dotty"
+	fakeKeys := []*SSHKey{{}}
+
+	updates := [][]string{
+		{"# customer key", "key1"},
+		{"# customer key", "key1", dottyComment, "dotty1"},
+		{"# customer key", "key1", dottyComment, "dotty2"},
+		{"# customer key", dottyComment, "dotty2"},
+	}
+	for i := 1; i != len(updates); i++ {
+		sysMgrMock.EXPECT().GetUserByName(user.Name).Return(user, nil)
+		sshHelperMock.EXPECT().authorizedKeysFile(user).Return(keysFile)
+		sysMgrMock.EXPECT().MkDirIfNonExist(filepath.Dir(keysFile), user, os.FileMode(0700)).Return(nil)
+		sysMgrMock.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, nil)
+		sysMgrMock.EXPECT().ReadFile(keysFile).Return([]byte(strings.Join(updates[i-1], "\n")+"\n"), nil)
+		sshHelperMock.EXPECT().prepareAuthorizedKeys(updates[i-1], fakeKeys).Return(updates[i])
+		sysMgrMock.EXPECT().CreateFileForWrite(tmpFilePath, user, os.FileMode(0600)).Return(&recorder{}, nil)
+		sysMgrMock.EXPECT().CopyFileAttribute(keysFile, tmpFilePath).Return(nil)
+		sysMgrMock.EXPECT().RenameFile(tmpFilePath, keysFile).Return(nil)
+		sysMgrMock.EXPECT().SyncDir(filepath.Dir(keysFile)).Return(nil)
+	}
+
+	sshMgr := &SSHManager{
+		sysMgr:        sysMgrMock,
+		sshHelper:     sshHelperMock,
+		keysFileDiffs: newKeysFileDiffHistory(2),
+	}
+	u := &updaterImpl{
+		sshMgr: sshMgr,
+	}
+	for i := 1; i != len(updates); i++ {
+		if err := u.updateAuthorizedKeysFile(user.Name, fakeKeys); err != nil {
+			t.Fatalf("updateAuthorizedKeysFile() unexpected error = %v", err)
+		}
+	}
+
+	got := sshMgr.RecentKeysFileDiffs()
+	if len(got) != 2 {
+		t.Fatalf("RecentKeysFileDiffs() got %d diffs, want 2", len(got))
+	}
+	want := []KeysFileDiff{
+		{File: keysFile, Removed: []string{"dotty1"}, Added: []string{"dotty2"}},
+		{File: keysFile, Removed: []string{"key1"}},
+	}
+	for i := range want {
+		got[i].UpdatedAt = time.Time{}
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("RecentKeysFileDiffs()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func Test_updaterImpl_updateAuthorizedKeysFile_staticUsers(t *testing.T) {
+	log.Mute()
+	getUserErr := errors.New("get-user-error")
+	staticUser := &sysutil.User{Name: "app", UID: 1000, GID: 1000, HomeDir: "/srv/app"}
+	tests := []struct {
+		name        string
+		username    string
+		staticUsers map[string]*sysutil.User
+		wantErr     error
+	}{
+		{
+			"should use the static user if failed to get the user from the system",
+			"app",
+			map[string]*sysutil.User{"app": staticUser},
+			nil,
+		},
+		{
+			"should return error if the user is not in the static users either",
+			"other",
+			map[string]*sysutil.User{"app": staticUser},
+			getUserErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().GetUserByName(tt.username).Return(nil, getUserErr)
+			if tt.wantErr == nil {
+				keysFile := "/srv/app/.ssh/authorized_keys"
+				tmpFilePath := keysFile + ".dotty"
+				sysMgrMock.EXPECT().MkDirIfNonExist("/srv/app/.ssh", staticUser, os.FileMode(0700)).Return(nil)
+				sysMgrMock.EXPECT().EnsureSSHDirPermissions(keysFile, staticUser).Return(false, nil)
+				sysMgrMock.EXPECT().ReadFile(keysFile).Return(nil, os.ErrNotExist)
+				sysMgrMock.EXPECT().CreateFileForWrite(tmpFilePath, staticUser, os.FileMode(0600)).Return(&recorder{}, nil)
+				sysMgrMock.EXPECT().RenameFile(tmpFilePath, keysFile).Return(nil)
+				sysMgrMock.EXPECT().SyncDir("/srv/app/.ssh").Return(nil)
+			}
+
+			sshMgr := &SSHManager{
+				authorizedKeysFilePattern: defaultAuthorizedKeysFile,
+				sysMgr:                    sysMgrMock,
+				staticUsers:               tt.staticUsers,
+			}
+			sshMgr.sshHelper = &sshHelperImpl{mgr: sshMgr}
+			u := &updaterImpl{
+				sshMgr: sshMgr,
+			}
+			if err := u.updateAuthorizedKeysFile(tt.username, []*SSHKey{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("updateAuthorizedKeysFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_updaterImpl_updateAuthorizedKeysFile_dryRun(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+	sshHelperMock := NewMocksshHelper(mockCtl)
+
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	fakeKeys := []*SSHKey{{}}
+
+	sysMgrMock.EXPECT().GetUserByName(user.Name).Return(user, nil)
+	sshHelperMock.EXPECT().authorizedKeysFile(user).Return(keysFile)
+	sysMgrMock.EXPECT().ReadFile(keysFile).Return([]byte("key1\n"), nil)
+	sshHelperMock.EXPECT().prepareAuthorizedKeys([]string{"key1"}, fakeKeys).Return([]string{"key1", dottyComment, "dotty1"})
+	// no calls to MkDirIfNonExist, CreateFileForWrite, CopyFileAttribute or RenameFile are expected
+
+	sshMgr := &SSHManager{
+		sysMgr:        sysMgrMock,
+		sshHelper:     sshHelperMock,
+		dryRun:        true,
+		keysFileDiffs: newKeysFileDiffHistory(defaultKeysFileDiffHistorySize),
+	}
+	u := &updaterImpl{
+		sshMgr: sshMgr,
+	}
+	if err := u.updateAuthorizedKeysFile(user.Name, fakeKeys); err != nil {
+		t.Errorf("updateAuthorizedKeysFile() unexpected error = %v", err)
+	}
+	if got := sshMgr.RecentKeysFileDiffs(); len(got) != 0 {
+		t.Errorf("updateAuthorizedKeysFile() should not record diffs in dry run, got %v", got)
+	}
+}
+
+type syncRecorder struct {
+	recorder
+	events  *[]string
+	syncErr error
+}
+
+func (r *syncRecorder) Sync() error {
+	*r.events = append(*r.events, "sync tmp file")
+	return r.syncErr
+}
+
+func Test_updaterImpl_do_syncs(t *testing.T) {
+	log.Mute()
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	tmpFilePath := keysFile + ".dotty"
+	syncErr := errors.New("sync-err")
+
+	tests := []struct {
+		name       string
+		syncErr    error
+		syncDirErr error
+		wantEvents []string
+		wantErr    error
+	}{
+		{
+			"should sync the tmp file before renaming it and the dir after",
+			nil,
+			nil,
+			[]string{"sync tmp file", "copy attribute", "rename", "sync dir"},
+			nil,
+		},
+		{
+			"should not replace the file if failed to sync the tmp file",
+			syncErr,
+			nil,
+			[]string{"sync tmp file", "remove tmp file"},
+			ErrWriteAuthorizedKeysFileFailed,
+		},
+		{
+			"should fail if failed to sync the dir",
+			nil,
+			syncErr,
+			[]string{"sync tmp file", "copy attribute", "rename", "sync dir", "remove tmp file"},
+			ErrWriteAuthorizedKeysFileFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+
+			events := make([]string, 0)
+			record := func(event string, err error) error {
+				events = append(events, event)
+				return err
+			}
+			tmpFile := &syncRecorder{events: &events, syncErr: tt.syncErr}
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().CreateFileForWrite(tmpFilePath, user, os.FileMode(0600)).Return(tmpFile, nil)
+			sysMgrMock.EXPECT().CopyFileAttribute(keysFile, tmpFilePath).DoAndReturn(func(_, _ string) error {
+				return record("copy attribute", nil)
+			}).MaxTimes(1)
+			sysMgrMock.EXPECT().RenameFile(tmpFilePath, keysFile).DoAndReturn(func(_, _ string) error {
+				return record("rename", nil)
+			}).MaxTimes(1)
+			sysMgrMock.EXPECT().SyncDir("/home/user1/.ssh").DoAndReturn(func(_ string) error {
+				return record("sync dir", tt.syncDirErr)
+			}).MaxTimes(1)
+			sysMgrMock.EXPECT().RemoveFile(tmpFilePath).DoAndReturn(func(_ string) error {
+				return record("remove tmp file", nil)
+			}).MaxTimes(1)
+
+			u := &updaterImpl{sshMgr: &SSHManager{sysMgr: sysMgrMock}}
+			err := u.do(keysFile, user, []string{"key1"}, true, false, 0)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("do() events = %v, want %v", events, tt.wantEvents)
+			}
+			if tmpFile.String() != "key1\n" {
+				t.Errorf("do() wrote %q, want %q", tmpFile.String(), "key1\n")
+			}
+		})
+	}
+}
+
+func Test_updaterImpl_do_minFreeDiskSpace(t *testing.T) {
+	log.Mute()
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	tmpFilePath := keysFile + ".dotty"
+	statErr := errors.New("stat-err")
+
+	tests := []struct {
+		name        string
+		currentSize int
+		wantCheck   bool
+		freeSpace   uint64
+		statErr     error
+		wantWrite   bool
+		wantErr     error
+	}{
+		{"should update the file if there is enough free space", 0, true, 4096, nil, true, nil},
+		{"should not write the tmp file if the free space is below the threshold", 0, true, 1024, nil, false, ErrInsufficientDiskSpace},
+		{"should update the file if the free space is unknown", 0, true, 0, statErr, true, nil},
+		{"should remove keys even if the free space is below the threshold", 100, false, 1024, nil, true, nil},
+		{"should rewrite the file even if the free space is below the threshold if its size is unchanged", 5, false, 1024, nil, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			if tt.wantCheck {
+				sysMgrMock.EXPECT().FreeSpace("/home/user1/.ssh").Return(tt.freeSpace, tt.statErr)
+			}
+			if tt.wantWrite {
+				sysMgrMock.EXPECT().CreateFileForWrite(tmpFilePath, user, os.FileMode(0600)).Return(&recorder{}, nil)
+				sysMgrMock.EXPECT().CopyFileAttribute(keysFile, tmpFilePath).Return(nil)
+				sysMgrMock.EXPECT().RenameFile(tmpFilePath, keysFile).Return(nil)
+				sysMgrMock.EXPECT().SyncDir("/home/user1/.ssh").Return(nil)
+			}
+
+			u := &updaterImpl{sshMgr: &SSHManager{sysMgr: sysMgrMock, minFreeDiskSpace: 2048}}
+			if err := u.do(keysFile, user, []string{"key1"}, true, false, tt.currentSize); !errors.Is(err, tt.wantErr) {
+				t.Errorf("do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_updaterImpl_updateAuthorizedKeysFile_symlinked(t *testing.T) {
+	log.Mute()
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	target := "/srv/keys/user1"
+	evalErr := errors.New("eval-err")
+
+	tests := []struct {
+		name    string
+		prepare func(sysMgr *mocks.MocksysManager)
+		wantErr error
+	}{
+		{
+			"should write through the link if the target is owned by the user",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EvalSymlinks(keysFile).Return(target, nil)
+				sysMgr.EXPECT().FileOwnerUID(target).Return(user.UID, nil)
+				sysMgr.EXPECT().ReadFileNoFollow(target, user).Return([]byte("key1\n"), nil)
+				sysMgr.EXPECT().ReplaceFileNoFollow(target, user, []byte("key1\n"), os.FileMode(0600)).Return(nil)
+			},
+			nil,
+		},
+		{
+			"should reject the link if a directory of the target became unsafe before it's read",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EvalSymlinks(keysFile).Return(target, nil)
+				sysMgr.EXPECT().FileOwnerUID(target).Return(user.UID, nil)
+				sysMgr.EXPECT().ReadFileNoFollow(target, user).Return(nil, &os.PathError{Op: "open", Path: target, Err: sysutil.ErrUnsafePath})
+			},
+			ErrUnsafeAuthorizedKeysFileLink,
+		},
+		{
+			"should reject the link if a directory of the target became unsafe before it's written",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EvalSymlinks(keysFile).Return(target, nil)
+				sysMgr.EXPECT().FileOwnerUID(target).Return(user.UID, nil)
+				sysMgr.EXPECT().ReadFileNoFollow(target, user).Return([]byte("key1\n"), nil)
+				sysMgr.EXPECT().ReplaceFileNoFollow(target, user, gomock.Any(), os.FileMode(0600)).Return(sysutil.ErrUnsafePath)
+			},
+			ErrUnsafeAuthorizedKeysFileLink,
+		},
+		{
+			"should reject the link if the target is owned by another user",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EvalSymlinks(keysFile).Return(target, nil)
+				sysMgr.EXPECT().FileOwnerUID(target).Return(0, nil)
+			},
+			ErrUnsafeAuthorizedKeysFileLink,
+		},
+		{
+			"should update the file as usual if it's not a link",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EvalSymlinks(keysFile).Return(keysFile, nil)
+				sysMgr.EXPECT().MkDirIfNonExist("/home/user1/.ssh", user, os.FileMode(0700)).Return(nil)
+				sysMgr.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, nil)
+				sysMgr.EXPECT().ReadFile(keysFile).Return(nil, os.ErrNotExist)
+				sysMgr.EXPECT().CreateFileForWrite(keysFile+".dotty", user, os.FileMode(0600)).Return(&recorder{}, nil)
+				sysMgr.EXPECT().RenameFile(keysFile+".dotty", keysFile).Return(nil)
+				sysMgr.EXPECT().SyncDir("/home/user1/.ssh").Return(nil)
+			},
+			nil,
+		},
+		{
+			"should create the file if it does not exist yet",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EvalSymlinks(keysFile).Return("", os.ErrNotExist)
+				sysMgr.EXPECT().MkDirIfNonExist("/home/user1/.ssh", user, os.FileMode(0700)).Return(nil)
+				sysMgr.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, nil)
+				sysMgr.EXPECT().ReadFile(keysFile).Return(nil, os.ErrNotExist)
+				sysMgr.EXPECT().CreateFileForWrite(keysFile+".dotty", user, os.FileMode(0600)).Return(&recorder{}, nil)
+				sysMgr.EXPECT().RenameFile(keysFile+".dotty", keysFile).Return(nil)
+				sysMgr.EXPECT().SyncDir("/home/user1/.ssh").Return(nil)
+			},
+			nil,
+		},
+		{
+			"should fail if the link cannot be resolved",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EvalSymlinks(keysFile).Return("", evalErr)
+			},
+			ErrReadAuthorizedKeysFileFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().GetUserByName(user.Name).Return(user, nil)
+			tt.prepare(sysMgrMock)
+
+			sshMgr := &SSHManager{
+				authorizedKeysFilePattern: defaultAuthorizedKeysFile,
+				sysMgr:                    sysMgrMock,
+				allowSymlinkedKeysFile:    true,
+			}
+			sshMgr.sshHelper = &sshHelperImpl{mgr: sshMgr}
+			u := &updaterImpl{sshMgr: sshMgr}
+			if err := u.updateAuthorizedKeysFile(user.Name, nil); !errors.Is(err, tt.wantErr) {
+				t.Errorf("updateAuthorizedKeysFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_updaterImpl_updateAuthorizedKeysFile_secondaryFiles(t *testing.T) {
+	log.Mute()
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	tmpFilePath := keysFile + ".dotty"
+	centralKeysFile := "/etc/ssh/authorized_keys/user1"
+	dropletKey1 := &SSHKey{
+		PublicKey:   "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE=",
+		Type:        SSHKeyTypeDroplet,
+		fingerprint: "SHA256:w8bUbLGaB7nZg0zJisdljWq7HNMr+VOYXXVQU5nT1AI",
+	}
+	dropletKey2 := &SSHKey{
+		PublicKey:   "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBFWs0vUPi/q2dscBE5yzycy98ZSzs7kas5gNGrM62HGMUqM1lpO3nHbXqeBz/erOaPSoEk7TpR5wWMKYi6Yu3+Y=",
+		Type:        SSHKeyTypeDroplet,
+		fingerprint: "SHA256:8PEHs4nUAyUcVM6Fc6SVdaRhi6F55PiVFuh7oPH0Mgk",
+	}
+
+	tests := []struct {
+		name           string
+		centralKeys    []byte
+		centralKeysErr error
+		want           string
+	}{
+		{
+			"should skip droplet keys already present in the secondary file",
+			[]byte("# central keys\n" + dropletKey1.PublicKey + " admin@central\n"),
+			nil,
+			"local-key\n" + dropletKeyComment + "\n" + dropletKeyFmt(dropletKey2) + "\n",
+		},
+		{
+			"should write all droplet keys if the secondary file does not exist",
+			nil,
+			os.ErrNotExist,
+			"local-key\n" + dropletKeyComment + "\n" + dropletKeyFmt(dropletKey1) + "\n" + dropletKeyComment + "\n" + dropletKeyFmt(dropletKey2) + "\n",
+		},
+		{
+			"should write all droplet keys if the secondary file cannot be read",
+			nil,
+			errors.New("read-err"),
+			"local-key\n" + dropletKeyComment + "\n" + dropletKeyFmt(dropletKey1) + "\n" + dropletKeyComment + "\n" + dropletKeyFmt(dropletKey2) + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			tmpFile := &recorder{}
+
+			sysMgrMock.EXPECT().GetUserByName(user.Name).Return(user, nil)
+			sysMgrMock.EXPECT().MkDirIfNonExist("/home/user1/.ssh", user, os.FileMode(0700)).Return(nil)
+			sysMgrMock.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, nil)
+			sysMgrMock.EXPECT().ReadFile(keysFile).Return([]byte("local-key\n"), nil)
+			sysMgrMock.EXPECT().ReadFile(centralKeysFile).Return(tt.centralKeys, tt.centralKeysErr)
+			sysMgrMock.EXPECT().CreateFileForWrite(tmpFilePath, user, os.FileMode(0600)).Return(tmpFile, nil)
+			sysMgrMock.EXPECT().CopyFileAttribute(keysFile, tmpFilePath).Return(nil)
+			sysMgrMock.EXPECT().RenameFile(tmpFilePath, keysFile).Return(nil)
+			sysMgrMock.EXPECT().SyncDir("/home/user1/.ssh").Return(nil)
+
+			sshMgr := &SSHManager{
+				authorizedKeysFilePattern:           defaultAuthorizedKeysFile,
+				authorizedKeysFileSecondaryPatterns: []string{"/etc/ssh/authorized_keys/%u"},
+				sysMgr:                              sysMgrMock,
+				manageDropletKeys:                   manageDropletKeysEnabled,
+				keysFileDiffs:                       newKeysFileDiffHistory(defaultKeysFileDiffHistorySize),
+			}
+			sshMgr.sshHelper = &sshHelperImpl{mgr: sshMgr}
+			u := &updaterImpl{
+				sshMgr: sshMgr,
+			}
+			if err := u.updateAuthorizedKeysFile(user.Name, []*SSHKey{dropletKey1, dropletKey2}); err != nil {
+				t.Fatalf("updateAuthorizedKeysFile() unexpected error = %v", err)
+			}
+			if got := tmpFile.String(); got != tt.want {
+				t.Errorf("updateAuthorizedKeysFile() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_updaterImpl_updateAuthorizedKeysFile_legacyAuthorizedKeys2(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	legacyKeysFile := "/home/user1/.ssh/authorized_keys2"
+	tmpFilePath := keysFile + ".dotty"
+	dottyKey := &SSHKey{
+		OSUser:     "user1",
+		PublicKey:  "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHkfoI1jkzV53geVZ9IMvVA6uyMlYwDkHJw04LMDWuFgAsA/hiLcoRPW2T4/1b6YPLyBwbgjZXwZ31MyLWhKbLI=",
+		ActorEmail: "actor@email.com",
+		TTL:        1800,
+		Type:       SSHKeyTypeDOTTY,
+		expireAt:   time.Now().Add(1800 * time.Second),
+	}
+	tmpFile := &recorder{}
+
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config").Return([]byte("AuthorizedKeysFile .ssh/authorized_keys .ssh/authorized_keys2\n"), nil)
+	sysMgrMock.EXPECT().GetUserByName(user.Name).Return(user, nil)
+	sysMgrMock.EXPECT().MkDirIfNonExist("/home/user1/.ssh", user, os.FileMode(0700)).Return(nil)
+	sysMgrMock.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, nil)
+	sysMgrMock.EXPECT().ReadFile(keysFile).Return(nil, os.ErrNotExist)
+	// the legacy file is only read, the keys are written to the primary one
+	sysMgrMock.EXPECT().ReadFile(legacyKeysFile).Return([]byte("local-key\n"), nil)
+	sysMgrMock.EXPECT().CreateFileForWrite(tmpFilePath, user, os.FileMode(0600)).Return(tmpFile, nil)
+	sysMgrMock.EXPECT().RenameFile(tmpFilePath, keysFile).Return(nil)
+	sysMgrMock.EXPECT().SyncDir("/home/user1/.ssh").Return(nil)
+
+	sshMgr := &SSHManager{
+		sysMgr:        sysMgrMock,
+		keysFileDiffs: newKeysFileDiffHistory(defaultKeysFileDiffHistorySize),
+	}
+	sshMgr.sshHelper = &sshHelperImpl{mgr: sshMgr, customSSHDCfgFile: "/etc/ssh/sshd_config"}
+	if err := sshMgr.parseSSHDConfig(); err != nil {
+		t.Fatalf("parseSSHDConfig() unexpected error = %v", err)
+	}
+	u := &updaterImpl{
+		sshMgr: sshMgr,
+	}
+	if err := u.updateAuthorizedKeysFile(user.Name, []*SSHKey{dottyKey}); err != nil {
+		t.Fatalf("updateAuthorizedKeysFile() unexpected error = %v", err)
+	}
+	want := dottyComment + "\n" + dottyKeyFmt(dottyKey) + "\n"
+	if got := tmpFile.String(); got != want {
+		t.Errorf("updateAuthorizedKeysFile() wrote %q, want %q", got, want)
+	}
+}
@@ -4,8 +4,12 @@ package sysaccess
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/digitalocean/droplet-agent/internal/sysutil"
@@ -19,6 +23,17 @@ var (
 	ErrWriteAuthorizedKeysFileFailed = errors.New("failed to write authorized_keys file")
 	ErrInvalidPortNumber             = errors.New("invalid port number")
 	ErrInvalidArgs                   = errors.New("invalid arguments")
+	ErrWatchSSHDConfigFailed         = errors.New("failed to watch sshd config")
+	ErrInvalidShortTTLPolicy         = errors.New("invalid short ttl policy")
+	ErrInvalidStaticUsers            = errors.New("invalid static users")
+	ErrUnsafeAuthorizedKeysFileLink  = errors.New("unsafe symlinked authorized_keys file")
+	ErrAuthorizedKeysFileUnused      = errors.New("authorized_keys file not used by sshd")
+	ErrInsufficientDiskSpace         = errors.New("insufficient disk space")
+
+	// ErrSSHDConfigUnreadable and the errors below are more specific cases of ErrSSHDConfigParseFailed
+	ErrSSHDConfigUnreadable        = fmt.Errorf("%w: unreadable file", ErrSSHDConfigParseFailed)
+	ErrSSHDPortMalformed           = fmt.Errorf("%w: malformed sshd port", ErrSSHDConfigParseFailed)
+	ErrAuthorizedKeysFileMalformed = fmt.Errorf("%w: malformed AuthorizedKeysFile", ErrSSHDConfigParseFailed)
 )
 
 // SSHKeyType indicates the type of the ssh key.
@@ -33,6 +48,67 @@ const (
 	SSHKeyTypeDroplet
 )
 
+// ShortTTLPolicy decides how a DOTTY key whose TTL is shorter than the interval of the expired keys sweep is handled.
+// Such a key may stay in the authorized_keys file for up to one sweep interval after it expires.
+type ShortTTLPolicy int
+
+// supported short TTL policies
+const (
+	ShortTTLWarn   ShortTTLPolicy = iota // accept the key as is, and log a warning
+	ShortTTLClamp                        // extend the TTL of the key to the sweep interval
+	ShortTTLReject                       // reject the key
+)
+
+// ParseShortTTLPolicy parses the name of a ShortTTLPolicy, which is one of "warn", "clamp" or "reject"
+func ParseShortTTLPolicy(name string) (ShortTTLPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "warn":
+		return ShortTTLWarn, nil
+	case "clamp":
+		return ShortTTLClamp, nil
+	case "reject":
+		return ShortTTLReject, nil
+	}
+	return ShortTTLWarn, fmt.Errorf("%w: %s", ErrInvalidShortTTLPolicy, name)
+}
+
+// ParseStaticUsers parses a comma separated list of static user entries in the format of "name:uid:gid:home_dir",
+// which are used when a user cannot be resolved through the system, e.g. in minimal containers without /etc/passwd
+func ParseStaticUsers(raw string) (map[string]*sysutil.User, error) {
+	ret := make(map[string]*sysutil.User)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		items := strings.Split(entry, ":")
+		if len(items) != 4 || items[0] == "" {
+			return nil, fmt.Errorf("%w: [%s] is not in the format of name:uid:gid:home_dir", ErrInvalidStaticUsers, entry)
+		}
+		uid, err := strconv.Atoi(items[1])
+		if err != nil || uid < 0 {
+			return nil, fmt.Errorf("%w: invalid uid [%s] for user [%s]", ErrInvalidStaticUsers, items[1], items[0])
+		}
+		gid, err := strconv.Atoi(items[2])
+		if err != nil || gid < 0 {
+			return nil, fmt.Errorf("%w: invalid gid [%s] for user [%s]", ErrInvalidStaticUsers, items[2], items[0])
+		}
+		if !filepath.IsAbs(items[3]) {
+			return nil, fmt.Errorf("%w: home dir [%s] of user [%s] must be an absolute path", ErrInvalidStaticUsers, items[3], items[0])
+		}
+		if _, ok := ret[items[0]]; ok {
+			return nil, fmt.Errorf("%w: user [%s] is listed more than once", ErrInvalidStaticUsers, items[0])
+		}
+		ret[items[0]] = &sysutil.User{
+			Name:    items[0],
+			UID:     uid,
+			GID:     gid,
+			HomeDir: items[3],
+		}
+	}
+	return ret, nil
+}
+
 // SSHKey contains information of a ssh key operated by DOTTY
 type SSHKey struct {
 	OSUser     string `json:"os_user,omitempty"`
@@ -46,6 +122,41 @@ type SSHKey struct {
 	expireAt    time.Time // set once when receiving the key, equals to receivedAt + TTL
 }
 
+// KeyInfo contains the metadata of a key managed by the agent
+type KeyInfo struct {
+	OSUser      string     `json:"os_user"`
+	ActorEmail  string     `json:"actor_email,omitempty"`
+	Fingerprint string     `json:"fingerprint"`
+	ExpireAt    time.Time  `json:"expire_at"`
+	Type        SSHKeyType `json:"type"`
+}
+
+// SSHDConfigInfo contains the sshd settings resolved from sshd_config
+type SSHDConfigInfo struct {
+	ConfigFile                string
+	Port                      int
+	AuthorizedKeysFilePattern string
+	AuthorizedKeysFileUnused  bool    // set if sshd only reads keys through the AuthorizedKeysCommand
+	ParseErrors               []error // errors encountered while parsing sshd_config
+}
+
+// SSHDConfigErrors aggregates the non-fatal errors encountered while parsing sshd_config, the settings affected by
+// them fall back to their defaults. errors.Is and errors.As match any of the aggregated errors.
+type SSHDConfigErrors []error
+
+func (e SSHDConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the aggregated errors
+func (e SSHDConfigErrors) Unwrap() []error {
+	return e
+}
+
 type sshKeyInfo struct {
 	OSUser     string `json:"os_user,omitempty"`
 	ActorEmail string `json:"actor_email"`
@@ -54,11 +165,20 @@ type sshKeyInfo struct {
 
 type sysManager interface {
 	GetUserByName(username string) (*sysutil.User, error)
+	GetUserGroups(user *sysutil.User) ([]string, error)
 	MkDirIfNonExist(dir string, user *sysutil.User, perm os.FileMode) error
 	CreateFileForWrite(file string, user *sysutil.User, perm os.FileMode) (io.WriteCloser, error)
 	CopyFileAttribute(from, to string) error
 	ReadFile(filename string) ([]byte, error)
+	ReadFileNoFollow(file string, user *sysutil.User) ([]byte, error)
+	ReplaceFileNoFollow(file string, user *sysutil.User, content []byte, perm os.FileMode) error
+	Glob(pattern string) ([]string, error)
 	RenameFile(oldpath, newpath string) error
+	EvalSymlinks(path string) (string, error)
+	FileOwnerUID(name string) (int, error)
+	SyncDir(dir string) error
+	FreeSpace(path string) (uint64, error)
+	EnsureSSHDirPermissions(file string, user *sysutil.User) (bool, error)
 	RemoveFile(name string) error
 	FileExists(name string) (bool, error)
 	Sleep(d time.Duration)
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DriftReport describes how the authorized_keys file of a user differs from the content the agent would write for the
+// keys assigned to the droplet, e.g. because of manual edits made after the agent last updated it
+type DriftReport struct {
+	OSUser     string   `json:"os_user"`
+	File       string   `json:"file"`
+	Missing    []string `json:"missing"`    // lines the agent expects, but are not in the file
+	Unexpected []string `json:"unexpected"` // lines in the file the agent would remove when updating it
+}
+
+// Verify checks the authorized_keys file of every user having some of the given keys against the content the agent
+// would write for them, and reports the files that drifted. Files matching the expected content are not reported.
+// The files are only read. Since the expiry time of a DOTTY key is set when the key is written, DOTTY keys are compared
+// without it.
+func (s *SSHManager) Verify(keys []*SSHKey) ([]DriftReport, error) {
+	keyGroups := s.groupKeysByUser(keys)
+	users := sortedUsers(keyGroups)
+	unlock := s.lockUsers(users)
+	defer unlock()
+
+	ret := make([]DriftReport, 0)
+	for _, username := range users {
+		user, err := s.lookupUser(username)
+		if err != nil {
+			return nil, err
+		}
+		authorizedKeysFile := s.authorizedKeysFile(user)
+		localKeysRaw, err := s.sysMgr.ReadFile(authorizedKeysFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w:%v", ErrReadAuthorizedKeysFileFailed, err)
+		}
+		localKeys := make([]string, 0)
+		if localKeysRaw != nil {
+			localKeys = strings.Split(strings.TrimRight(string(localKeysRaw), "\n"), "\n")
+		}
+		managedKeys := s.skipKeysInSecondaryFiles(user, keyGroups[username])
+		expectedKeys := s.prepareAuthorizedKeys(localKeys, managedKeys)
+		unexpected, missing := driftLines(localKeys, expectedKeys)
+		if len(unexpected) == 0 && len(missing) == 0 {
+			log.Debug("[%s] matches the keys managed for user [%s]", authorizedKeysFile, username)
+			continue
+		}
+		ret = append(ret, DriftReport{
+			OSUser:     username,
+			File:       authorizedKeysFile,
+			Missing:    missing,
+			Unexpected: unexpected,
+		})
+	}
+	return ret, nil
+}
+
+// driftLines works like diffLines, except that the DOTTY key lines are compared without their expiry time
+func driftLines(local, expected []string) (unexpected, missing []string) {
+	remaining := make(map[string]int, len(local))
+	for _, l := range local {
+		remaining[withoutExpiry(l)]++
+	}
+	for _, l := range expected {
+		if k := withoutExpiry(l); remaining[k] > 0 {
+			remaining[k]--
+			continue
+		}
+		missing = append(missing, l)
+	}
+	for _, l := range local {
+		if k := withoutExpiry(l); remaining[k] > 0 {
+			remaining[k]--
+			unexpected = append(unexpected, l)
+		}
+	}
+	return unexpected, missing
+}
+
+// withoutExpiry clears the expiry time of a DOTTY key line, other lines are returned unchanged
+func withoutExpiry(line string) string {
+	if !isDottyKeyLine(line) {
+		return line
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSuffix(line, "-"+dottyKeyIndicator)))
+	if err != nil {
+		return line
+	}
+	info := &sshKeyInfo{}
+	if err := json.Unmarshal([]byte(comment), info); err != nil {
+		return line
+	}
+	info.ExpireAt = ""
+	keyComment, _ := json.Marshal(info)
+	return fmt.Sprintf("%s %s-%s", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), string(keyComment), dottyKeyIndicator)
+}
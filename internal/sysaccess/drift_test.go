@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess/internal/mocks"
+	"github.com/digitalocean/droplet-agent/internal/sysutil"
+
+	"go.uber.org/mock/gomock"
+)
+
+func TestSSHManager_Verify(t *testing.T) {
+	log.Mute()
+	user := &sysutil.User{Name: "user1", UID: 1, GID: 2, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	dottyPublicKey := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHkfoI1jkzV53geVZ9IMvVA6uyMlYwDkHJw04LMDWuFgAsA/hiLcoRPW2T4/1b6YPLyBwbgjZXwZ31MyLWhKbLI="
+	newDottyKey := func() *SSHKey {
+		return &SSHKey{
+			OSUser:     "user1",
+			PublicKey:  dottyPublicKey,
+			ActorEmail: "actor@email.com",
+			TTL:        1800,
+			Type:       SSHKeyTypeDOTTY,
+		}
+	}
+	// the file was written a while ago, the expiry of the key in it differs from the one the key would be written with now
+	writtenDottyKey := newDottyKey()
+	writtenDottyKey.expireAt = time.Now().Add(600 * time.Second)
+	writtenDottyKeyLine := dottyKeyFmt(writtenDottyKey)
+	staleDottyKeyLine := dottyKeyFmt(&SSHKey{
+		OSUser:     "user1",
+		PublicKey:  "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHzeZZbcsOfu8hWB/OVntUCLZ1EWMiOU6BysslJIxe1mSnQzEjQBaMY/eK3vjipVIaktLLJ3FNCCXlFCPWFYkrs=",
+		ActorEmail: "actor2@email.com",
+		TTL:        1800,
+		Type:       SSHKeyTypeDOTTY,
+		expireAt:   time.Now().Add(600 * time.Second),
+	})
+	readErr := errors.New("read-err")
+
+	tests := []struct {
+		name      string
+		content   []byte
+		readErr   error
+		want      func(key *SSHKey) []DriftReport
+		wantErrIs error
+	}{
+		{
+			"should not report files matching the managed keys",
+			[]byte("local-key\n" + dottyComment + "\n" + writtenDottyKeyLine + "\n"),
+			nil,
+			func(_ *SSHKey) []DriftReport { return []DriftReport{} },
+			nil,
+		},
+		{
+			"should report managed keys removed from the file",
+			[]byte("local-key\n"),
+			nil,
+			func(key *SSHKey) []DriftReport {
+				return []DriftReport{{OSUser: "user1", File: keysFile, Missing: []string{dottyComment, dottyKeyFmt(key)}}}
+			},
+			nil,
+		},
+		{
+			"should report managed keys added to the file by others",
+			[]byte("local-key\n" + dottyComment + "\n" + writtenDottyKeyLine + "\n" + dottyComment + "\n" + staleDottyKeyLine + "\n"),
+			nil,
+			func(_ *SSHKey) []DriftReport {
+				return []DriftReport{{OSUser: "user1", File: keysFile, Unexpected: []string{dottyComment, staleDottyKeyLine}}}
+			},
+			nil,
+		},
+		{
+			"should report a missing file",
+			nil,
+			os.ErrNotExist,
+			func(key *SSHKey) []DriftReport {
+				return []DriftReport{{OSUser: "user1", File: keysFile, Missing: []string{dottyComment, dottyKeyFmt(key)}}}
+			},
+			nil,
+		},
+		{
+			"should fail if the file cannot be read",
+			nil,
+			readErr,
+			func(_ *SSHKey) []DriftReport { return nil },
+			ErrReadAuthorizedKeysFileFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().GetUserByName(user.Name).Return(user, nil)
+			sysMgrMock.EXPECT().ReadFile(keysFile).Return(tt.content, tt.readErr)
+			// the files must only be read
+			sysMgrMock.EXPECT().CreateFileForWrite(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			sysMgrMock.EXPECT().RenameFile(gomock.Any(), gomock.Any()).Times(0)
+
+			s := &SSHManager{
+				authorizedKeysFilePattern: defaultAuthorizedKeysFile,
+				sysMgr:                    sysMgrMock,
+			}
+			s.sshHelper = &sshHelperImpl{mgr: s, timeNow: time.Now}
+
+			key := newDottyKey()
+			got, err := s.Verify([]*SSHKey{key})
+			if !errors.Is(err, tt.wantErrIs) {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErrIs)
+			}
+			if want := tt.want(key); !reflect.DeepEqual(got, want) {
+				t.Errorf("Verify() got = %+v, want %+v", got, want)
+			}
+			if len(s.cachedKeys) != 0 {
+				t.Errorf("Verify() unexpectedly cached the keys: %v", s.cachedKeys)
+			}
+		})
+	}
+}
@@ -71,6 +71,36 @@ func (mr *MocksysManagerMockRecorder) CreateFileForWrite(file, user, perm any) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateFileForWrite", reflect.TypeOf((*MocksysManager)(nil).CreateFileForWrite), file, user, perm)
 }
 
+// EnsureSSHDirPermissions mocks base method.
+func (m *MocksysManager) EnsureSSHDirPermissions(file string, user *sysutil.User) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnsureSSHDirPermissions", file, user)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EnsureSSHDirPermissions indicates an expected call of EnsureSSHDirPermissions.
+func (mr *MocksysManagerMockRecorder) EnsureSSHDirPermissions(file, user any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureSSHDirPermissions", reflect.TypeOf((*MocksysManager)(nil).EnsureSSHDirPermissions), file, user)
+}
+
+// EvalSymlinks mocks base method.
+func (m *MocksysManager) EvalSymlinks(path string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EvalSymlinks", path)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EvalSymlinks indicates an expected call of EvalSymlinks.
+func (mr *MocksysManagerMockRecorder) EvalSymlinks(path any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EvalSymlinks", reflect.TypeOf((*MocksysManager)(nil).EvalSymlinks), path)
+}
+
 // FileExists mocks base method.
 func (m *MocksysManager) FileExists(name string) (bool, error) {
 	m.ctrl.T.Helper()
@@ -86,6 +116,21 @@ func (mr *MocksysManagerMockRecorder) FileExists(name any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FileExists", reflect.TypeOf((*MocksysManager)(nil).FileExists), name)
 }
 
+// FileOwnerUID mocks base method.
+func (m *MocksysManager) FileOwnerUID(name string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FileOwnerUID", name)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FileOwnerUID indicates an expected call of FileOwnerUID.
+func (mr *MocksysManagerMockRecorder) FileOwnerUID(name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FileOwnerUID", reflect.TypeOf((*MocksysManager)(nil).FileOwnerUID), name)
+}
+
 // GetUserByName mocks base method.
 func (m *MocksysManager) GetUserByName(username string) (*sysutil.User, error) {
 	m.ctrl.T.Helper()
@@ -101,6 +146,36 @@ func (mr *MocksysManagerMockRecorder) GetUserByName(username any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByName", reflect.TypeOf((*MocksysManager)(nil).GetUserByName), username)
 }
 
+// GetUserGroups mocks base method.
+func (m *MocksysManager) GetUserGroups(user *sysutil.User) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserGroups", user)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserGroups indicates an expected call of GetUserGroups.
+func (mr *MocksysManagerMockRecorder) GetUserGroups(user any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserGroups", reflect.TypeOf((*MocksysManager)(nil).GetUserGroups), user)
+}
+
+// Glob mocks base method.
+func (m *MocksysManager) Glob(pattern string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Glob", pattern)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Glob indicates an expected call of Glob.
+func (mr *MocksysManagerMockRecorder) Glob(pattern any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Glob", reflect.TypeOf((*MocksysManager)(nil).Glob), pattern)
+}
+
 // MkDirIfNonExist mocks base method.
 func (m *MocksysManager) MkDirIfNonExist(dir string, user *sysutil.User, perm os.FileMode) error {
 	m.ctrl.T.Helper()
@@ -130,6 +205,21 @@ func (mr *MocksysManagerMockRecorder) ReadFile(filename any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadFile", reflect.TypeOf((*MocksysManager)(nil).ReadFile), filename)
 }
 
+// ReadFileNoFollow mocks base method.
+func (m *MocksysManager) ReadFileNoFollow(file string, user *sysutil.User) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadFileNoFollow", file, user)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadFileNoFollow indicates an expected call of ReadFileNoFollow.
+func (mr *MocksysManagerMockRecorder) ReadFileNoFollow(file, user any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadFileNoFollow", reflect.TypeOf((*MocksysManager)(nil).ReadFileNoFollow), file, user)
+}
+
 // RemoveFile mocks base method.
 func (m *MocksysManager) RemoveFile(name string) error {
 	m.ctrl.T.Helper()
@@ -158,6 +248,49 @@ func (mr *MocksysManagerMockRecorder) RenameFile(oldpath, newpath any) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenameFile", reflect.TypeOf((*MocksysManager)(nil).RenameFile), oldpath, newpath)
 }
 
+// ReplaceFileNoFollow mocks base method.
+func (m *MocksysManager) ReplaceFileNoFollow(file string, user *sysutil.User, content []byte, perm os.FileMode) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReplaceFileNoFollow", file, user, content, perm)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReplaceFileNoFollow indicates an expected call of ReplaceFileNoFollow.
+func (mr *MocksysManagerMockRecorder) ReplaceFileNoFollow(file, user, content, perm any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReplaceFileNoFollow", reflect.TypeOf((*MocksysManager)(nil).ReplaceFileNoFollow), file, user, content, perm)
+}
+
+// SyncDir mocks base method.
+func (m *MocksysManager) SyncDir(dir string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SyncDir", dir)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SyncDir indicates an expected call of SyncDir.
+func (mr *MocksysManagerMockRecorder) SyncDir(dir any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SyncDir", reflect.TypeOf((*MocksysManager)(nil).SyncDir), dir)
+}
+
+// FreeSpace mocks base method.
+func (m *MocksysManager) FreeSpace(path string) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FreeSpace", path)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FreeSpace indicates an expected call of FreeSpace.
+func (mr *MocksysManagerMockRecorder) FreeSpace(path any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FreeSpace", reflect.TypeOf((*MocksysManager)(nil).FreeSpace), path)
+}
+
 // Sleep mocks base method.
 func (m *MocksysManager) Sleep(d time.Duration) {
 	m.ctrl.T.Helper()
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultKeysFileDiffHistorySize = 20
+
+// KeysFileDiff records the lines removed from and added to an authorized_keys file by a single update
+type KeysFileDiff struct {
+	File      string    `json:"file"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Removed   []string  `json:"removed"`
+	Added     []string  `json:"added"`
+}
+
+// keysFileDiffHistory retains the last N diffs made to the authorized_keys files, for post-incident analysis
+type keysFileDiffHistory struct {
+	size  int
+	diffs []*KeysFileDiff
+	lock  sync.Mutex
+}
+
+func newKeysFileDiffHistory(size int) *keysFileDiffHistory {
+	return &keysFileDiffHistory{
+		size:  size,
+		diffs: make([]*KeysFileDiff, 0, size),
+	}
+}
+
+func (h *keysFileDiffHistory) record(diff *KeysFileDiff) {
+	if h == nil || h.size <= 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.diffs) == h.size {
+		h.diffs = append(h.diffs[:0], h.diffs[1:]...)
+	}
+	h.diffs = append(h.diffs, diff)
+}
+
+// list returns the retained diffs, the oldest first
+func (h *keysFileDiffHistory) list() []KeysFileDiff {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ret := make([]KeysFileDiff, 0, len(h.diffs))
+	for _, d := range h.diffs {
+		ret = append(ret, *d)
+	}
+	return ret
+}
+
+// diffLines returns the lines that are in before but not in after, and the ones that are in after but not in before.
+// Duplicated lines are counted, so removing one of two identical lines is reported as well.
+func diffLines(before, after []string) (removed, added []string) {
+	remaining := make(map[string]int, len(before))
+	for _, l := range before {
+		remaining[l]++
+	}
+	for _, l := range after {
+		if remaining[l] > 0 {
+			remaining[l]--
+			continue
+		}
+		added = append(added, l)
+	}
+	for _, l := range before {
+		if remaining[l] > 0 {
+			remaining[l]--
+			removed = append(removed, l)
+		}
+	}
+	return removed, added
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_diffLines(t *testing.T) {
+	tests := []struct {
+		name        string
+		before      []string
+		after       []string
+		wantRemoved []string
+		wantAdded   []string
+	}{
+		{
+			"no changes",
+			[]string{"a", "b"},
+			[]string{"a", "b"},
+			nil,
+			nil,
+		},
+		{
+			"should report removed and added lines",
+			[]string{"# customer key", "key1", dottyComment, "dotty1"},
+			[]string{"# customer key", "key1", dottyComment, "dotty2"},
+			[]string{"dotty1"},
+			[]string{"dotty2"},
+		},
+		{
+			"should count duplicated lines",
+			[]string{"", "key1", "", "key1"},
+			[]string{"", "key1"},
+			[]string{"", "key1"},
+			nil,
+		},
+		{
+			"should handle empty file",
+			nil,
+			[]string{dottyComment, "dotty1"},
+			nil,
+			[]string{dottyComment, "dotty1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotRemoved, gotAdded := diffLines(tt.before, tt.after)
+			if !reflect.DeepEqual(gotRemoved, tt.wantRemoved) {
+				t.Errorf("diffLines() removed = %v, want %v", gotRemoved, tt.wantRemoved)
+			}
+			if !reflect.DeepEqual(gotAdded, tt.wantAdded) {
+				t.Errorf("diffLines() added = %v, want %v", gotAdded, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func Test_keysFileDiffHistory(t *testing.T) {
+	t.Run("should only retain the last N diffs", func(t *testing.T) {
+		h := newKeysFileDiffHistory(2)
+		h.record(&KeysFileDiff{File: "f1"})
+		h.record(&KeysFileDiff{File: "f2"})
+		h.record(&KeysFileDiff{File: "f3"})
+		want := []KeysFileDiff{{File: "f2"}, {File: "f3"}}
+		if got := h.list(); !reflect.DeepEqual(got, want) {
+			t.Errorf("list() = %v, want %v", got, want)
+		}
+	})
+	t.Run("nil history should be a no-op", func(t *testing.T) {
+		var h *keysFileDiffHistory
+		h.record(&KeysFileDiff{File: "f1"})
+		if got := h.list(); got != nil {
+			t.Errorf("list() = %v, want nil", got)
+		}
+	})
+}
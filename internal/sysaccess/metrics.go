@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"errors"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type sshMgrMetrics struct {
+	keysAdded      prometheus.Counter
+	keysRemoved    prometheus.Counter
+	updateFailures prometheus.Counter
+	cachedKeys     prometheus.Gauge
+}
+
+func newSSHMgrMetrics(r prometheus.Registerer) *sshMgrMetrics {
+	return &sshMgrMetrics{
+		keysAdded: registerCounter(r, prometheus.CounterOpts{
+			Name: "dotty_keys_added_total",
+			Help: "Number of DOTTY keys added to the authorized_keys files.",
+		}),
+		keysRemoved: registerCounter(r, prometheus.CounterOpts{
+			Name: "dotty_keys_removed_total",
+			Help: "Number of DOTTY keys removed from the authorized_keys files.",
+		}),
+		updateFailures: registerCounter(r, prometheus.CounterOpts{
+			Name: "authorized_keys_update_failures_total",
+			Help: "Number of failed authorized_keys file updates.",
+		}),
+		cachedKeys: registerGauge(r, prometheus.GaugeOpts{
+			Name: "dotty_keys_cached",
+			Help: "Number of DOTTY keys currently managed by the agent.",
+		}),
+	}
+}
+
+// registerCounter registers a counter with the registry, or returns the existing one if already registered, e.g. by
+// another SSHManager
+func registerCounter(r prometheus.Registerer, opts prometheus.CounterOpts) prometheus.Counter {
+	c := prometheus.NewCounter(opts)
+	if err := r.Register(c); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(prometheus.Counter); ok {
+				return existing
+			}
+		}
+		log.Error("failed to register metric %s: %v", opts.Name, err)
+	}
+	return c
+}
+
+// registerGauge registers a gauge with the registry, or returns the existing one if already registered
+func registerGauge(r prometheus.Registerer, opts prometheus.GaugeOpts) prometheus.Gauge {
+	g := prometheus.NewGauge(opts)
+	if err := r.Register(g); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(prometheus.Gauge); ok {
+				return existing
+			}
+		}
+		log.Error("failed to register metric %s: %v", opts.Name, err)
+	}
+	return g
+}
+
+func (m *sshMgrMetrics) updateFailed() {
+	if m == nil {
+		return
+	}
+	m.updateFailures.Inc()
+}
+
+// keysChanged records the DOTTY keys added and removed when the cached keys are replaced
+func (m *sshMgrMetrics) keysChanged(before, after map[string][]*SSHKey) {
+	if m == nil {
+		return
+	}
+	beforeKeys := dottyKeySet(before)
+	afterKeys := dottyKeySet(after)
+	var added, removed float64
+	for k := range afterKeys {
+		if !beforeKeys[k] {
+			added++
+		}
+	}
+	for k := range beforeKeys {
+		if !afterKeys[k] {
+			removed++
+		}
+	}
+	m.keysAdded.Add(added)
+	m.keysRemoved.Add(removed)
+	m.cachedKeys.Set(float64(len(afterKeys)))
+}
+
+func dottyKeySet(keys map[string][]*SSHKey) map[string]bool {
+	ret := make(map[string]bool)
+	for user, userKeys := range keys {
+		for _, k := range userKeys {
+			if k.Type == SSHKeyTypeDOTTY {
+				ret[user+" "+k.PublicKey] = true
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSSHManager_metrics(t *testing.T) {
+	log.Mute()
+	timeNow := time.Now()
+	dottyKey := func(user, pubKey string, expireAt time.Time) *SSHKey {
+		return &SSHKey{OSUser: user, PublicKey: pubKey, TTL: 60, Type: SSHKeyTypeDOTTY, expireAt: expireAt}
+	}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sshHelperMock := NewMocksshHelper(mockCtl)
+	updaterMock := NewMockauthorizedKeysFileUpdater(mockCtl)
+	sshHelperMock.EXPECT().validateKey(gomock.Any()).Return(nil).AnyTimes()
+	helper := &sshHelperImpl{timeNow: func() time.Time { return timeNow }}
+	sshHelperMock.EXPECT().removeExpiredKeys(gomock.Any()).DoAndReturn(helper.removeExpiredKeys).AnyTimes()
+	sshHelperMock.EXPECT().areSameKeys(gomock.Any(), gomock.Any()).DoAndReturn(helper.areSameKeys).AnyTimes()
+
+	registry := prometheus.NewRegistry()
+	s := &SSHManager{
+		sshHelper:                 sshHelperMock,
+		authorizedKeysFileUpdater: updaterMock,
+		cachedKeys:                make(map[string][]*SSHKey),
+		metrics:                   newSSHMgrMetrics(registry),
+	}
+	m := s.metrics
+
+	// add 2 dotty keys for user1 and 1 droplet key for user2, which is not counted
+	updaterMock.EXPECT().updateAuthorizedKeysFile("user1", gomock.Any()).Return(nil)
+	updaterMock.EXPECT().updateAuthorizedKeysFile("user2", gomock.Any()).Return(nil)
+	err := s.UpdateKeys([]*SSHKey{
+		dottyKey("user1", "key-1", timeNow.Add(-time.Minute)),
+		dottyKey("user1", "key-2", timeNow.Add(time.Minute)),
+		{OSUser: "user2", PublicKey: "droplet-key", Type: SSHKeyTypeDroplet},
+	})
+	if err != nil {
+		t.Fatalf("UpdateKeys() unexpected error = %v", err)
+	}
+	assertMetrics(t, m, 2, 0, 0, 2)
+
+	// key-1 expired
+	updaterMock.EXPECT().updateAuthorizedKeysFile("user1", gomock.Any()).Return(nil)
+	if err = s.RemoveExpiredKeys(); err != nil {
+		t.Fatalf("RemoveExpiredKeys() unexpected error = %v", err)
+	}
+	assertMetrics(t, m, 2, 1, 0, 1)
+
+	// keys of user1 not changed, failed to add key-3 for user3, and failed to remove the keys of user2
+	updaterMock.EXPECT().updateAuthorizedKeysFile("user3", gomock.Any()).Return(errors.New("update-err"))
+	updaterMock.EXPECT().updateAuthorizedKeysFile("user2", []*SSHKey{}).Return(errors.New("update-err"))
+	err = s.UpdateKeys([]*SSHKey{
+		dottyKey("user1", "key-2", timeNow.Add(time.Minute)),
+		dottyKey("user3", "key-3", timeNow.Add(time.Minute)),
+	})
+	if err != nil {
+		t.Fatalf("UpdateKeys() unexpected error = %v", err)
+	}
+	assertMetrics(t, m, 2, 1, 2, 1)
+}
+
+func assertMetrics(t *testing.T, m *sshMgrMetrics, added, removed, failures, cached float64) {
+	t.Helper()
+	if got := testutil.ToFloat64(m.keysAdded); got != added {
+		t.Errorf("dotty_keys_added_total = %v, want %v", got, added)
+	}
+	if got := testutil.ToFloat64(m.keysRemoved); got != removed {
+		t.Errorf("dotty_keys_removed_total = %v, want %v", got, removed)
+	}
+	if got := testutil.ToFloat64(m.updateFailures); got != failures {
+		t.Errorf("authorized_keys_update_failures_total = %v, want %v", got, failures)
+	}
+	if got := testutil.ToFloat64(m.cachedKeys); got != cached {
+		t.Errorf("dotty_keys_cached = %v, want %v", got, cached)
+	}
+}
+
+func Test_newSSHMgrMetrics_alreadyRegistered(t *testing.T) {
+	log.Mute()
+	registry := prometheus.NewRegistry()
+	m1 := newSSHMgrMetrics(registry)
+	m2 := newSSHMgrMetrics(registry)
+	m1.keysAdded.Inc()
+	m2.keysAdded.Inc()
+	if got := testutil.ToFloat64(m1.keysAdded); got != 2 {
+		t.Errorf("dotty_keys_added_total = %v, want 2", got)
+	}
+	if got, err := testutil.GatherAndCount(registry); err != nil || got != 4 {
+		t.Errorf("GatherAndCount() = %d, %v, want 4 metrics", got, err)
+	}
+}
@@ -1,9 +1,36 @@
 package sysaccess
 
+import (
+	"time"
+
+	"github.com/digitalocean/droplet-agent/internal/sysutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
 type sshMgrOpts struct {
 	customSSHDPort    int
 	customSSHDCfgFile string
 	manageDropletKeys bool
+	preciseKeyExpiry  bool
+	dryRun            bool
+
+	allowSymlinkedKeysFile bool
+	minFreeDiskSpace       uint64
+
+	fsWatcherSetupTimeout time.Duration
+	fileCheckInterval     time.Duration
+	sshdCfgMaxWait        time.Duration
+
+	keySweepInterval time.Duration
+	shortTTLPolicy   ShortTTLPolicy
+
+	maxKeyTTL        time.Duration
+	rejectOverMaxTTL bool
+
+	staticUsers map[string]*sysutil.User
+
+	metricsRegisterer prometheus.Registerer
 }
 
 // SSHManagerOpt allows creating the SSHManager instance with designated options
@@ -30,10 +57,115 @@ func WithoutManagingDropletKeys() SSHManagerOpt {
 	}
 }
 
+// WithPreciseKeyExpiry tells the agent to record the expiry time of DOTTY keys with nanosecond precision,
+// instead of the default second precision
+func WithPreciseKeyExpiry() SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.preciseKeyExpiry = true
+	}
+}
+
+// WithDryRun tells the agent to only log the changes it would make to the authorized_keys files,
+// without actually writing them
+func WithDryRun() SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.dryRun = true
+	}
+}
+
+// WithAllowSymlinkedAuthorizedKeys tells the agent to write through an authorized_keys file that is a symlink,
+// as long as the link target is owned by the same user and only reached through directories owned by root or the user,
+// instead of replacing the link with a regular file
+func WithAllowSymlinkedAuthorizedKeys() SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.allowSymlinkedKeysFile = true
+	}
+}
+
+// WithMinFreeDiskSpace tells the agent not to update an authorized_keys file when the filesystem it's on has less than
+// the given number of bytes free, so that the temporary file written in the process does not fill up the disk
+func WithMinFreeDiskSpace(bytes uint64) SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.minFreeDiskSpace = bytes
+	}
+}
+
+// WithSSHDConfigWatchTimeout sets how long the agent waits for the fs watcher to start watching the sshd_config
+// before falling back to polling the file
+func WithSSHDConfigWatchTimeout(timeout time.Duration) SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.fsWatcherSetupTimeout = timeout
+	}
+}
+
+// WithSSHDConfigCheck sets how often the agent checks the sshd_config when it cannot be watched, or is being replaced,
+// and how long it waits for a renamed or removed sshd_config to be back before giving up. A maxWait of 0 means forever.
+// Once given up on, sshd_config is still noticed when created again, through a watch on its directory.
+func WithSSHDConfigCheck(interval, maxWait time.Duration) SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.fileCheckInterval = interval
+		opt.sshdCfgMaxWait = maxWait
+	}
+}
+
+// WithKeySweepInterval tells the agent how often expired keys are removed, and how to handle DOTTY keys
+// whose TTL is shorter than that interval
+func WithKeySweepInterval(interval time.Duration, policy ShortTTLPolicy) SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.keySweepInterval = interval
+		opt.shortTTLPolicy = policy
+	}
+}
+
+// WithMaxKeyTTL caps the TTL of DOTTY keys, keys requesting a longer TTL are clamped to it
+func WithMaxKeyTTL(d time.Duration) SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.maxKeyTTL = d
+	}
+}
+
+// WithRejectingKeysOverMaxTTL tells the agent to reject DOTTY keys requesting a TTL longer than the one
+// set via WithMaxKeyTTL, instead of clamping them
+func WithRejectingKeysOverMaxTTL() SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.rejectOverMaxTTL = true
+	}
+}
+
+// WithStaticUsers provides the users to fall back to when they cannot be resolved through the system
+func WithStaticUsers(users map[string]*sysutil.User) SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.staticUsers = users
+	}
+}
+
+// WithMetricsRegisterer sets the registry the SSHManager registers its metrics with, instead of the default one
+func WithMetricsRegisterer(r prometheus.Registerer) SSHManagerOpt {
+	return func(opt *sshMgrOpts) {
+		opt.metricsRegisterer = r
+	}
+}
+
 func defaultMgrOpts() *sshMgrOpts {
 	return &sshMgrOpts{
 		customSSHDPort:    0,
 		customSSHDCfgFile: "",
 		manageDropletKeys: true,
+		preciseKeyExpiry:  false,
+		dryRun:            false,
+
+		allowSymlinkedKeysFile: false,
+
+		fsWatcherSetupTimeout: defaultFSWatcherSetupTimeout,
+		fileCheckInterval:     defaultFileCheckInterval,
+		sshdCfgMaxWait:        0,
+
+		keySweepInterval: 0,
+		shortTTLPolicy:   ShortTTLWarn,
+
+		maxKeyTTL:        0,
+		rejectOverMaxTTL: false,
+
+		metricsRegisterer: prometheus.DefaultRegisterer,
 	}
 }
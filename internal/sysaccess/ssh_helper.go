@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -40,18 +41,27 @@ type fsWatcher interface {
 }
 
 type sshHelperImpl struct {
-	mgr     *SSHManager
-	timeNow func() time.Time
+	mgr        *SSHManager
+	timeNow    func() time.Time
+	logWarning func(format string, params ...interface{})
 
 	customSSHDCfgFile string
 }
 
 func (s *sshHelperImpl) authorizedKeysFile(user *sysutil.User) string {
-	filePath := s.mgr.authorizedKeysFilePattern
+	return expandAuthorizedKeysFilePattern(s.mgr.authorizedKeysFilePatternFor(user), user)
+}
+
+// expandAuthorizedKeysFilePattern returns the path of the authorized_keys file of the user, given the pattern
+// of the AuthorizedKeysFile in sshd_config
+func expandAuthorizedKeysFilePattern(pattern string, user *sysutil.User) string {
+	filePath := pattern
 	filePath = strings.ReplaceAll(filePath, "%%", "%")
 	filePath = strings.ReplaceAll(filePath, "%h", strings.TrimRight(user.HomeDir, string(os.PathSeparator)))
 	filePath = strings.ReplaceAll(filePath, "%u", user.Name)
-	return filePath
+	// collapse redundant separators (e.g. "%h//.ssh/authorized_keys") so that the path
+	// can be reliably compared with the paths reported by the fs watcher
+	return filepath.Clean(filePath)
 }
 
 // prepareAuthorizedKeys prepares the authorized keys that will be updated to filesystem
@@ -60,48 +70,176 @@ func (s *sshHelperImpl) authorizedKeysFile(user *sysutil.User) string {
 //     but all permanent DO managed droplet keys will be preserved
 //   - managedKeys = []*SSHKey{}: means the droplet no longer has any DO managed keys (neither Droplet Keys nor DoTTY Keys),
 //     therefore, all DigitalOcean managed keys will be removed
+//
+// Comments a customer wrote between the comment line of a managed key and the key itself annotate that key, they are
+// moved along with the key, and are kept right above it. Blank lines are kept in place.
+// A customer key that is the exact same key as a droplet key is replaced by the managed one, while a DOTTY key that
+// the customer already added permanently is not written, so that the same key is never written twice.
+// Customer keys with options (e.g. from="10.0.0.0/8",command="/usr/bin/backup") are kept intact, as the managed keys
+// never have any, and they don't count as the same key either since they are restricted.
 func (s *sshHelperImpl) prepareAuthorizedKeys(localKeys []string, managedKeys []*SSHKey) []string {
 	managedDropletKeysEnabled := atomic.LoadUint32(&s.mgr.manageDropletKeys) == manageDropletKeysEnabled
-	managedKeysQuickCheck := make(map[string]bool)
+	managedKeysByFpt := make(map[string]*SSHKey)
 	keepLocalDropletKeys := false
 	if managedKeys == nil {
 		keepLocalDropletKeys = true
 	} else {
 		for _, k := range managedKeys {
-			managedKeysQuickCheck[k.fingerprint] = true
+			if fpt := managedKeyFingerprint(k); fpt != "" {
+				managedKeysByFpt[fpt] = k
+			}
 		}
 	}
+	filterDropletKeys := managedDropletKeysEnabled && !keepLocalDropletKeys
 
 	ret := make([]string, 0, len(localKeys))
+	localKeyFpts := make(map[string]bool) // fingerprints of the keys added by the customer
+	annotations := make(map[*SSHKey][]string)
+	moved := make(map[int]bool) // indexes in ret of the annotations moved along with their keys
+	inManagedBlock := false
+	var pending []int // indexes in ret of the comments found in the current managed block
+	// takeAnnotations attaches the comments pending in the current managed block to the key held by the given line,
+	// if the key is still managed, otherwise they are left in place
+	takeAnnotations := func(line string) {
+		defer func() {
+			inManagedBlock = false
+			pending = nil
+		}()
+		if len(pending) == 0 {
+			return
+		}
+		fpt, err := keyFingerprint(line)
+		if err != nil {
+			return
+		}
+		key, ok := managedKeysByFpt[fpt]
+		if !ok || annotations[key] != nil || (key.Type != SSHKeyTypeDOTTY && !managedDropletKeysEnabled) {
+			return
+		}
+		for _, idx := range pending {
+			annotations[key] = append(annotations[key], ret[idx])
+			moved[idx] = true
+		}
+	}
 
 	// First, filter out all DO managed keys
 	for _, line := range localKeys {
 		lineDup := strings.Trim(line, " \t")
-		if strings.EqualFold(lineDup, dottyPrevComment) || strings.EqualFold(lineDup, dottyComment) || strings.HasSuffix(lineDup, dottyKeyIndicator) {
+		if strings.EqualFold(lineDup, dottyPrevComment) || strings.EqualFold(lineDup, dottyComment) ||
+			(filterDropletKeys && strings.EqualFold(lineDup, dropletKeyComment)) {
+			inManagedBlock = true
+			pending = nil
 			continue
 		}
-		if managedDropletKeysEnabled && !keepLocalDropletKeys {
-			if strings.EqualFold(lineDup, dropletKeyComment) || strings.HasSuffix(lineDup, dropletKeyIndicator) {
+		if isDottyKeyLine(lineDup) {
+			takeAnnotations(lineDup)
+			continue
+		}
+		customerOptions := hasKeyOptions(lineDup)
+		if filterDropletKeys && !customerOptions {
+			if strings.HasSuffix(lineDup, dropletKeyIndicator) {
+				takeAnnotations(lineDup)
 				continue
 			}
-			if pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(lineDup)); err == nil {
-				// if the line contains a key, check if it should be marked as DOManaged
-				fpt := ssh.FingerprintSHA256(pubKey)
-				if managedKeysQuickCheck[fpt] {
+			if fpt, err := keyFingerprint(lineDup); err == nil {
+				// if the line contains the exact same key as a droplet key, it's marked as DOManaged
+				if k, ok := managedKeysByFpt[fpt]; ok && k.Type != SSHKeyTypeDOTTY {
+					takeAnnotations(lineDup)
 					continue
 				}
 			}
 		}
+		if fpt, err := keyFingerprint(lineDup); err == nil && !customerOptions {
+			localKeyFpts[fpt] = true
+		}
+		if inManagedBlock {
+			if strings.HasPrefix(lineDup, "#") {
+				pending = append(pending, len(ret))
+			} else if lineDup != "" {
+				// a customer key ends the managed block
+				inManagedBlock = false
+				pending = nil
+			}
+		}
 		ret = append(ret, line)
 	}
+	if len(moved) != 0 {
+		kept := ret[:0]
+		for idx, line := range ret {
+			if !moved[idx] {
+				kept = append(kept, line)
+			}
+		}
+		ret = kept
+	}
 	log.Debug("file will contain: [%d] lines of local keys, and [%d] managed keys, manageDropletKeys is set to [%v]", len(ret), len(managedKeys), managedDropletKeysEnabled)
 
 	// Then append all managed keys to the end
 	for _, key := range managedKeys {
-		if key.Type == SSHKeyTypeDOTTY {
-			ret = append(ret, []string{dottyComment, dottyKeyFmt(key)}...)
-		} else if managedDropletKeysEnabled {
-			ret = append(ret, []string{dropletKeyComment, dropletKeyFmt(key)}...)
+		if key.Type == SSHKeyTypeDOTTY && localKeyFpts[managedKeyFingerprint(key)] {
+			// the customer added the exact same key permanently, which must not be replaced by a temporary one,
+			// otherwise the customer would lose access once it expires
+			log.Debug("dotty key [%s] of user [%s] is already added by the customer, skipped", key.fingerprint, key.OSUser)
+			continue
+		}
+		lines := s.managedKeyLines(key, managedDropletKeysEnabled)
+		if len(lines) == 0 {
+			continue
+		}
+		ret = append(ret, lines[0])
+		ret = append(ret, annotations[key]...)
+		ret = append(ret, lines[1:]...)
+	}
+	return ret
+}
+
+// managedKeyLines returns the lines of the given managed key, including its comment line,
+// or nil if the key is a droplet key while managing droplet keys is disabled
+func (s *sshHelperImpl) managedKeyLines(key *SSHKey, managedDropletKeysEnabled bool) []string {
+	if key.Type == SSHKeyTypeDOTTY {
+		return []string{dottyComment, dottyKeyFmtWithLayout(key, s.mgr.keyExpiryLayout())}
+	}
+	if managedDropletKeysEnabled {
+		return []string{dropletKeyComment, dropletKeyFmt(key)}
+	}
+	return nil
+}
+
+// managedKeyFingerprint returns the fingerprint of the given managed key, computing it from its public key if not set
+func managedKeyFingerprint(key *SSHKey) string {
+	if key.fingerprint != "" {
+		return key.fingerprint
+	}
+	fpt, err := keyFingerprint(key.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return fpt
+}
+
+// pruneStaleDropletKeys removes the droplet keys that are no longer among the given droplet keys from the lines of an
+// authorized_keys file, along with their comment line. DOTTY keys and the keys added by the customer are kept.
+func pruneStaleDropletKeys(localKeys []string, dropletKeys []*SSHKey) []string {
+	current := make(map[string]bool, len(dropletKeys))
+	for _, k := range dropletKeys {
+		if fpt := managedKeyFingerprint(k); fpt != "" {
+			current[fpt] = true
+		}
+	}
+	ret := make([]string, 0, len(localKeys))
+	for _, line := range localKeys {
+		lineDup := strings.Trim(line, " \t")
+		if !strings.HasSuffix(lineDup, dropletKeyIndicator) || isDottyKeyLine(lineDup) || hasKeyOptions(lineDup) {
+			ret = append(ret, line)
+			continue
+		}
+		if fpt, err := keyFingerprint(lineDup); err == nil && current[fpt] {
+			ret = append(ret, line)
+			continue
+		}
+		log.Debug("pruning stale droplet key: %s", lineDup)
+		if n := len(ret); n > 0 && strings.EqualFold(strings.Trim(ret[n-1], " \t"), dropletKeyComment) {
+			ret = ret[:n-1]
 		}
 	}
 	return ret
@@ -139,17 +277,68 @@ func (s *sshHelperImpl) validateKey(k *SSHKey) (err error) {
 		if k.TTL <= 0 {
 			return fmt.Errorf("%w: invalid ttl", ErrInvalidKey)
 		}
-		k.expireAt = s.timeNow().Add(time.Duration(k.TTL) * time.Second)
+		ttl, err := s.enforceMaxTTL(k)
+		if err != nil {
+			return err
+		}
+		if ttl, err = s.enforceMinTTL(k, ttl); err != nil {
+			return err
+		}
+		k.expireAt = s.timeNow().Add(ttl)
 	}
 	k.PublicKey = strings.Trim(k.PublicKey, " \t\r\n")
-	pubKey, _, _, _, e := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+	fpt, e := keyFingerprint(k.PublicKey)
 	if e != nil {
 		return fmt.Errorf("%w: invalid ssh key: %s-%v", ErrInvalidKey, k.PublicKey, e)
 	}
-	k.fingerprint = ssh.FingerprintSHA256(pubKey)
+	k.fingerprint = fpt
 	return nil
 }
 
+// enforceMaxTTL returns the TTL of the given DOTTY key capped to the configured maximum TTL,
+// or an error if the key should be rejected instead
+func (s *sshHelperImpl) enforceMaxTTL(k *SSHKey) (time.Duration, error) {
+	ttl := time.Duration(k.TTL) * time.Second
+	if s.mgr == nil || s.mgr.maxKeyTTL <= 0 || ttl <= s.mgr.maxKeyTTL {
+		return ttl, nil
+	}
+	if s.mgr.rejectOverMaxTTL {
+		return 0, fmt.Errorf("%w: ttl [%v] exceeds the max key ttl [%v]", ErrInvalidKey, ttl, s.mgr.maxKeyTTL)
+	}
+	log.Info("ttl [%v] of the key for user [%s] exceeds the max key ttl, capping it to [%v]", ttl, k.OSUser, s.mgr.maxKeyTTL)
+	return s.mgr.maxKeyTTL, nil
+}
+
+// enforceMinTTL returns the TTL the given DOTTY key should be kept for, according to the configured short TTL policy.
+// A key with a TTL shorter than the expired keys sweep interval could be left in the authorized_keys file
+// for up to one sweep interval after it expires.
+func (s *sshHelperImpl) enforceMinTTL(k *SSHKey, ttl time.Duration) (time.Duration, error) {
+	if s.mgr == nil || s.mgr.keySweepInterval <= 0 || ttl >= s.mgr.keySweepInterval {
+		return ttl, nil
+	}
+	switch s.mgr.shortTTLPolicy {
+	case ShortTTLReject:
+		return 0, fmt.Errorf("%w: ttl [%v] is shorter than the key sweep interval [%v]", ErrInvalidKey, ttl, s.mgr.keySweepInterval)
+	case ShortTTLClamp:
+		s.logWarning("ttl [%v] of the key for user [%s] is shorter than the key sweep interval, extending it to [%v]", ttl, k.OSUser, s.mgr.keySweepInterval)
+		return s.mgr.keySweepInterval, nil
+	default:
+		s.logWarning("ttl [%v] of the key for user [%s] is shorter than the key sweep interval [%v], the key may outlive its ttl", ttl, k.OSUser, s.mgr.keySweepInterval)
+		return ttl, nil
+	}
+}
+
+// keyFingerprint parses an authorized_keys line and returns the SHA256 fingerprint of its public key.
+// Leading options (e.g. "no-touch-required" for security keys) and the trailing comment are ignored,
+// so that the same key yields the same fingerprint regardless of how it is written in the file.
+func keyFingerprint(line string) (string, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(pubKey), nil
+}
+
 func (s *sshHelperImpl) areSameKeys(keys1, keys2 []*SSHKey) bool {
 	if keys1 == nil || keys2 == nil {
 		return keys1 == nil && keys2 == nil
@@ -189,7 +378,8 @@ func (s *sshHelperImpl) sshdCfgModified(w fsWatcher, sshdCfgFile string, ev *fsn
 		return false
 	}
 	log.Info("[WatchSSHDConfig] sshd_config events detected.")
-	if ev.Op&fsnotify.Write == fsnotify.Write {
+	// a Create is only seen through the directory watched once the agent gave up waiting for the file
+	if ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
 		log.Debug("[WatchSSHDConfig] sshd_config modified")
 		return true
 	} else if ev.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
@@ -205,11 +395,25 @@ func (s *sshHelperImpl) sshdCfgModified(w fsWatcher, sshdCfgFile string, ev *fsn
 		// - removing the sshd_config will not impact the sshd service until it is restarted,
 		//   therefore, we don't necessarily need to restart the droplet-agent service unless
 		//   a new sshd_config file is presented
+		//
+		// if the file is not back within the configured max wait, the agent gives up and keeps running with the
+		// config it parsed when started. The directory of the file is watched instead, so that the file being
+		// created again is still noticed without blocking the other events
+		interval := s.mgr.sshdCfgCheckInterval()
+		var waited time.Duration
 		for {
 			if exists, _ := s.mgr.sysMgr.FileExists(sshdCfgFile); exists {
 				break
 			}
-			s.mgr.sysMgr.Sleep(fileCheckInterval)
+			if s.mgr.sshdCfgMaxWait > 0 && waited >= s.mgr.sshdCfgMaxWait {
+				log.Error("[WatchSSHDConfig] sshd_config is not back after %v, keep running with the current config", waited)
+				if err := w.Add(filepath.Dir(sshdCfgFile)); err != nil {
+					log.Error("[WatchSSHDConfig] failed to watch the directory of sshd_config, it will not be noticed once back: %v", err)
+				}
+				return false
+			}
+			s.mgr.sysMgr.Sleep(interval)
+			waited += interval
 		}
 		log.Debug("[WatchSSHDConfig] sshd_config ready")
 		_ = w.Add(sshdCfgFile)
@@ -220,15 +424,44 @@ func (s *sshHelperImpl) sshdCfgModified(w fsWatcher, sshdCfgFile string, ev *fsn
 }
 
 func dottyKeyFmt(key *SSHKey) string {
+	return dottyKeyFmtWithLayout(key, time.RFC3339)
+}
+
+// dottyKeyFmtWithLayout formats a DOTTY key with its expiry time written in the given time layout.
+// RFC3339 truncates the expiry time to the second, RFC3339Nano preserves the sub-second part.
+func dottyKeyFmtWithLayout(key *SSHKey, expireAtLayout string) string {
 	info := &sshKeyInfo{
 		OSUser:     key.OSUser,
 		ActorEmail: key.ActorEmail,
-		ExpireAt:   key.expireAt.Format(time.RFC3339),
+		ExpireAt:   key.expireAt.Format(expireAtLayout),
 	}
 	keyComment, _ := json.Marshal(info)
 	return fmt.Sprintf("%s %s-%s", key.PublicKey, string(keyComment), dottyKeyIndicator)
 }
 
+// isDottyKeyLine checks if the line is a DOTTY key written by dottyKeyFmt, i.e. a key followed by the JSON encoded
+// key info and the "-dotty_ssh" indicator. A customer key whose comment merely ends with "dotty_ssh" is not one.
+func isDottyKeyLine(line string) bool {
+	line, found := strings.CutSuffix(line, "-"+dottyKeyIndicator)
+	if !found {
+		return false
+	}
+	_, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil || len(options) != 0 || !strings.HasPrefix(comment, "{") {
+		// dotty keys are written without any option
+		return false
+	}
+	info := &sshKeyInfo{}
+	return json.Unmarshal([]byte(comment), info) == nil
+}
+
+// hasKeyOptions tells whether the key held by the given authorized_keys line has options, which are only set by the
+// customer since the managed keys are written without any
+func hasKeyOptions(line string) bool {
+	_, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	return err == nil && len(options) != 0
+}
+
 func dropletKeyFmt(key *SSHKey) string {
 	return fmt.Sprintf("%s -%s", key.PublicKey, dropletKeyIndicator)
 }
@@ -50,6 +50,24 @@ func Test_sshHelperImpl_authorizedKeysFile(t *testing.T) {
 			&sysutil.User{Name: "hlee"},
 			"/etc/ssh.d/hlee/authorized_keys",
 		},
+		{
+			"should collapse redundant separators in the pattern",
+			"%h//.ssh///authorized_keys",
+			&sysutil.User{HomeDir: "/home/hlee"},
+			"/home/hlee/.ssh/authorized_keys",
+		},
+		{
+			"should collapse redundant separators from both the home dir and the pattern",
+			"%h//.ssh/authorized_keys",
+			&sysutil.User{HomeDir: "//home//hlee//"},
+			"/home/hlee/.ssh/authorized_keys",
+		},
+		{
+			"should clean up dot segments",
+			"/etc/ssh.d/./%u/../%u/authorized_keys",
+			&sysutil.User{Name: "hlee"},
+			"/etc/ssh.d/hlee/authorized_keys",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -111,6 +129,21 @@ func Test_sshHelperImpl_prepareAuthorizedKeys(t *testing.T) {
 		Type:        SSHKeyTypeDroplet,
 		fingerprint: "SHA256:8PEHs4nUAyUcVM6Fc6SVdaRhi6F55PiVFuh7oPH0Mgk",
 	}
+	skDropletKey := &SSHKey{
+		OSUser:      "root",
+		PublicKey:   "sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gAAAABHNzaDo=",
+		Type:        SSHKeyTypeDroplet,
+		fingerprint: "SHA256:nX0hpi5mKbTIJ10yBq5/sLQhiI1Y0RBAqN0drDdgJWs",
+	}
+	skDottyKey := &SSHKey{
+		OSUser:      "root",
+		PublicKey:   "sk-ecdsa-sha2-nistp256@openssh.com AAAAInNrLWVjZHNhLXNoYTItbmlzdHAyNTZAb3BlbnNzaC5jb20AAAAIbmlzdHAyNTYAAABBBGeNmBshBcmIJWam+LY0ipC0VzWJoK+miRrWZiKFr0L70wTyaoasb9ph+BH9HLJGatK/lzCW7V9E7YbeVY5JSz8AAAAEc3NoOg==",
+		ActorEmail:  "actor@email.com",
+		TTL:         1800,
+		Type:        SSHKeyTypeDOTTY,
+		fingerprint: "SHA256:pHpyvw/bT98+TIERXS33BFPaaHq+i8d55+eANJUZ6rY",
+		expireAt:    timeNow.Add(1800 * time.Second),
+	}
 	type args struct {
 		localKeys   []string
 		managedKeys []*SSHKey
@@ -118,8 +151,10 @@ func Test_sshHelperImpl_prepareAuthorizedKeys(t *testing.T) {
 	tests := []struct {
 		name               string
 		withoutManagedKeys bool
+		preciseKeyExpiry   bool
 		args               args
 		want               []string
+		wantStable         bool // preparing the result again must not reshuffle it
 	}{
 		{
 			name: "should remove all DO managed keys if managedKeys is empty",
@@ -326,14 +361,15 @@ func Test_sshHelperImpl_prepareAuthorizedKeys(t *testing.T) {
 			},
 		},
 		{
-			name: "should properly handle comments and empty lines",
+			name:       "should properly handle comments and empty lines",
+			wantStable: true,
 			args: args{
 				localKeys: []string{
 					"#comment 1",
 					"",
 					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
 					dottyComment,
-					"# added comment (will not be kept in the same place)",
+					"# added comment (kept above the key it annotates)",
 					"",
 					dottyKeyFmt(exampleKey2),
 					"# another comment",
@@ -349,7 +385,6 @@ func Test_sshHelperImpl_prepareAuthorizedKeys(t *testing.T) {
 				"#comment 1",
 				"",
 				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
-				"# added comment (will not be kept in the same place)",
 				"",
 				"# another comment",
 				"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQCnMKX2t5cq+TE+CmpkD7Mbdb3CQE81xGzutwQkr91nz/EDDxOsBfYGUAuHH/7eb+JXno2LiU9sWO3w9/muSsP5zDXoZY9xCUuatvJsMBIUWC7O3uGeE0UJWpdkNpXrbo+IuU/1TsoKnDEMd3o5Etyq5rrotZ0/ap/q4JxkFmJCFpGwGMI5H+MWk0UXbVVDV6jn1YsvFuEZl9ju63AyGGfJU05O1HbW8E5VB0tXbQ2u1tuV8on2uG/3bc2JmRZ9C78kA5FwJUrDU1r41vqHFSFF1oTPHU1SWsSacr8FZ95/u0Hdh+c+FryUlVm8I+rptG9yeTvCKs+AtJv+BdhkZcW47ppMt2g702/gP9MphLVg04XKr6xP4Kj4Z+gjj+HEX5ucs9mkJwigeeoDm8lnydhOHzxdRnImW3E7lksTyQRw+fgzJ8hFcxA5J7G4O7xuypAWp/vmzaOUrwMq741WRMJEwEo0cGL7P8nGw/BQA6h7BWb7VA4mvtOxVkBcolVUQ2FpatBaSkdr2EEvCq5dZddroGi2OaPvEgUe6cl22JA6tv2Ah/k6q5NgR2Qik+jCOKSSUkQrVA6/eGJz3Rt9zf99Ah3hzHPEVpX6IVpKOMZUa66pw+bFLJLonzV2cGu/nQn0KCtI7AcoB+GWyqm1oqRDwzmCwqJRXJJ0PovKrSVHPQ== customer@key2",
@@ -357,6 +392,7 @@ func Test_sshHelperImpl_prepareAuthorizedKeys(t *testing.T) {
 				dottyComment,
 				dottyKeyFmt(exampleKey1),
 				dottyComment,
+				"# added comment (kept above the key it annotates)",
 				dottyKeyFmt(exampleKey2),
 			},
 		},
@@ -443,6 +479,273 @@ func Test_sshHelperImpl_prepareAuthorizedKeys(t *testing.T) {
 				dottyKeyFmt(exampleKey1),
 			},
 		},
+		{
+			name:             "should write the expiry time of dotty keys with nanosecond precision if enabled",
+			preciseKeyExpiry: true,
+			args: args{
+				localKeys: []string{},
+				managedKeys: []*SSHKey{
+					exampleKey1,
+				},
+			},
+			want: []string{
+				dottyComment,
+				dottyKeyFmtWithLayout(exampleKey1, time.RFC3339Nano),
+			},
+		},
+		{
+			name: "should preserve customer keys whose comment happens to end with the dotty indicator",
+			args: args{
+				localKeys: []string{
+					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= dotty_ssh",
+					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDdPvHGQm4OWJd9vDvz405D7BFxhwu09IvnPOf0+e/nrGzWykXJsm9Hy1AdjSM7lgUEleeOQeMZt7EIlZJ8Eou4= my-dotty_ssh",
+					dottyComment,
+					dottyKeyFmt(exampleKey2),
+				},
+				managedKeys: []*SSHKey{
+					exampleKey1,
+				},
+			},
+			want: []string{
+				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= dotty_ssh",
+				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDdPvHGQm4OWJd9vDvz405D7BFxhwu09IvnPOf0+e/nrGzWykXJsm9Hy1AdjSM7lgUEleeOQeMZt7EIlZJ8Eou4= my-dotty_ssh",
+				dottyComment,
+				dottyKeyFmt(exampleKey1),
+			},
+		},
+		{
+			name: "should properly handle security key backed keys",
+			args: args{
+				localKeys: []string{
+					"# customer key 1",
+					"no-touch-required sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gAAAABHNzaDo= customer@key1",
+					dottyComment,
+					dottyKeyFmt(skDottyKey),
+				},
+				managedKeys: []*SSHKey{
+					skDropletKey,
+					skDottyKey,
+				},
+			},
+			want: []string{
+				"# customer key 1",
+				"no-touch-required sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gAAAABHNzaDo= customer@key1",
+				dropletKeyComment,
+				dropletKeyFmt(skDropletKey),
+				dottyComment,
+				dottyKeyFmt(skDottyKey),
+			},
+		},
+		{
+			name: "should replace a customer key duplicating a droplet key with the managed one",
+			args: args{
+				localKeys: []string{
+					"# my laptop",
+					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE= me@laptop",
+				},
+				managedKeys: []*SSHKey{
+					{
+						OSUser:    "root",
+						PublicKey: dropletKey1.PublicKey,
+						Type:      SSHKeyTypeDroplet,
+					},
+				},
+			},
+			want: []string{
+				"# my laptop",
+				dropletKeyComment,
+				dropletKeyFmt(dropletKey1),
+			},
+			wantStable: true,
+		},
+		{
+			name: "should keep a customer key with options duplicating a droplet key intact",
+			args: args{
+				localKeys: []string{
+					"# backups",
+					`from="10.0.0.0/8",command="/usr/bin/backup" ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE= backup@host`,
+				},
+				managedKeys: []*SSHKey{
+					dropletKey1,
+				},
+			},
+			want: []string{
+				"# backups",
+				`from="10.0.0.0/8",command="/usr/bin/backup" ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE= backup@host`,
+				dropletKeyComment,
+				dropletKeyFmt(dropletKey1),
+			},
+			wantStable: true,
+		},
+		{
+			name: "should not mistake customer keys with options for managed keys",
+			args: args{
+				localKeys: []string{
+					`restrict,command="/usr/bin/backup" ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBFWs0vUPi/q2dscBE5yzycy98ZSzs7kas5gNGrM62HGMUqM1lpO3nHbXqeBz/erOaPSoEk7TpR5wWMKYi6Yu3+Y= -` + dropletKeyIndicator,
+					`from="10.0.0.0/8" ` + dottyKeyFmt(exampleKey2),
+				},
+				managedKeys: []*SSHKey{},
+			},
+			want: []string{
+				`restrict,command="/usr/bin/backup" ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBFWs0vUPi/q2dscBE5yzycy98ZSzs7kas5gNGrM62HGMUqM1lpO3nHbXqeBz/erOaPSoEk7TpR5wWMKYi6Yu3+Y= -` + dropletKeyIndicator,
+				`from="10.0.0.0/8" ` + dottyKeyFmt(exampleKey2),
+			},
+			wantStable: true,
+		},
+		{
+			name: "should still write a dotty key the customer added with options",
+			args: args{
+				localKeys: []string{
+					`from="10.0.0.0/8" ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHxxGMc7paI72eTQSNoz+e9jxVZjYDsMwfy6MwPgZlzncKjm+QTfgilNEDskWfU8Om4EiOMedhvrDhBfVSbqAoA= me@laptop`,
+				},
+				managedKeys: []*SSHKey{
+					exampleKey1,
+				},
+			},
+			want: []string{
+				`from="10.0.0.0/8" ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHxxGMc7paI72eTQSNoz+e9jxVZjYDsMwfy6MwPgZlzncKjm+QTfgilNEDskWfU8Om4EiOMedhvrDhBfVSbqAoA= me@laptop`,
+				dottyComment,
+				dottyKeyFmt(exampleKey1),
+			},
+		},
+		{
+			name: "should not write a dotty key the customer already added",
+			args: args{
+				localKeys: []string{
+					"# customer key 1",
+					exampleKey2.PublicKey + " customer@key2",
+				},
+				managedKeys: []*SSHKey{
+					exampleKey1,
+					exampleKey2,
+				},
+			},
+			want: []string{
+				"# customer key 1",
+				exampleKey2.PublicKey + " customer@key2",
+				dottyComment,
+				dottyKeyFmt(exampleKey1),
+			},
+			wantStable: true,
+		},
+		{
+			name:               "should not write a dotty key the customer already added even if not managing droplet keys",
+			withoutManagedKeys: true,
+			args: args{
+				localKeys: []string{
+					exampleKey2.PublicKey + " customer@key2",
+				},
+				managedKeys: []*SSHKey{
+					exampleKey2,
+				},
+			},
+			want: []string{
+				exampleKey2.PublicKey + " customer@key2",
+			},
+			wantStable: true,
+		},
+		{
+			name: "should only deduplicate keys with the exact same fingerprint",
+			args: args{
+				localKeys: []string{
+					dropletKey2.PublicKey + " root@droplet",
+					exampleKey3.PublicKey + " {\"os_user\":\"user2\",\"actor_email\":\"actor2@email.com\"}",
+				},
+				managedKeys: []*SSHKey{
+					dropletKey1,
+					exampleKey2,
+				},
+			},
+			want: []string{
+				dropletKey2.PublicKey + " root@droplet",
+				exampleKey3.PublicKey + " {\"os_user\":\"user2\",\"actor_email\":\"actor2@email.com\"}",
+				dropletKeyComment,
+				dropletKeyFmt(dropletKey1),
+				dottyComment,
+				dottyKeyFmt(exampleKey2),
+			},
+			wantStable: true,
+		},
+		{
+			name:       "should keep customer comments above the managed keys they annotate",
+			wantStable: true,
+			args: args{
+				localKeys: []string{
+					"# customer key 1",
+					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
+					dropletKeyComment,
+					"# laptop of the on-call engineer",
+					"# do not remove",
+					dropletKeyFmt(dropletKey1),
+					"",
+					"# customer key 2",
+					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDdPvHGQm4OWJd9vDvz405D7BFxhwu09IvnPOf0+e/nrGzWykXJsm9Hy1AdjSM7lgUEleeOQeMZt7EIlZJ8Eou4= customer@key3",
+				},
+				managedKeys: []*SSHKey{
+					exampleKey1,
+					dropletKey1,
+				},
+			},
+			want: []string{
+				"# customer key 1",
+				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
+				"",
+				"# customer key 2",
+				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDdPvHGQm4OWJd9vDvz405D7BFxhwu09IvnPOf0+e/nrGzWykXJsm9Hy1AdjSM7lgUEleeOQeMZt7EIlZJ8Eou4= customer@key3",
+				dottyComment,
+				dottyKeyFmt(exampleKey1),
+				dropletKeyComment,
+				"# laptop of the on-call engineer",
+				"# do not remove",
+				dropletKeyFmt(dropletKey1),
+			},
+		},
+		{
+			name:       "should keep the comments in place if the key they annotate is removed",
+			wantStable: true,
+			args: args{
+				localKeys: []string{
+					dottyComment,
+					"# temporary access for the migration",
+					"",
+					dottyKeyFmt(exampleKey2),
+					"# customer key 1",
+					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
+				},
+				managedKeys: []*SSHKey{
+					exampleKey1,
+				},
+			},
+			want: []string{
+				"# temporary access for the migration",
+				"",
+				"# customer key 1",
+				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
+				dottyComment,
+				dottyKeyFmt(exampleKey1),
+			},
+		},
+		{
+			name:       "should not take the comments of customer keys following a managed comment as annotations",
+			wantStable: true,
+			args: args{
+				localKeys: []string{
+					dottyComment,
+					"# customer key 1",
+					"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
+					dottyKeyFmt(exampleKey2),
+				},
+				managedKeys: []*SSHKey{
+					exampleKey2,
+				},
+			},
+			want: []string{
+				"# customer key 1",
+				"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHeAQeGsd93e5G41zQ3/N1rQ9OT5cj5xLwD0q7sf6fLFdMiDdxVIRFt/Qv+dCvvvZ3xO+Ers7aemTnEivfJSadU= customer@key1",
+				dottyComment,
+				dottyKeyFmt(exampleKey2),
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -452,14 +755,19 @@ func Test_sshHelperImpl_prepareAuthorizedKeys(t *testing.T) {
 				},
 				mgr: &SSHManager{
 					manageDropletKeys: manageDropletKeysEnabled,
+					preciseKeyExpiry:  tt.preciseKeyExpiry,
 				},
 			}
 			if tt.withoutManagedKeys {
 				s.mgr.manageDropletKeys = manageDropletKeysDisabled
 			}
-			if got := s.prepareAuthorizedKeys(tt.args.localKeys, tt.args.managedKeys); !reflect.DeepEqual(got, tt.want) {
+			got := s.prepareAuthorizedKeys(tt.args.localKeys, tt.args.managedKeys)
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("prepareAuthorizedKeys() = %v, want %v", got, tt.want)
 			}
+			if again := s.prepareAuthorizedKeys(got, tt.args.managedKeys); tt.wantStable && !reflect.DeepEqual(again, got) {
+				t.Errorf("prepareAuthorizedKeys() is not stable, got %v, then %v", got, again)
+			}
 		})
 	}
 }
@@ -542,6 +850,78 @@ func Test_dottyKeyFmt(t *testing.T) {
 	}
 }
 
+func Test_isDottyKeyLine(t *testing.T) {
+	pubKey := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE="
+	tests := []struct {
+		name string
+		line string
+		want bool
+	}{
+		{"formatted dotty key", dottyKeyFmt(&SSHKey{OSUser: "root", PublicKey: pubKey, ActorEmail: "actor@email.com"}), true},
+		{"customer key with a dotty_ssh comment", pubKey + " dotty_ssh", false},
+		{"customer key with a comment ending with -dotty_ssh", pubKey + " customer-dotty_ssh", false},
+		{"customer key with a non-JSON braced comment", pubKey + " {not json}-dotty_ssh", false},
+		{"invalid key with a key info", "not-a-key {\"os_user\":\"root\"}-dotty_ssh", false},
+		{"droplet key", dropletKeyFmt(&SSHKey{PublicKey: pubKey}), false},
+		{"customer key with options and a key info", `command="/usr/bin/backup" ` + dottyKeyFmt(&SSHKey{OSUser: "root", PublicKey: pubKey}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDottyKeyLine(tt.line); got != tt.want {
+				t.Errorf("isDottyKeyLine() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dottyKeyFmtWithLayout(t *testing.T) {
+	expireAt := time.Date(2023, 10, 1, 10, 0, 0, 123456789, time.UTC)
+	key := &SSHKey{
+		OSUser:     "root",
+		PublicKey:  "alg base64-key",
+		ActorEmail: "actor@email.com",
+		TTL:        50,
+		expireAt:   expireAt,
+	}
+	tests := []struct {
+		name         string
+		layout       string
+		wantExpireAt time.Time
+	}{
+		{
+			"should truncate the expiry time to the second by default",
+			time.RFC3339,
+			expireAt.Truncate(time.Second),
+		},
+		{
+			"should preserve nanosecond precision if enabled",
+			time.RFC3339Nano,
+			expireAt,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dottyKeyFmtWithLayout(key, tt.layout)
+			lineEnd := "-" + dottyKeyIndicator
+			info := &sshKeyInfo{}
+			c := got[len(key.PublicKey) : len(got)-len(lineEnd)]
+			if err := json.Unmarshal([]byte(c), info); err != nil {
+				t.Fatalf("dottyKeyFmtWithLayout() unexpected key comment. %s, %v", c, err)
+			}
+			gotExpireAt, err := time.Parse(time.RFC3339Nano, info.ExpireAt)
+			if err != nil {
+				t.Fatalf("dottyKeyFmtWithLayout() unexpected expire_at. %s, %v", info.ExpireAt, err)
+			}
+			if !gotExpireAt.Equal(tt.wantExpireAt) {
+				t.Errorf("dottyKeyFmtWithLayout() expire_at = %v, want %v", gotExpireAt, tt.wantExpireAt)
+			}
+		})
+	}
+	if dottyKeyFmt(key) != dottyKeyFmtWithLayout(key, time.RFC3339) {
+		t.Errorf("dottyKeyFmt() should default to second precision")
+	}
+}
+
 func Test_areSameKeys(t *testing.T) {
 	key1 := &SSHKey{
 		OSUser:     "root",
@@ -873,6 +1253,80 @@ func Test_sshHelperImpl_removeExpiredKeys(t *testing.T) {
 	}
 }
 
+func Test_pruneStaleDropletKeys(t *testing.T) {
+	log.Mute()
+	currentKey := &SSHKey{
+		OSUser:    "root",
+		PublicKey: "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHkfoI1jkzV53geVZ9IMvVA6uyMlYwDkHJw04LMDWuFgAsA/hiLcoRPW2T4/1b6YPLyBwbgjZXwZ31MyLWhKbLI= current@key",
+		Type:      SSHKeyTypeDroplet,
+	}
+	staleKey := &SSHKey{
+		OSUser:    "root",
+		PublicKey: "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHzeZZbcsOfu8hWB/OVntUCLZ1EWMiOU6BysslJIxe1mSnQzEjQBaMY/eK3vjipVIaktLLJ3FNCCXlFCPWFYkrs= stale@key",
+		Type:      SSHKeyTypeDroplet,
+	}
+	dottyKey := &SSHKey{
+		OSUser:     "root",
+		PublicKey:  staleKey.PublicKey,
+		ActorEmail: "actor@email.com",
+		TTL:        1800,
+		Type:       SSHKeyTypeDOTTY,
+		expireAt:   time.Now().Add(1800 * time.Second),
+	}
+	customerKey := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQCnMKX2t5cq+TE+CmpkD7Mbdb3CQE81xGzutwQkr91nz/EDDxOsBfYGUAuHH/7eb+JXno2LiU9sWO3w9/muSsP5zDXoZY9xCUuatvJsMBIUWC7O3uGeE0UJWpdkNpXrbo+IuU/1TsoKnDEMd3o5Etyq5rrotZ0/ap/q4JxkFmJCFpGwGMI5H+MWk0UXbVVDV6jn1YsvFuEZl9ju63AyGGfJU05O1HbW8E5VB0tXbQ2u1tuV8on2uG/3bc2JmRZ9C78kA5FwJUrDU1r41vqHFSFF1oTPHU1SWsSacr8FZ95/u0Hdh+c+FryUlVm8I+rptG9yeTvCKs+AtJv+BdhkZcW47ppMt2g702/gP9MphLVg04XKr6xP4Kj4Z+gjj+HEX5ucs9mkJwigeeoDm8lnydhOHzxdRnImW3E7lksTyQRw+fgzJ8hFcxA5J7G4O7xuypAWp/vmzaOUrwMq741WRMJEwEo0cGL7P8nGw/BQA6h7BWb7VA4mvtOxVkBcolVUQ2FpatBaSkdr2EEvCq5dZddroGi2OaPvEgUe6cl22JA6tv2Ah/k6q5NgR2Qik+jCOKSSUkQrVA6/eGJz3Rt9zf99Ah3hzHPEVpX6IVpKOMZUa66pw+bFLJLonzV2cGu/nQn0KCtI7AcoB+GWyqm1oqRDwzmCwqJRXJJ0PovKrSVHPQ== customer@key"
+
+	tests := []struct {
+		name        string
+		localKeys   []string
+		dropletKeys []*SSHKey
+		want        []string
+	}{
+		{
+			"should remove stale droplet keys along with their comment",
+			[]string{customerKey, dropletKeyComment, dropletKeyFmt(currentKey), dropletKeyComment, dropletKeyFmt(staleKey)},
+			[]*SSHKey{currentKey},
+			[]string{customerKey, dropletKeyComment, dropletKeyFmt(currentKey)},
+		},
+		{
+			"should keep the lines untouched if no droplet key is stale",
+			[]string{customerKey, dropletKeyComment, dropletKeyFmt(currentKey)},
+			[]*SSHKey{currentKey},
+			[]string{customerKey, dropletKeyComment, dropletKeyFmt(currentKey)},
+		},
+		{
+			"should remove all droplet keys if the droplet no longer has any",
+			[]string{dropletKeyComment, dropletKeyFmt(currentKey), dropletKeyComment, dropletKeyFmt(staleKey), customerKey},
+			nil,
+			[]string{customerKey},
+		},
+		{
+			"should keep customer keys with options ending with the droplet key indicator",
+			[]string{`from="10.0.0.0/8" ` + dropletKeyFmt(staleKey)},
+			[]*SSHKey{currentKey},
+			[]string{`from="10.0.0.0/8" ` + dropletKeyFmt(staleKey)},
+		},
+		{
+			"should leave dotty keys to expire",
+			[]string{dottyComment, dottyKeyFmt(dottyKey), dropletKeyComment, dropletKeyFmt(staleKey)},
+			[]*SSHKey{currentKey},
+			[]string{dottyComment, dottyKeyFmt(dottyKey)},
+		},
+		{
+			"should keep the comments not directly above a stale droplet key",
+			[]string{dropletKeyComment, "# customer comment", dropletKeyFmt(staleKey)},
+			[]*SSHKey{currentKey},
+			[]string{dropletKeyComment, "# customer comment"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pruneStaleDropletKeys(tt.localKeys, tt.dropletKeys); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pruneStaleDropletKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_sshHelperImpl_validateKey(t *testing.T) {
 	timeNow := time.Now()
 	tests := []struct {
@@ -976,6 +1430,60 @@ func Test_sshHelperImpl_validateKey(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"should support sk-ssh-ed25519 security keys",
+			&SSHKey{
+				OSUser:     "root",
+				PublicKey:  "sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gAAAABHNzaDo=",
+				ActorEmail: "actor@email.com",
+				Type:       SSHKeyTypeDroplet,
+			},
+			&SSHKey{
+				OSUser:      "root",
+				PublicKey:   "sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gAAAABHNzaDo=",
+				ActorEmail:  "actor@email.com",
+				Type:        SSHKeyTypeDroplet,
+				fingerprint: "SHA256:nX0hpi5mKbTIJ10yBq5/sLQhiI1Y0RBAqN0drDdgJWs",
+			},
+			nil,
+		},
+		{
+			"should support certificates",
+			&SSHKey{
+				OSUser:     "root",
+				PublicKey:  "ssh-ed25519-cert-v01@openssh.com AAAAIHNzaC1lZDI1NTE5LWNlcnQtdjAxQG9wZW5zc2guY29tAAAAIOOGRyhGr5lQPCac7Oa7A+kvPNmbPM7AaPhK8paUSgMpAAAAIEgjEbnK6RX9yVuQibXKsthzY0ac28VNWAhI9fZWs8R+AAAAAAAAAAAAAAABAAAABHRlc3QAAAAIAAAABHJvb3QAAAAAAAAAAP//////////AAAAAAAAAIIAAAAVcGVybWl0LVgxMS1mb3J3YXJkaW5nAAAAAAAAABdwZXJtaXQtYWdlbnQtZm9yd2FyZGluZwAAAAAAAAAWcGVybWl0LXBvcnQtZm9yd2FyZGluZwAAAAAAAAAKcGVybWl0LXB0eQAAAAAAAAAOcGVybWl0LXVzZXItcmMAAAAAAAAAAAAAADMAAAALc3NoLWVkMjU1MTkAAAAgSdo/E7TI8FM3BXafy/fBXJlISCkcos2qFymHVdjUa80AAABTAAAAC3NzaC1lZDI1NTE5AAAAQMj4+hlzVlmyS6tRl2dxPDNdFDGs0n8eJRCre4P9VSTKUBIF8yPP9cFDRnsfykuYghEAgGPmUh9AGplCwN+4GQo=",
+				ActorEmail: "actor@email.com",
+				Type:       SSHKeyTypeDroplet,
+			},
+			&SSHKey{
+				OSUser:      "root",
+				PublicKey:   "ssh-ed25519-cert-v01@openssh.com AAAAIHNzaC1lZDI1NTE5LWNlcnQtdjAxQG9wZW5zc2guY29tAAAAIOOGRyhGr5lQPCac7Oa7A+kvPNmbPM7AaPhK8paUSgMpAAAAIEgjEbnK6RX9yVuQibXKsthzY0ac28VNWAhI9fZWs8R+AAAAAAAAAAAAAAABAAAABHRlc3QAAAAIAAAABHJvb3QAAAAAAAAAAP//////////AAAAAAAAAIIAAAAVcGVybWl0LVgxMS1mb3J3YXJkaW5nAAAAAAAAABdwZXJtaXQtYWdlbnQtZm9yd2FyZGluZwAAAAAAAAAWcGVybWl0LXBvcnQtZm9yd2FyZGluZwAAAAAAAAAKcGVybWl0LXB0eQAAAAAAAAAOcGVybWl0LXVzZXItcmMAAAAAAAAAAAAAADMAAAALc3NoLWVkMjU1MTkAAAAgSdo/E7TI8FM3BXafy/fBXJlISCkcos2qFymHVdjUa80AAABTAAAAC3NzaC1lZDI1NTE5AAAAQMj4+hlzVlmyS6tRl2dxPDNdFDGs0n8eJRCre4P9VSTKUBIF8yPP9cFDRnsfykuYghEAgGPmUh9AGplCwN+4GQo=",
+				ActorEmail:  "actor@email.com",
+				Type:        SSHKeyTypeDroplet,
+				fingerprint: "SHA256:kMvVfbsSluB3ud5HGHuoyd4tOyGNd2oZ+ea2Blf9CcA",
+			},
+			nil,
+		},
+		{
+			"should support sk-ecdsa-sha2-nistp256 security keys",
+			&SSHKey{
+				OSUser:     "root",
+				PublicKey:  "sk-ecdsa-sha2-nistp256@openssh.com AAAAInNrLWVjZHNhLXNoYTItbmlzdHAyNTZAb3BlbnNzaC5jb20AAAAIbmlzdHAyNTYAAABBBGeNmBshBcmIJWam+LY0ipC0VzWJoK+miRrWZiKFr0L70wTyaoasb9ph+BH9HLJGatK/lzCW7V9E7YbeVY5JSz8AAAAEc3NoOg== user@token",
+				ActorEmail: "actor@email.com",
+				Type:       SSHKeyTypeDOTTY,
+				TTL:        60,
+			},
+			&SSHKey{
+				OSUser:      "root",
+				PublicKey:   "sk-ecdsa-sha2-nistp256@openssh.com AAAAInNrLWVjZHNhLXNoYTItbmlzdHAyNTZAb3BlbnNzaC5jb20AAAAIbmlzdHAyNTYAAABBBGeNmBshBcmIJWam+LY0ipC0VzWJoK+miRrWZiKFr0L70wTyaoasb9ph+BH9HLJGatK/lzCW7V9E7YbeVY5JSz8AAAAEc3NoOg== user@token",
+				ActorEmail:  "actor@email.com",
+				Type:        SSHKeyTypeDOTTY,
+				TTL:         60,
+				fingerprint: "SHA256:pHpyvw/bT98+TIERXS33BFPaaHq+i8d55+eANJUZ6rY",
+				expireAt:    timeNow.Add(60 * time.Second),
+			},
+			nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -995,6 +1503,189 @@ func Test_sshHelperImpl_validateKey(t *testing.T) {
 	}
 }
 
+func Test_sshHelperImpl_validateKeyShortTTL(t *testing.T) {
+	timeNow := time.Now()
+	sweepInterval := 120 * time.Second
+	pubKey := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE="
+	tests := []struct {
+		name         string
+		ttl          int
+		policy       ShortTTLPolicy
+		wantExpireAt time.Time
+		wantWarning  bool
+		wantErr      error
+	}{
+		{
+			"should accept the key and warn by default",
+			60,
+			ShortTTLWarn,
+			timeNow.Add(60 * time.Second),
+			true,
+			nil,
+		},
+		{
+			"should extend the ttl to the sweep interval if clamping",
+			60,
+			ShortTTLClamp,
+			timeNow.Add(sweepInterval),
+			true,
+			nil,
+		},
+		{
+			"should reject the key if configured",
+			60,
+			ShortTTLReject,
+			time.Time{},
+			false,
+			ErrInvalidKey,
+		},
+		{
+			"should not warn if ttl is not shorter than the sweep interval",
+			120,
+			ShortTTLReject,
+			timeNow.Add(sweepInterval),
+			false,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warned := false
+			s := &sshHelperImpl{
+				mgr: &SSHManager{
+					keySweepInterval: sweepInterval,
+					shortTTLPolicy:   tt.policy,
+				},
+				timeNow: func() time.Time {
+					return timeNow
+				},
+				logWarning: func(_ string, _ ...interface{}) {
+					warned = true
+				},
+			}
+			key := &SSHKey{
+				OSUser:    "root",
+				PublicKey: pubKey,
+				Type:      SSHKeyTypeDOTTY,
+				TTL:       tt.ttl,
+			}
+			err := s.validateKey(key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateKey() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !key.expireAt.Equal(tt.wantExpireAt) {
+				t.Errorf("validateKey() expireAt = %v, want %v", key.expireAt, tt.wantExpireAt)
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("validateKey() warned = %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func Test_sshHelperImpl_validateKeyMaxTTL(t *testing.T) {
+	log.Mute()
+	timeNow := time.Now()
+	maxTTL := 4 * time.Hour
+	pubKey := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE="
+	tests := []struct {
+		name         string
+		keyType      SSHKeyType
+		ttl          int
+		reject       bool
+		wantExpireAt time.Time
+		wantErr      error
+	}{
+		{
+			"should keep the ttl if within the cap",
+			SSHKeyTypeDOTTY,
+			3600,
+			false,
+			timeNow.Add(time.Hour),
+			nil,
+		},
+		{
+			"should clamp the ttl to the cap by default",
+			SSHKeyTypeDOTTY,
+			86400,
+			false,
+			timeNow.Add(maxTTL),
+			nil,
+		},
+		{
+			"should reject the key if configured",
+			SSHKeyTypeDOTTY,
+			86400,
+			true,
+			time.Time{},
+			ErrInvalidKey,
+		},
+		{
+			"should not touch droplet keys",
+			SSHKeyTypeDroplet,
+			0,
+			true,
+			time.Time{},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &sshHelperImpl{
+				mgr: &SSHManager{
+					maxKeyTTL:        maxTTL,
+					rejectOverMaxTTL: tt.reject,
+				},
+				timeNow: func() time.Time {
+					return timeNow
+				},
+			}
+			key := &SSHKey{
+				OSUser:    "root",
+				PublicKey: pubKey,
+				Type:      tt.keyType,
+				TTL:       tt.ttl,
+			}
+			err := s.validateKey(key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateKey() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !key.expireAt.Equal(tt.wantExpireAt) {
+				t.Errorf("validateKey() expireAt = %v, want %v", key.expireAt, tt.wantExpireAt)
+			}
+			if key.TTL != tt.ttl {
+				t.Errorf("validateKey() TTL = %v, want %v", key.TTL, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestParseShortTTLPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    ShortTTLPolicy
+		wantErr error
+	}{
+		{"warn", ShortTTLWarn, nil},
+		{" Clamp ", ShortTTLClamp, nil},
+		{"REJECT", ShortTTLReject, nil},
+		{"ignore", ShortTTLWarn, ErrInvalidShortTTLPolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseShortTTLPolicy(tt.name)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseShortTTLPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseShortTTLPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_sshHelperImpl_sshdCfgModified(t *testing.T) {
 	log.Mute()
 	sshdCfgFile := "/path/to/sshd_config"
@@ -1011,14 +1702,23 @@ func Test_sshHelperImpl_sshdCfgModified(t *testing.T) {
 			false,
 		},
 		{
-			"return false if operation is not write, rename, or remove",
+			"return false if operation is not write, create, rename, or remove",
 			&fsnotify.Event{
 				Name: sshdCfgFile,
-				Op:   ^(fsnotify.Write | fsnotify.Rename | fsnotify.Remove),
+				Op:   ^(fsnotify.Write | fsnotify.Create | fsnotify.Rename | fsnotify.Remove),
 			},
 			nil,
 			false,
 		},
+		{
+			"return true if sshd_config is created again once given up on",
+			&fsnotify.Event{
+				Name: sshdCfgFile,
+				Op:   fsnotify.Create,
+			},
+			nil,
+			true,
+		},
 		{
 			"return true if is a Write operation",
 			&fsnotify.Event{
@@ -1107,9 +1807,9 @@ func Test_sshHelperImpl_sshdCfgModified(t *testing.T) {
 				gomock.InOrder(
 					w.EXPECT().Remove(sshdCfgFile).Return(nil),
 					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, errors.New("oops")),
-					sysMgr.EXPECT().Sleep(fileCheckInterval),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
 					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
-					sysMgr.EXPECT().Sleep(fileCheckInterval),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
 					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(true, nil),
 					w.EXPECT().Add(sshdCfgFile).Return(nil),
 				)
@@ -1140,3 +1840,120 @@ func Test_sshHelperImpl_sshdCfgModified(t *testing.T) {
 		})
 	}
 }
+
+func Test_sshHelperImpl_sshdCfgModified_maxWait(t *testing.T) {
+	log.Mute()
+	sshdCfgFile := "/etc/ssh/sshd_config"
+	interval := time.Second
+	ev := &fsnotify.Event{Name: sshdCfgFile, Op: fsnotify.Remove}
+
+	tests := []struct {
+		name    string
+		prepare func(w *MockfsWatcher, sysMgr *mocks.MocksysManager)
+		want    bool
+	}{
+		{
+			"should give up once sshd_config is not back within the max wait",
+			func(w *MockfsWatcher, sysMgr *mocks.MocksysManager) {
+				gomock.InOrder(
+					w.EXPECT().Remove(sshdCfgFile).Return(nil),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					sysMgr.EXPECT().Sleep(interval),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					sysMgr.EXPECT().Sleep(interval),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					// the directory is watched instead, not to miss the file once back
+					w.EXPECT().Add("/etc/ssh").Return(nil),
+				)
+			},
+			false,
+		},
+		{
+			"should give up even if the directory of sshd_config cannot be watched",
+			func(w *MockfsWatcher, sysMgr *mocks.MocksysManager) {
+				gomock.InOrder(
+					w.EXPECT().Remove(sshdCfgFile).Return(nil),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					sysMgr.EXPECT().Sleep(interval),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					sysMgr.EXPECT().Sleep(interval),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					w.EXPECT().Add("/etc/ssh").Return(errors.New("add-err")),
+				)
+			},
+			false,
+		},
+		{
+			"should report the change if sshd_config is back within the max wait",
+			func(w *MockfsWatcher, sysMgr *mocks.MocksysManager) {
+				gomock.InOrder(
+					w.EXPECT().Remove(sshdCfgFile).Return(nil),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					sysMgr.EXPECT().Sleep(interval),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(false, nil),
+					sysMgr.EXPECT().Sleep(interval),
+					sysMgr.EXPECT().FileExists(sshdCfgFile).Return(true, nil),
+					w.EXPECT().Add(sshdCfgFile).Return(nil),
+				)
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			fsWatcherMock := NewMockfsWatcher(mockCtl)
+			tt.prepare(fsWatcherMock, sysMgrMock)
+
+			s := &sshHelperImpl{
+				mgr: &SSHManager{
+					sysMgr:            sysMgrMock,
+					fileCheckInterval: interval,
+					sshdCfgMaxWait:    2 * interval,
+				},
+			}
+			if got := s.sshdCfgModified(fsWatcherMock, sshdCfgFile, ev); got != tt.want {
+				t.Errorf("sshdCfgModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStaticUsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]*sysutil.User
+		wantErr error
+	}{
+		{
+			"should parse multiple users",
+			"app:1000:1001:/srv/app, deploy:1002:1002:/home/deploy",
+			map[string]*sysutil.User{
+				"app":    {Name: "app", UID: 1000, GID: 1001, HomeDir: "/srv/app"},
+				"deploy": {Name: "deploy", UID: 1002, GID: 1002, HomeDir: "/home/deploy"},
+			},
+			nil,
+		},
+		{"should return an empty mapping if not configured", "", map[string]*sysutil.User{}, nil},
+		{"invalid format", "app:1000:/srv/app", nil, ErrInvalidStaticUsers},
+		{"invalid uid", "app:-1:1000:/srv/app", nil, ErrInvalidStaticUsers},
+		{"invalid gid", "app:1000:gid:/srv/app", nil, ErrInvalidStaticUsers},
+		{"relative home dir", "app:1000:1000:srv/app", nil, ErrInvalidStaticUsers},
+		{"duplicated user", "app:1000:1000:/srv/app,app:1001:1001:/srv/app", nil, ErrInvalidStaticUsers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseStaticUsers(tt.raw)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseStaticUsers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseStaticUsers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
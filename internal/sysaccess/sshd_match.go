@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/sysutil"
+)
+
+// sshdMatchBlock is a Match block in sshd_config. Only the User and Group criteria are supported,
+// blocks with any other criteria never match, so that their configs are not applied to the wrong users
+type sshdMatchBlock struct {
+	users       string // comma separated pattern list, empty if not a criterion of the block
+	groups      string // comma separated pattern list, empty if not a criterion of the block
+	unsupported bool
+
+	authorizedKeysFilePattern           string
+	authorizedKeysFileSecondaryPatterns []string
+}
+
+// parseSSHDMatch parses a Match line, it returns nil if the line is "Match all", which ends the previous Match block
+func parseSSHDMatch(line string) (*sshdMatchBlock, error) {
+	var criteria []string
+	for _, item := range strings.Split(line, " ")[1:] {
+		if item == "#" {
+			break
+		}
+		if item != "" {
+			criteria = append(criteria, item)
+		}
+	}
+	if len(criteria) == 1 && strings.EqualFold(criteria[0], "all") {
+		return nil, nil
+	}
+	ret := &sshdMatchBlock{}
+	if len(criteria) == 0 || len(criteria)%2 != 0 {
+		// still returns a block, so that the configs within it are not taken as global ones
+		ret.unsupported = true
+		return ret, fmt.Errorf("%w: invalid Match criteria: %v", ErrSSHDConfigParseFailed, criteria)
+	}
+	for i := 0; i < len(criteria); i += 2 {
+		switch strings.ToLower(criteria[i]) {
+		case "user":
+			ret.users = criteria[i+1]
+		case "group":
+			ret.groups = criteria[i+1]
+		default:
+			ret.unsupported = true
+		}
+	}
+	return ret, nil
+}
+
+// matches checks if the block applies to the given user, groups are only fetched when needed
+func (m *sshdMatchBlock) matches(user *sysutil.User, getGroups func() []string) bool {
+	if m.unsupported {
+		return false
+	}
+	if m.users != "" && matchPatternList(user.Name, m.users) != 1 {
+		return false
+	}
+	if m.groups != "" {
+		matched := false
+		for _, group := range getGroups() {
+			switch matchPatternList(group, m.groups) {
+			case -1:
+				// a negated match on any group rejects the block, same as sshd
+				return false
+			case 1:
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPatternList matches name against a comma separated list of sshd patterns.
+// It returns 1 if matched, -1 if matched by a negated pattern (prefixed with "!"), or 0 if not matched
+func matchPatternList(name, patterns string) int {
+	ret := 0
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if ok, _ := path.Match(pattern, name); !ok {
+			continue
+		}
+		if negated {
+			return -1
+		}
+		ret = 1
+	}
+	return ret
+}
+
+// authorizedKeysFilePatternFor returns the AuthorizedKeysFile pattern of the first Match block that applies to the
+// user, or the global one if none applies
+func (s *SSHManager) authorizedKeysFilePatternFor(user *sysutil.User) string {
+	if m := s.authorizedKeysFileMatchFor(user); m != nil {
+		return m.authorizedKeysFilePattern
+	}
+	return s.authorizedKeysFilePattern
+}
+
+// secondaryAuthorizedKeysFilePatternsFor returns the AuthorizedKeysFile patterns applying to the user other than
+// the one returned by authorizedKeysFilePatternFor
+func (s *SSHManager) secondaryAuthorizedKeysFilePatternsFor(user *sysutil.User) []string {
+	if m := s.authorizedKeysFileMatchFor(user); m != nil {
+		return m.authorizedKeysFileSecondaryPatterns
+	}
+	return s.authorizedKeysFileSecondaryPatterns
+}
+
+// authorizedKeysFileMatchFor returns the first Match block setting AuthorizedKeysFile that applies to the user,
+// or nil if none applies
+func (s *SSHManager) authorizedKeysFileMatchFor(user *sysutil.User) *sshdMatchBlock {
+	var groups []string
+	groupsFetched := false
+	getGroups := func() []string {
+		if !groupsFetched {
+			groupsFetched = true
+			var err error
+			if groups, err = s.sysMgr.GetUserGroups(user); err != nil {
+				log.Error("failed to get groups of user [%s]: %v", user.Name, err)
+			}
+		}
+		return groups
+	}
+	for _, m := range s.authorizedKeysFileMatches {
+		if m.matches(user, getGroups) {
+			return m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package sysaccess
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/droplet-agent/internal/log"
+	"github.com/digitalocean/droplet-agent/internal/sysaccess/internal/mocks"
+	"github.com/digitalocean/droplet-agent/internal/sysutil"
+
+	"go.uber.org/mock/gomock"
+)
+
+func TestSSHManager_authorizedKeysFilePatternFor(t *testing.T) {
+	log.Mute()
+	sshdCfg := `AuthorizedKeysFile .ssh/authorized_keys
+Port 22
+
+Match User root,admin*
+	AuthorizedKeysFile /etc/ssh/root_keys/%u
+	AuthorizedKeysFile /etc/ssh/ignored/%u
+	Port 2222
+
+Match Group staff,!contractors
+	AuthorizedKeysFile /etc/ssh/staff_keys/%u # staff only
+
+Match User deploy Group ci
+	AuthorizedKeysFile /etc/ssh/ci_keys/%u
+
+Match Address 10.0.0.0/8
+	AuthorizedKeysFile /etc/ssh/internal_keys/%u
+
+Match all
+AuthorizedKeysFile /etc/ssh/not_global/%u
+`
+	tests := []struct {
+		name      string
+		user      *sysutil.User
+		groups    []string
+		groupsErr error
+		want      string
+	}{
+		{
+			"should use the global pattern if no Match block applies",
+			&sysutil.User{Name: "hlee"},
+			[]string{"hlee"},
+			nil,
+			"%h/.ssh/authorized_keys",
+		},
+		{
+			"should use the pattern of the matched Match User block",
+			&sysutil.User{Name: "root"},
+			nil,
+			nil,
+			"/etc/ssh/root_keys/%u",
+		},
+		{
+			"should support wildcards in Match User",
+			&sysutil.User{Name: "admin2"},
+			nil,
+			nil,
+			"/etc/ssh/root_keys/%u",
+		},
+		{
+			"should use the pattern of the matched Match Group block",
+			&sysutil.User{Name: "hlee"},
+			[]string{"hlee", "staff"},
+			nil,
+			"/etc/ssh/staff_keys/%u",
+		},
+		{
+			"should not match if the user is in a negated group",
+			&sysutil.User{Name: "hlee"},
+			[]string{"staff", "contractors"},
+			nil,
+			"%h/.ssh/authorized_keys",
+		},
+		{
+			"should require all criteria to match",
+			&sysutil.User{Name: "deploy"},
+			[]string{"deploy"},
+			nil,
+			"%h/.ssh/authorized_keys",
+		},
+		{
+			"should match if all criteria match",
+			&sysutil.User{Name: "deploy"},
+			[]string{"deploy", "ci"},
+			nil,
+			"/etc/ssh/ci_keys/%u",
+		},
+		{
+			"should fall back to the global pattern if failed to get the groups",
+			&sysutil.User{Name: "hlee"},
+			nil,
+			errors.New("group-err"),
+			"%h/.ssh/authorized_keys",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().ReadFile(gomock.Any()).Return([]byte(sshdCfg), nil)
+			sysMgrMock.EXPECT().GetUserGroups(tt.user).Return(tt.groups, tt.groupsErr).MaxTimes(1)
+			s := &SSHManager{
+				sysMgr: sysMgrMock,
+			}
+			s.sshHelper = &sshHelperImpl{mgr: s}
+			if err := s.parseSSHDConfig(); err != nil {
+				t.Fatalf("parseSSHDConfig() unexpected error = %v", err)
+			}
+			if s.sshdPort != 22 {
+				t.Errorf("parseSSHDConfig() SSHD Port got = [%v], want [22]", s.sshdPort)
+			}
+			if got := s.authorizedKeysFilePatternFor(tt.user); got != tt.want {
+				t.Errorf("authorizedKeysFilePatternFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHManager_parseSSHDConfig_includeEndsInMatch(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config").Return([]byte("Include /etc/ssh/sshd_config.d/*.conf\n"+
+		"Port 2200\nAuthorizedKeysFile .ssh/global_keys\n"), nil)
+	sysMgrMock.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{"/etc/ssh/sshd_config.d/50-root.conf"}, nil)
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-root.conf").Return([]byte("Match User root\n"+
+		"\tAuthorizedKeysFile /etc/ssh/root_keys/%u\n"), nil)
+	s := &SSHManager{
+		sysMgr: sysMgrMock,
+	}
+	s.sshHelper = &sshHelperImpl{mgr: s}
+	if err := s.parseSSHDConfig(); err != nil {
+		t.Fatalf("parseSSHDConfig() unexpected error = %v", err)
+	}
+	if s.sshdPort != 2200 {
+		t.Errorf("parseSSHDConfig() SSHD Port got = [%v], want [2200]", s.sshdPort)
+	}
+	if s.authorizedKeysFilePattern != "%h/.ssh/global_keys" {
+		t.Errorf("parseSSHDConfig() AuthorizedKeysFile got = [%v], want [%%h/.ssh/global_keys]", s.authorizedKeysFilePattern)
+	}
+	if got := s.authorizedKeysFilePatternFor(&sysutil.User{Name: "root"}); got != "/etc/ssh/root_keys/%u" {
+		t.Errorf("authorizedKeysFilePatternFor(root) = %v, want /etc/ssh/root_keys/%%u", got)
+	}
+}
+
+func Test_parseSSHDMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *sshdMatchBlock
+		wantErr error
+	}{
+		{"Match all ends the Match block", "Match all", nil, nil},
+		{"should parse User", "Match User root", &sshdMatchBlock{users: "root"}, nil},
+		{"should parse Group", "Match group staff # comment", &sshdMatchBlock{groups: "staff"}, nil},
+		{"should parse multiple criteria", "Match User  deploy  Group ci", &sshdMatchBlock{users: "deploy", groups: "ci"}, nil},
+		{"should mark unsupported criteria", "Match LocalPort 2222", &sshdMatchBlock{unsupported: true}, nil},
+		{"should mark invalid criteria", "Match User", &sshdMatchBlock{unsupported: true}, ErrSSHDConfigParseFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSSHDMatch(tt.line)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseSSHDMatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("parseSSHDMatch() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
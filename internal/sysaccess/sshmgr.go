@@ -3,10 +3,13 @@
 package sysaccess
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"net"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +20,7 @@ import (
 	"github.com/digitalocean/droplet-agent/internal/log"
 	"github.com/digitalocean/droplet-agent/internal/sysutil"
 
+	"github.com/fsnotify/fsnotify"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -29,7 +33,11 @@ const (
 	dottyKeyIndicator         = "dotty_ssh"
 	defaultOSUser             = "root"
 	defaultSSHDPort           = 22
-	fileCheckInterval         = 5 * time.Second
+	defaultFileCheckInterval  = 5 * time.Second
+
+	defaultFSWatcherSetupTimeout = 10 * time.Second
+	maxSSHDConfigIncludeDepth    = 16         // same as the limit used by sshd itself
+	sshdIncludeBaseDir           = "/etc/ssh" // sshd resolves relative Include paths against it, whatever the config file
 )
 
 // SSHManager provides functions for managing SSH access
@@ -37,17 +45,50 @@ type SSHManager struct {
 	sshHelper
 	authorizedKeysFileUpdater
 
-	authorizedKeysFilePattern string // same as the AuthorizedKeysFile in sshd_config, default to %h/.ssh/authorized_keys
-	sshdPort                  int
+	authorizedKeysFilePattern           string            // same as the AuthorizedKeysFile in sshd_config, default to %h/.ssh/authorized_keys
+	authorizedKeysFileSecondaryPatterns []string          // the other patterns listed by AuthorizedKeysFile, only read from
+	authorizedKeysFileMatches           []*sshdMatchBlock // AuthorizedKeysFile overrides set within Match blocks, in order
+	sshdIncludedFiles                   []string          // files included by sshd_config that were parsed, in order
+	sshdIncludePatterns                 []string          // absolute globs of the Include directives, in order
+	authorizedKeysCommand               string            // same as the AuthorizedKeysCommand in sshd_config, if any
+	authorizedKeysFileUnused            bool              // set if sshd only reads keys through the AuthorizedKeysCommand
+	sshdConfigErrs                      []error           // errors encountered while parsing sshd_config the last time
+	sshdPort                            int
+
+	logWarning func(format string, params ...interface{})
+
+	sysMgr                sysManager
+	fsWatcher             fsWatcher
+	fsWatcherQuitHook     func()
+	fsWatcherSetupTimeout time.Duration
+	sshdCfgPollQuit       chan struct{}
+	closeOnce             sync.Once
+	fileCheckInterval     time.Duration // how often the sshd_config is checked when it cannot be watched
+	sshdCfgMaxWait        time.Duration // how long to wait for a removed sshd_config to be back, 0 means forever
 
-	sysMgr            sysManager
-	fsWatcher         fsWatcher
-	fsWatcherQuitHook func()
+	cachedKeys     map[string][]*SSHKey
+	cachedKeysLock sync.Mutex // only guards the cachedKeys map, held shortly when reading or replacing the keys of a user
+	updateKeysLock sync.Mutex // serializes the updates of the whole set of keys, which are diffed against the cached keys
+	userKeysLocks  sync.Map   // per user locks, held while the authorized_keys file of the user is being updated
+	keysFileDiffs  *keysFileDiffHistory
+	metrics        *sshMgrMetrics
 
-	cachedKeys       map[string][]*SSHKey
-	cachedKeysOpLock sync.Mutex
+	revokedKeys     map[string]bool // fingerprints and actor emails of the DOTTY keys revoked through the metadata
+	revokedKeysLock sync.Mutex
 
 	manageDropletKeys uint32
+	preciseKeyExpiry  bool
+	dryRun            bool // if set, changes to the authorized_keys files are only logged
+
+	allowSymlinkedKeysFile bool
+	minFreeDiskSpace       uint64 // in bytes, 0 means the free space is not checked
+
+	keySweepInterval time.Duration
+	shortTTLPolicy   ShortTTLPolicy
+	maxKeyTTL        time.Duration
+	rejectOverMaxTTL bool
+
+	staticUsers map[string]*sysutil.User
 }
 
 // NewSSHManager constructs a new SSHManager object
@@ -58,9 +99,28 @@ func NewSSHManager(opts ...SSHManagerOpt) (*SSHManager, error) {
 	}
 	ret := &SSHManager{
 		sysMgr:            sysutil.NewSysManager(),
+		logWarning:        log.Warn,
 		cachedKeys:        make(map[string][]*SSHKey),
+		keysFileDiffs:     newKeysFileDiffHistory(defaultKeysFileDiffHistorySize),
+		metrics:           newSSHMgrMetrics(defaultOpts.metricsRegisterer),
 		sshdPort:          defaultOpts.customSSHDPort,
 		manageDropletKeys: manageDropletKeysEnabled,
+		preciseKeyExpiry:  defaultOpts.preciseKeyExpiry,
+		dryRun:            defaultOpts.dryRun,
+
+		allowSymlinkedKeysFile: defaultOpts.allowSymlinkedKeysFile,
+		minFreeDiskSpace:       defaultOpts.minFreeDiskSpace,
+
+		fsWatcherSetupTimeout: defaultOpts.fsWatcherSetupTimeout,
+		fileCheckInterval:     defaultOpts.fileCheckInterval,
+		sshdCfgMaxWait:        defaultOpts.sshdCfgMaxWait,
+
+		keySweepInterval: defaultOpts.keySweepInterval,
+		shortTTLPolicy:   defaultOpts.shortTTLPolicy,
+		maxKeyTTL:        defaultOpts.maxKeyTTL,
+		rejectOverMaxTTL: defaultOpts.rejectOverMaxTTL,
+
+		staticUsers: defaultOpts.staticUsers,
 	}
 	if !defaultOpts.manageDropletKeys {
 		ret.manageDropletKeys = manageDropletKeysDisabled
@@ -68,6 +128,7 @@ func NewSSHManager(opts ...SSHManagerOpt) (*SSHManager, error) {
 	ret.sshHelper = &sshHelperImpl{
 		mgr:               ret,
 		timeNow:           time.Now,
+		logWarning:        log.Warn,
 		customSSHDCfgFile: defaultOpts.customSSHDCfgFile,
 	}
 	ret.authorizedKeysFileUpdater = &updaterImpl{sshMgr: ret}
@@ -83,6 +144,31 @@ func NewSSHManager(opts ...SSHManagerOpt) (*SSHManager, error) {
 	return ret, nil
 }
 
+// RecentKeysFileDiffs returns the lines removed and added by the most recent updates of the authorized_keys files,
+// the oldest first
+func (s *SSHManager) RecentKeysFileDiffs() []KeysFileDiff {
+	return s.keysFileDiffs.list()
+}
+
+// ListManagedKeys returns the metadata of the keys currently managed by the agent, sorted by the os user
+func (s *SSHManager) ListManagedKeys() []KeyInfo {
+	cachedKeys := s.cachedKeysSnapshot()
+	users := sortedUsers(cachedKeys)
+	ret := make([]KeyInfo, 0)
+	for _, user := range users {
+		for _, k := range cachedKeys[user] {
+			ret = append(ret, KeyInfo{
+				OSUser:      k.OSUser,
+				ActorEmail:  k.ActorEmail,
+				Fingerprint: k.fingerprint,
+				ExpireAt:    k.expireAt,
+				Type:        k.Type,
+			})
+		}
+	}
+	return ret
+}
+
 // EnableManagedDropletKeys enables the SSH manager to manage droplet keys
 func (s *SSHManager) EnableManagedDropletKeys() {
 	atomic.StoreUint32(&s.manageDropletKeys, manageDropletKeysEnabled)
@@ -96,37 +182,32 @@ func (s *SSHManager) DisableManagedDropletKeys() {
 // RemoveExpiredKeys removes expired keys from the authorized_keys file
 func (s *SSHManager) RemoveExpiredKeys() (err error) {
 	log.Debug("removing expired keys")
-	s.cachedKeysOpLock.Lock()
-	defer s.cachedKeysOpLock.Unlock()
-
-	if len(s.cachedKeys) == 0 {
+	users := sortedUsers(s.cachedKeysSnapshot())
+	if len(users) == 0 {
 		log.Debug("empty cached keys, skip removing")
 		return nil
 	}
-	cleanKeys := s.removeExpiredKeys(s.cachedKeys)
-	hasExpired := false
-	defer func() {
-		if hasExpired && err == nil {
-			log.Debug("expired keys removed")
-			s.cachedKeys = cleanKeys
-		} else {
-			log.Debug("has expired keys: %v, update file error: %v", hasExpired, err)
-		}
-	}()
+	unlock := s.lockUsers(users)
+	defer unlock()
+
+	cachedKeys := s.cachedKeysSnapshot(users...)
+	cleanKeys := s.removeExpiredKeys(cachedKeys)
 	eg, _ := errgroup.WithContext(context.Background())
-	for user, keys := range s.cachedKeys {
+	for user, keys := range cachedKeys {
 		u := user
 		if s.areSameKeys(keys, cleanKeys[u]) {
 			// keys all still valid for this user, no need to update
 			continue
 		}
-		hasExpired = true
 		eg.Go(func() error {
 			log.Debug("removing expired keys for %s", u)
 			if e := s.updateAuthorizedKeysFile(u, cleanKeys[u]); e != nil {
 				log.Error("failed to remove expired keys for %s: %v", u, e)
+				s.metrics.updateFailed()
 				return e
 			}
+			log.Debug("expired keys removed for %s", u)
+			s.setCachedKeys(u, cleanKeys[u])
 			return nil
 		})
 	}
@@ -134,75 +215,93 @@ func (s *SSHManager) RemoveExpiredKeys() (err error) {
 }
 
 // UpdateKeys updates the given ssh keys to corresponding authorized_keys files.
-func (s *SSHManager) UpdateKeys(keys []*SSHKey) (retErr error) {
-	s.cachedKeysOpLock.Lock() // this lock may be too aggressive and can be possibly refined
-	defer s.cachedKeysOpLock.Unlock()
+// The authorized_keys files of different users are updated in parallel, but the calls are serialized: since the users
+// without keys are found by diffing the given keys against the cached ones, overlapping calls could otherwise leave
+// behind the keys of users dropped by the most recent call.
+func (s *SSHManager) UpdateKeys(keys []*SSHKey) error {
 	if keys == nil {
 		return ErrInvalidArgs
 	}
-	keyGroups := make(map[string][]*SSHKey) // group the keys by os user
-	updatedKeys := make(map[string][]*SSHKey)
-	for _, key := range keys {
-		if err := s.validateKey(key); err != nil {
-			//invalid key, skip
-			log.Error("invalid key, %s", err.Error())
-			continue
-		}
-		if _, ok := keyGroups[key.OSUser]; !ok {
-			keyGroups[key.OSUser] = make([]*SSHKey, 0, 1)
-		}
-		keyGroups[key.OSUser] = append(keyGroups[key.OSUser], key)
+	if s.authorizedKeysFileUnused {
+		return fmt.Errorf("%w: AuthorizedKeysFile is none and sshd reads keys through AuthorizedKeysCommand [%s]",
+			ErrAuthorizedKeysFileUnused, s.authorizedKeysCommand)
 	}
-	defer func() {
-		if retErr == nil {
-			s.cachedKeys = updatedKeys
-		}
-	}()
+	s.updateKeysLock.Lock()
+	defer s.updateKeysLock.Unlock()
+	keyGroups := s.groupKeysByUser(keys)
+
+	users := sortedUsers(s.cachedKeysSnapshot())
+	for user := range keyGroups {
+		users = append(users, user)
+	}
+	if len(users) == 0 {
+		log.Debug("no keys to update")
+		return nil
+	}
+	unlock := s.lockUsers(users)
+	defer unlock()
 
-	cleanKeys := s.removeExpiredKeys(s.cachedKeys)
+	cachedKeys := s.cachedKeysSnapshot(users...)
+	cleanKeys := s.removeExpiredKeys(cachedKeys)
+	eg, _ := errgroup.WithContext(context.Background())
 	for username, keys := range keyGroups {
-		if s.areSameKeys(keys, cleanKeys[username]) {
+		u, k := username, keys
+		if s.areSameKeys(k, cleanKeys[u]) {
 			//key not changed for the current user, skip
-			log.Debug("keys not changed for %s, skipped", username)
-			updatedKeys[username] = cleanKeys[username]
+			log.Debug("keys not changed for %s, skipped", u)
+			s.setCachedKeys(u, cleanKeys[u])
 			continue
 		}
-		log.Debug("updating %d keys for %s", len(keys), username)
-		if err := s.updateAuthorizedKeysFile(username, keys); err != nil {
-			log.Error("failed to update keys for %s:%v", username, err)
-			continue
-		}
-		updatedKeys[username] = keys
+		eg.Go(func() error {
+			log.Debug("updating %d keys for %s", len(k), u)
+			if err := s.updateAuthorizedKeysFile(u, k); err != nil {
+				log.Error("failed to update keys for %s:%v", u, err)
+				s.metrics.updateFailed()
+				s.setCachedKeys(u, nil)
+				return nil
+			}
+			s.setCachedKeys(u, k)
+			return nil
+		})
 	}
 
-	for user := range s.cachedKeys {
+	for user := range cachedKeys {
 		// update the authorized_keys file for users that no longer have valid keys
-		if _, ok := keyGroups[user]; !ok {
+		if _, ok := keyGroups[user]; ok {
+			continue
+		}
+		u := user
+		eg.Go(func() error {
 			// if keys of a user is deleted
-			log.Debug("removing keys for %s", user)
-			if err := s.updateAuthorizedKeysFile(user, []*SSHKey{}); err != nil {
+			log.Debug("removing keys for %s", u)
+			if err := s.updateAuthorizedKeysFile(u, []*SSHKey{}); err != nil {
 				if errors.Is(err, sysutil.ErrUserNotFound) {
-					log.Info("os user [%s] no longer exists", user)
-					continue
+					log.Info("os user [%s] no longer exists", u)
+					s.setCachedKeys(u, nil)
+					return nil
 				}
-				log.Error("failed to remove keys for user %s:%v", user, err)
+				log.Error("failed to remove keys for user %s:%v", u, err)
+				s.metrics.updateFailed()
 				// if failed to remove ssh keys for a user,
 				// preserve them so that the removal can be retried next time
-				updatedKeys[user] = s.cachedKeys[user]
+				return nil
 			}
-		}
+			s.setCachedKeys(u, nil)
+			return nil
+		})
 	}
-	return nil
+	return eg.Wait()
 }
 
 // RemoveDOTTYKeys removes all dotty keys from the droplet
 // When the agent exit, all temporary keys managed through DigitalOcean must be cleaned up
 // to avoid leaving stale expired keys in the system
 func (s *SSHManager) RemoveDOTTYKeys() error {
-	s.cachedKeysOpLock.Lock()
-	defer s.cachedKeysOpLock.Unlock()
+	users := sortedUsers(s.cachedKeysSnapshot())
+	unlock := s.lockUsers(users)
+	defer unlock()
 	eg, _ := errgroup.WithContext(context.Background())
-	for user := range s.cachedKeys {
+	for _, user := range users {
 		u := user
 		eg.Go(func() error {
 			if err := s.updateAuthorizedKeysFile(u, nil); err != nil {
@@ -218,23 +317,313 @@ func (s *SSHManager) RemoveDOTTYKeys() error {
 	return eg.Wait()
 }
 
+// RevokeKeys immediately removes the DOTTY keys matching the given fingerprints from the authorized_keys files and the
+// cached keys, instead of waiting for them to expire. Each entry is either the SHA256 fingerprint of a key or the email
+// of the actor the key was issued to. The given list replaces the previously revoked ones, and matching keys are refused
+// by the following updates as long as they stay revoked. Droplet keys are never revoked.
+func (s *SSHManager) RevokeKeys(fingerprints []string) error {
+	revoked := make(map[string]bool, len(fingerprints))
+	for _, f := range fingerprints {
+		if f = strings.TrimSpace(f); f != "" {
+			revoked[f] = true
+		}
+	}
+	s.revokedKeysLock.Lock()
+	s.revokedKeys = revoked
+	s.revokedKeysLock.Unlock()
+	if len(revoked) == 0 {
+		return nil
+	}
+
+	users := sortedUsers(s.cachedKeysSnapshot())
+	if len(users) == 0 {
+		return nil
+	}
+	unlock := s.lockUsers(users)
+	defer unlock()
+
+	cachedKeys := s.cachedKeysSnapshot(users...)
+	eg, _ := errgroup.WithContext(context.Background())
+	for user, keys := range cachedKeys {
+		u := user
+		remaining := make([]*SSHKey, 0, len(keys))
+		for _, k := range keys {
+			if s.isRevoked(k) {
+				log.Info("revoking dotty key [%s] of user [%s] issued to [%s]", managedKeyFingerprint(k), u, k.ActorEmail)
+				continue
+			}
+			remaining = append(remaining, k)
+		}
+		if len(remaining) == len(keys) {
+			// no revoked key for this user
+			continue
+		}
+		eg.Go(func() error {
+			if err := s.updateAuthorizedKeysFile(u, remaining); err != nil {
+				if errors.Is(err, sysutil.ErrUserNotFound) {
+					log.Info("os user [%s] no longer exists", u)
+					s.setCachedKeys(u, nil)
+					return nil
+				}
+				log.Error("failed to revoke keys for %s: %v", u, err)
+				s.metrics.updateFailed()
+				return fmt.Errorf("%w: failed to revoke keys for user %s", err, u)
+			}
+			s.setCachedKeys(u, remaining)
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// isRevoked tells whether the given key is a DOTTY key revoked through the metadata
+func (s *SSHManager) isRevoked(key *SSHKey) bool {
+	if key.Type != SSHKeyTypeDOTTY {
+		return false
+	}
+	s.revokedKeysLock.Lock()
+	defer s.revokedKeysLock.Unlock()
+	if len(s.revokedKeys) == 0 {
+		return false
+	}
+	return s.revokedKeys[managedKeyFingerprint(key)] || (key.ActorEmail != "" && s.revokedKeys[key.ActorEmail])
+}
+
+// PruneStaleDropletKeys removes the droplet keys that are no longer among the given droplet keys from the
+// authorized_keys files, e.g. the keys rotated out while the agent was not running, without waiting for the next update
+// of the keys. The files of root and of the users owning the given keys are checked. DOTTY keys are left to expire.
+func (s *SSHManager) PruneStaleDropletKeys(dropletKeys []*SSHKey) error {
+	keyGroups := map[string][]*SSHKey{defaultOSUser: nil}
+	for _, k := range dropletKeys {
+		user := k.OSUser
+		if user == "" {
+			user = defaultOSUser
+		}
+		keyGroups[user] = append(keyGroups[user], k)
+	}
+	users := sortedUsers(keyGroups)
+	unlock := s.lockUsers(users)
+	defer unlock()
+	eg, _ := errgroup.WithContext(context.Background())
+	for _, user := range users {
+		u := user
+		eg.Go(func() error {
+			if err := s.pruneAuthorizedKeysFile(u, keyGroups[u]); err != nil {
+				if errors.Is(err, sysutil.ErrUserNotFound) {
+					log.Info("os user [%s] no longer exists", u)
+					return nil
+				}
+				return fmt.Errorf("%w: failed to prune keys for user %s", err, u)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// FixSSHDirPermissions makes sure the ~/.ssh directory of the given user is only accessible by the user (0700), and
+// that the authorized_keys file in it is only readable and writable by the user (0600), both owned by the user.
+// Otherwise, sshd refuses the keys when StrictModes is on. Keys files outside of ~/.ssh are left untouched.
+func (s *SSHManager) FixSSHDirPermissions(osUsername string) error {
+	osUser, err := s.lookupUser(osUsername)
+	if err != nil {
+		return err
+	}
+	return s.fixSSHDirPermissions(osUser, s.authorizedKeysFile(osUser))
+}
+
+func (s *SSHManager) fixSSHDirPermissions(user *sysutil.User, authorizedKeysFile string) error {
+	if user.HomeDir == "" {
+		return nil
+	}
+	sshDir := filepath.Join(user.HomeDir, ".ssh")
+	if filepath.Dir(filepath.Clean(authorizedKeysFile)) != sshDir {
+		// e.g. keys centrally managed under /etc/ssh, which are not owned by the user
+		return nil
+	}
+	changed, err := s.sysMgr.EnsureSSHDirPermissions(authorizedKeysFile, user)
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Info("fixed the permissions of [%s] of user [%s]", sshDir, user.Name)
+	}
+	return nil
+}
+
+// lockUsers exclusively locks the keys of the given users, so that the keys of other users can be updated in parallel.
+// The locks are always taken in the same order to avoid deadlocks. The returned function releases them.
+func (s *SSHManager) lockUsers(users []string) (unlock func()) {
+	sorted := make([]string, 0, len(users))
+	seen := make(map[string]bool, len(users))
+	for _, user := range users {
+		if !seen[user] {
+			seen[user] = true
+			sorted = append(sorted, user)
+		}
+	}
+	sort.Strings(sorted)
+	locks := make([]*sync.Mutex, 0, len(sorted))
+	for _, user := range sorted {
+		lockRaw, _ := s.userKeysLocks.LoadOrStore(user, &sync.Mutex{})
+		lock := lockRaw.(*sync.Mutex)
+		lock.Lock()
+		locks = append(locks, lock)
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// cachedKeysSnapshot returns a copy of the cached keys of the given users, or of all users if none is given, which can
+// be read without holding any lock
+func (s *SSHManager) cachedKeysSnapshot(users ...string) map[string][]*SSHKey {
+	s.cachedKeysLock.Lock()
+	defer s.cachedKeysLock.Unlock()
+	if s.cachedKeys == nil {
+		return nil
+	}
+	ret := make(map[string][]*SSHKey, len(s.cachedKeys))
+	if len(users) == 0 {
+		for user, keys := range s.cachedKeys {
+			ret[user] = keys
+		}
+		return ret
+	}
+	for _, user := range users {
+		if keys, ok := s.cachedKeys[user]; ok {
+			ret[user] = keys
+		}
+	}
+	return ret
+}
+
+// setCachedKeys replaces the cached keys of the given user, the user is removed from the cache if it has no keys
+func (s *SSHManager) setCachedKeys(user string, keys []*SSHKey) {
+	s.cachedKeysLock.Lock()
+	defer s.cachedKeysLock.Unlock()
+	before := make(map[string][]*SSHKey, len(s.cachedKeys))
+	for u, k := range s.cachedKeys {
+		before[u] = k
+	}
+	if s.cachedKeys == nil {
+		s.cachedKeys = make(map[string][]*SSHKey)
+	}
+	if len(keys) == 0 {
+		delete(s.cachedKeys, user)
+	} else {
+		s.cachedKeys[user] = keys
+	}
+	s.metrics.keysChanged(before, s.cachedKeys)
+}
+
+// groupKeysByUser groups the valid keys by os user, skipping the revoked ones
+func (s *SSHManager) groupKeysByUser(keys []*SSHKey) map[string][]*SSHKey {
+	keyGroups := make(map[string][]*SSHKey)
+	for _, key := range keys {
+		if err := s.validateKey(key); err != nil {
+			//invalid key, skip
+			log.Error("invalid key, %s", err.Error())
+			continue
+		}
+		if s.isRevoked(key) {
+			log.Info("dotty key [%s] of user [%s] is revoked, skipped", key.fingerprint, key.OSUser)
+			continue
+		}
+		if _, ok := keyGroups[key.OSUser]; !ok {
+			keyGroups[key.OSUser] = make([]*SSHKey, 0, 1)
+		}
+		keyGroups[key.OSUser] = append(keyGroups[key.OSUser], key)
+	}
+	return keyGroups
+}
+
+func sortedUsers(keys map[string][]*SSHKey) []string {
+	users := make([]string, 0, len(keys))
+	for user := range keys {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// keyExpiryLayout returns the time layout used when writing the expiry time of DOTTY keys
+func (s *SSHManager) keyExpiryLayout() string {
+	if s.preciseKeyExpiry {
+		return time.RFC3339Nano
+	}
+	return time.RFC3339
+}
+
 // SSHDPort returns the port sshd is binding to
 func (s *SSHManager) SSHDPort() int {
 	return s.sshdPort
 }
 
-// WatchSSHDConfig watches if sshd_config is modified,
+// SSHDConfigInfo returns the settings resolved from sshd_config
+func (s *SSHManager) SSHDConfigInfo() *SSHDConfigInfo {
+	return &SSHDConfigInfo{
+		ConfigFile:                s.sshdConfigFile(),
+		Port:                      s.sshdPort,
+		AuthorizedKeysFilePattern: s.authorizedKeysFilePattern,
+		AuthorizedKeysFileUnused:  s.authorizedKeysFileUnused,
+		ParseErrors:               s.sshdConfigErrs,
+	}
+}
+
+// SSHDConfigErrors returns the non-fatal errors encountered while parsing sshd_config as a SSHDConfigErrors,
+// or nil if it was parsed without errors
+func (s *SSHManager) SSHDConfigErrors() error {
+	if len(s.sshdConfigErrs) == 0 {
+		return nil
+	}
+	return SSHDConfigErrors(s.sshdConfigErrs)
+}
+
+// WatchSSHDConfig watches if sshd_config, or any of the files it includes, is modified,
 // if yes, it will close the returned channel so that all subscribers to that
 // channel will be notified
+// The directories of the Include directives are watched as well, so that a new file matching them is noticed.
+// If the fs watcher fails to watch any of these files in time, it falls back to periodically polling them.
 func (s *SSHManager) WatchSSHDConfig() (<-chan bool, error) {
 	sshdCfgFile := s.sshdConfigFile()
-	log.Info("[WatchSSHDConfig] watching file: %s", sshdCfgFile)
+	files := append([]string{sshdCfgFile}, s.sshdIncludedFiles...)
+	log.Info("[WatchSSHDConfig] watching files: %v", files)
 	w, evChan, errChan, e := s.newFSWatcher()
 	if e != nil {
 		log.Error("[WatchSSHDConfig] failed to launch watcher: %v", e)
 		return nil, e
 	}
 	ret := make(chan bool, 1)
+	fallBackToPolling := func(name string, err error) (<-chan bool, error) {
+		log.Error("[WatchSSHDConfig] failed to watch %s: %v. Falling back to polling", name, err)
+		if errors.Is(err, ErrWatchSSHDConfigFailed) {
+			// the Add call timed out and may still be holding the watcher, closing it could block as well
+			go func() { _ = w.Close() }()
+		} else {
+			_ = w.Close()
+		}
+		s.sshdCfgPollQuit = make(chan struct{})
+		go s.pollSSHDConfig(files, ret)
+		return ret, nil
+	}
+	for _, file := range files {
+		if e = s.addToFSWatcher(w, file); e != nil {
+			return fallBackToPolling(file, e)
+		}
+	}
+	for _, dir := range s.sshdIncludeDirs() {
+		if e = s.addToFSWatcher(w, dir); e != nil {
+			if errors.Is(e, ErrWatchSSHDConfigFailed) {
+				return fallBackToPolling(dir, e)
+			}
+			// e.g. the directory does not exist, there is nothing sshd could include from it either
+			log.Info("[WatchSSHDConfig] new files included from %s will not be noticed: %v", dir, e)
+		}
+	}
+	s.fsWatcher = w
 	go func() {
 		if s.fsWatcherQuitHook != nil {
 			defer s.fsWatcherQuitHook()
@@ -249,7 +638,11 @@ func (s *SSHManager) WatchSSHDConfig() (<-chan bool, error) {
 					log.Info("[WatchSSHDConfig] Events channel closed. Watcher quit")
 					return
 				}
-				if s.sshdCfgModified(w, sshdCfgFile, &ev) {
+				if ev.Name == sshdCfgFile {
+					if s.sshdCfgModified(w, sshdCfgFile, &ev) {
+						ret <- true
+					}
+				} else if s.sshdIncludedFileModified(&ev) {
 					ret <- true
 				}
 			case fsErr, ok := <-errChan:
@@ -262,34 +655,178 @@ func (s *SSHManager) WatchSSHDConfig() (<-chan bool, error) {
 			}
 		}
 	}()
-	e = w.Add(sshdCfgFile)
-	if e != nil {
-		_ = w.Close()
-		return nil, e
-	}
-	s.fsWatcher = w
 	return ret, nil
 }
 
-// Close properly shutdowns the SSH manager
-func (s *SSHManager) Close() error {
-	if s.fsWatcher != nil {
-		return s.fsWatcher.Close()
+// sshdIncludedFileModified checks whether the event indicates that one of the files included by sshd_config changed,
+// or that a new file matching one of its Include directives was created.
+// Unlike the sshd_config itself, an included file that is renamed or removed is considered a change right away, since
+// sshd (as well as the agent when restarted) simply skips the Include entries that do not match any file.
+func (s *SSHManager) sshdIncludedFileModified(ev *fsnotify.Event) bool {
+	included := false
+	for _, file := range s.sshdIncludedFiles {
+		if ev.Name == file {
+			included = true
+			break
+		}
 	}
-	return nil
+	if !included {
+		if ev.Op&(fsnotify.Write|fsnotify.Create) != 0 && s.matchesSSHDInclude(ev.Name) {
+			log.Info("[WatchSSHDConfig] new included file %s", ev.Name)
+			return true
+		}
+		return false
+	}
+	if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+		log.Info("[WatchSSHDConfig] included file %s modified", ev.Name)
+		return true
+	}
+	log.Debug("[WatchSSHDConfig] included file %s not modified, event ignored", ev.Name)
+	return false
+}
+
+// matchesSSHDInclude tells whether the given file matches any of the Include directives of sshd_config
+func (s *SSHManager) matchesSSHDInclude(name string) bool {
+	for _, pattern := range s.sshdIncludePatterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sshdIncludeDirs returns the directories of the Include directives, the ones with wildcards cannot be watched
+func (s *SSHManager) sshdIncludeDirs() []string {
+	dirs := make([]string, 0, len(s.sshdIncludePatterns))
+	seen := make(map[string]bool)
+	for _, pattern := range s.sshdIncludePatterns {
+		dir := filepath.Dir(pattern)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if strings.ContainsAny(dir, "*?[\\") {
+			log.Info("[WatchSSHDConfig] new files included through %s will not be noticed", pattern)
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// sshdCfgCheckInterval returns how often the sshd_config is checked when it cannot be watched
+func (s *SSHManager) sshdCfgCheckInterval() time.Duration {
+	if s.fileCheckInterval <= 0 {
+		return defaultFileCheckInterval
+	}
+	return s.fileCheckInterval
+}
+
+// addToFSWatcher adds the given file to the fs watcher,
+// giving up if the watcher does not manage to do so within the configured timeout
+func (s *SSHManager) addToFSWatcher(w fsWatcher, name string) error {
+	timeout := s.fsWatcherSetupTimeout
+	if timeout <= 0 {
+		timeout = defaultFSWatcherSetupTimeout
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- w.Add(name)
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w: timed out after %v", ErrWatchSSHDConfigFailed, timeout)
+	}
+}
+
+// pollSSHDConfig periodically reads the sshd_config, as well as the files it includes, and notifies via the given
+// channel once the content of any of them changed, or once a new file matches one of its Include directives.
+// A missing or unreadable file is not considered a change, for the same reasons explained in sshdCfgModified.
+func (s *SSHManager) pollSSHDConfig(files []string, ret chan<- bool) {
+	if s.fsWatcherQuitHook != nil {
+		defer s.fsWatcherQuitHook()
+	}
+	defer close(ret)
+	log.Info("[WatchSSHDConfig] polling files: %v", files)
+	originals := make([][]byte, len(files))
+	originalErrs := make([]error, len(files))
+	for i, file := range files {
+		originals[i], originalErrs[i] = s.sysMgr.ReadFile(file)
+	}
+	// only the files matching the Include directives from now on are new, including the ones that failed to be parsed
+	known := make(map[string]bool)
+	for _, file := range files {
+		known[file] = true
+	}
+	for _, pattern := range s.sshdIncludePatterns {
+		matches, _ := s.sysMgr.Glob(pattern)
+		for _, file := range matches {
+			known[file] = true
+		}
+	}
+	for {
+		select {
+		case <-s.sshdCfgPollQuit:
+			log.Info("[WatchSSHDConfig] Polling stopped")
+			return
+		default:
+		}
+		s.sysMgr.Sleep(s.sshdCfgCheckInterval())
+		for i, file := range files {
+			current, err := s.sysMgr.ReadFile(file)
+			if err != nil {
+				log.Debug("[WatchSSHDConfig] failed to read %s: %v", file, err)
+				continue
+			}
+			if originalErrs[i] != nil || !bytes.Equal(originals[i], current) {
+				log.Info("[WatchSSHDConfig] %s modified", file)
+				ret <- true
+				return
+			}
+		}
+		for _, pattern := range s.sshdIncludePatterns {
+			matches, _ := s.sysMgr.Glob(pattern)
+			for _, file := range matches {
+				if !known[file] {
+					log.Info("[WatchSSHDConfig] new included file %s", file)
+					ret <- true
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close properly shutdowns the SSH manager, calling it more than once has no effect
+func (s *SSHManager) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.sshdCfgPollQuit != nil {
+			close(s.sshdCfgPollQuit)
+		}
+		if s.fsWatcher != nil {
+			err = s.fsWatcher.Close()
+		}
+	})
+	return err
 }
 
 // parseSSHDConfig parses the sshd_config file and retrieves configurations needed by the agent, which are:
 //   - AuthorizedKeysFile : to know how to locate the authorized_keys file
 //   - Port | ListenAddress : to know which port sshd is currently binding to
+//   - AuthorizedKeysCommand : to know whether sshd reads the authorized_keys file at all
 //
 // NOTES:
 //   - the port specified in the command line arguments (--sshd_port) when launching the agent has the highest priority,
-//     if given, parseSSHDConfig will skip parsing port numbers specified in the sshd_config
+//     if given, the port numbers specified in the sshd_config are only used to warn about a likely wrong port
 //   - only 1 port is currently supported, if there are multiple ports presented, for example, multiple "Port" entries
 //     or more ports are found from `ListenAddress` entry/entries, the agent will only take the first one found, and this
 //     *MAY NOT* be the right one. If this happens to be the case, please explicit specify which port the agent should
 //     watch via the command line argument "--sshd_port"
+//   - AuthorizedKeysFile set within "Match User" and/or "Match Group" blocks only applies to the matching users, blocks
+//     with other criteria are ignored
 func (s *SSHManager) parseSSHDConfig() error {
 	defer func() {
 		if s.authorizedKeysFilePattern == "" {
@@ -304,43 +841,131 @@ func (s *SSHManager) parseSSHDConfig() error {
 
 	sshdConfigBytes, err := s.sysMgr.ReadFile(s.sshdConfigFile())
 	if err != nil {
-		return fmt.Errorf("%w:%s", ErrSSHDConfigParseFailed, err.Error())
+		return fmt.Errorf("%w:%s", ErrSSHDConfigUnreadable, err.Error())
+	}
+	state := &sshdConfigParseState{}
+	s.parseSSHDConfigContent(sshdConfigBytes, 0, state)
+	s.sshdConfigErrs = state.errs
+	s.resolveSSHDPort(state.ports)
+	if s.authorizedKeysCommand != "" {
+		if state.authorizedKeysFileNone {
+			log.Error("sshd_config sets AuthorizedKeysFile to none and uses AuthorizedKeysCommand [%s], "+
+				"keys written by the agent will NOT take effect", s.authorizedKeysCommand)
+			s.authorizedKeysFileUnused = true
+		} else {
+			log.Info("sshd_config uses AuthorizedKeysCommand [%s] in addition to the AuthorizedKeysFile", s.authorizedKeysCommand)
+		}
+	}
+	return nil
+}
+
+// resolveSSHDPort takes the first port found in sshd_config, unless a port is explicitly configured, in which case
+// it is kept as is, but a warning is logged if sshd is not listening on it according to sshd_config
+func (s *SSHManager) resolveSSHDPort(ports []int) {
+	if s.sshdPort == 0 {
+		if len(ports) != 0 {
+			s.sshdPort = ports[0]
+		}
+		return
+	}
+	if len(ports) == 0 {
+		ports = []int{defaultSSHDPort}
+	}
+	for _, port := range ports {
+		if port == s.sshdPort {
+			return
+		}
+	}
+	warn := s.logWarning
+	if warn == nil {
+		warn = log.Warn
 	}
-	sshdConfigs := strings.Split(string(sshdConfigBytes), "\n")
-	jobDoneCnt := 0
-	var errsEncountered []error
+	warn("the configured sshd port [%d] is not among the ports sshd listens on according to sshd_config %v, "+
+		"web console connections will likely fail", s.sshdPort, ports)
+}
+
+// sshdConfigParseState keeps track of the parsing progress across the sshd_config and the files it includes
+type sshdConfigParseState struct {
+	authorizedKeysFileFound bool
+	authorizedKeysFileNone  bool            // set if the AuthorizedKeysFile found is "none"
+	ports                   []int           // ports found from the Port and ListenAddress entries, in order
+	match                   *sshdMatchBlock // the Match block being parsed, nil if parsing global configs
+	errs                    []error
+}
+
+// parseSSHDConfigContent parses the given sshd_config content, following the Include directives.
+// Included files are parsed in place, so the first occurrence of a config still wins.
+func (s *SSHManager) parseSSHDConfigContent(content []byte, depth int, state *sshdConfigParseState) {
+	sshdConfigs := strings.Split(string(content), "\n")
 	for _, line := range sshdConfigs {
 		line = strings.ReplaceAll(line, "#", " #")
 		line = strings.ReplaceAll(line, "\t", " ")
 		line = strings.TrimLeft(line, " ")
 		var e error
-		if strings.HasPrefix(line, "AuthorizedKeysFile ") {
-			e = s.parseAuthorizedKeysFile(line)
-		} else if s.sshdPort == 0 && (strings.HasPrefix(line, "Port") || strings.HasPrefix(line, "ListenAddress")) {
-			e = s.parseSSHDPort(line)
-		} else {
-			continue
+		if strings.HasPrefix(line, "Include ") {
+			s.parseSSHDConfigInclude(line, depth, state)
+		} else if strings.HasPrefix(line, "Match ") {
+			state.match, e = parseSSHDMatch(line)
+		} else if strings.HasPrefix(line, "AuthorizedKeysFile ") {
+			e = s.parseAuthorizedKeysFile(line, state)
+		} else if state.match == nil && strings.HasPrefix(line, "AuthorizedKeysCommand ") {
+			e = s.parseAuthorizedKeysCommand(line)
+		} else if state.match == nil && (strings.HasPrefix(line, "Port") || strings.HasPrefix(line, "ListenAddress")) {
+			// Port and ListenAddress are not allowed in Match blocks
+			e = parseSSHDPort(line, state)
 		}
-		if e == nil {
-			jobDoneCnt++
-		} else {
-			errsEncountered = append(errsEncountered, e)
+		if e != nil {
+			state.errs = append(state.errs, e)
+		}
+	}
+}
+
+func (s *SSHManager) parseSSHDConfigInclude(line string, depth int, state *sshdConfigParseState) {
+	if depth >= maxSSHDConfigIncludeDepth {
+		state.errs = append(state.errs, fmt.Errorf("%w: too many nested Include", ErrSSHDConfigParseFailed))
+		return
+	}
+	for _, pattern := range strings.Split(line, " ")[1:] {
+		if pattern == "" {
+			continue
 		}
-		if jobDoneCnt == 2 {
+		if pattern == "#" {
 			break
 		}
+		if !filepath.IsAbs(pattern) {
+			// like sshd, relative paths are relative to /etc/ssh, even if the sshd_config is somewhere else
+			pattern = filepath.Join(sshdIncludeBaseDir, pattern)
+		}
+		files, err := s.sysMgr.Glob(pattern)
+		if err != nil {
+			state.errs = append(state.errs, fmt.Errorf("%w: invalid Include %s: %v", ErrSSHDConfigParseFailed, pattern, err))
+			continue
+		}
+		s.sshdIncludePatterns = append(s.sshdIncludePatterns, pattern)
+		for _, file := range files {
+			content, err := s.sysMgr.ReadFile(file)
+			if err != nil {
+				state.errs = append(state.errs, fmt.Errorf("%w: failed to read included file %s: %v", ErrSSHDConfigUnreadable, file, err))
+				continue
+			}
+			s.sshdIncludedFiles = append(s.sshdIncludedFiles, file)
+			// like sshd, a Match block does not extend past the end of the file it is in
+			match := state.match
+			s.parseSSHDConfigContent(content, depth+1, state)
+			state.match = match
+		}
 	}
-	if len(errsEncountered) != 0 {
-		log.Error("errors encountered while parsing sshd_config: %v", errsEncountered)
-	}
-	return nil
 }
 
-func (s *SSHManager) parseAuthorizedKeysFile(line string) error {
+// parseAuthorizedKeysFile parses the AuthorizedKeysFile config. The first config found wins, either globally or
+// within a Match block, in which case it overrides the global one for the users matching the block.
+// When multiple patterns are listed, DOTTY keys are written to the primary one, see primaryAuthorizedKeysFilePattern
+func (s *SSHManager) parseAuthorizedKeysFile(line string, state *sshdConfigParseState) error {
 	keyFiles := strings.Split(line, " ")
 	if len(keyFiles) < 2 {
-		return fmt.Errorf("%w: invalid format of AuthorizedKeysFile", ErrSSHDConfigParseFailed)
+		return fmt.Errorf("%w: invalid format of AuthorizedKeysFile", ErrAuthorizedKeysFileMalformed)
 	}
+	var patterns []string
 	for i := 1; i != len(keyFiles); i++ {
 		keyFile := keyFiles[i]
 		if keyFile == "" {
@@ -349,56 +974,131 @@ func (s *SSHManager) parseAuthorizedKeysFile(line string) error {
 		if keyFile == "#" {
 			break
 		}
-		if keyFile[0] != '/' {
+		if keyFile == "none" {
+			if len(patterns) != 0 {
+				continue
+			}
+			if state.match == nil && !state.authorizedKeysFileFound {
+				state.authorizedKeysFileFound = true
+				state.authorizedKeysFileNone = true
+			}
+			return nil
+		}
+		if keyFile[0] != '/' && !strings.HasPrefix(keyFile, "%h/") {
 			keyFile = "%h/" + keyFile
 		}
-		s.authorizedKeysFilePattern = keyFile
+		patterns = append(patterns, keyFile)
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("%w: failed to parse AuthorizedKeysFile", ErrAuthorizedKeysFileMalformed)
+	}
+	primary, secondaries := primaryAuthorizedKeysFilePattern(patterns)
+	if state.match != nil {
+		if state.match.authorizedKeysFilePattern == "" {
+			state.match.authorizedKeysFilePattern = primary
+			state.match.authorizedKeysFileSecondaryPatterns = secondaries
+			s.authorizedKeysFileMatches = append(s.authorizedKeysFileMatches, state.match)
+		}
+	} else if !state.authorizedKeysFileFound {
+		s.authorizedKeysFilePattern = primary
+		s.authorizedKeysFileSecondaryPatterns = secondaries
+		state.authorizedKeysFileFound = true
+	}
+	return nil
+}
+
+// primaryAuthorizedKeysFilePattern picks the pattern DOTTY keys are written to, out of the ones listed by
+// AuthorizedKeysFile. The first pattern within the home directory of the user is preferred, since files elsewhere
+// (e.g. /etc/ssh/authorized_keys/%u) are usually centrally managed, otherwise the first pattern is used.
+// The other patterns are returned in order.
+func primaryAuthorizedKeysFilePattern(patterns []string) (string, []string) {
+	primary := 0
+	for i, p := range patterns {
+		if strings.HasPrefix(p, "%h/") {
+			primary = i
+			break
+		}
+	}
+	secondaries := make([]string, 0, len(patterns)-1)
+	secondaries = append(secondaries, patterns[:primary]...)
+	secondaries = append(secondaries, patterns[primary+1:]...)
+	if len(secondaries) == 0 {
+		return patterns[primary], nil
+	}
+	return patterns[primary], secondaries
+}
+
+// parseAuthorizedKeysCommand parses the AuthorizedKeysCommand config, the first one found wins
+func (s *SSHManager) parseAuthorizedKeysCommand(line string) error {
+	if s.authorizedKeysCommand != "" {
 		return nil
 	}
-	return fmt.Errorf("%w: failed to parse AuthorizedKeysFile", ErrSSHDConfigParseFailed)
+	cmd := strings.TrimSpace(strings.SplitN(strings.TrimPrefix(line, "AuthorizedKeysCommand "), " #", 2)[0])
+	if cmd == "" {
+		return fmt.Errorf("%w: invalid format of AuthorizedKeysCommand", ErrSSHDConfigParseFailed)
+	}
+	if cmd != "none" {
+		s.authorizedKeysCommand = cmd
+	}
+	return nil
 }
 
-func (s *SSHManager) parseSSHDPort(line string) error {
+func parseSSHDPort(line string, state *sshdConfigParseState) error {
 	items := strings.Split(line, " ")
 	if len(items) < 2 {
-		return fmt.Errorf("%w: invalid configuration when parsing sshd port", ErrSSHDConfigParseFailed)
+		return fmt.Errorf("%w: invalid configuration when parsing sshd port", ErrSSHDPortMalformed)
 	}
-	cfg := ""
+	args := make([]string, 0, len(items)-1)
 	for i := 1; i != len(items); i++ {
-		if items[i] == "#" {
+		if strings.HasPrefix(items[i], "#") {
 			break
 		}
 		if items[i] != "" {
-			cfg = items[i]
-			break
+			args = append(args, items[i])
 		}
 	}
-	if cfg == "" {
-		return fmt.Errorf("%w: failed to find configuration for %v", ErrSSHDConfigParseFailed, items[0])
+	if len(args) == 0 {
+		return fmt.Errorf("%w: failed to find configuration for %v", ErrSSHDPortMalformed, items[0])
 	}
+	cfg := args[0]
 	switch items[0] {
 	case "Port":
 		portTmp, err := strconv.Atoi(cfg)
 		if err != nil {
-			return fmt.Errorf("%w: invalid Port:%v", ErrSSHDConfigParseFailed, err)
+			return fmt.Errorf("%w: invalid Port:%v", ErrSSHDPortMalformed, err)
 		}
-		s.sshdPort = portTmp
+		state.ports = append(state.ports, portTmp)
 	case "ListenAddress":
-		_, port, err := net.SplitHostPort(cfg)
-		if err != nil {
+		port, ok := listenAddressPort(args)
+		if !ok {
 			// failed to fetch the port from the config due to either missing port number or an invalid config,
 			// but either case, we skip parsing this line
 			break
 		}
 		portTmp, err := strconv.Atoi(port)
 		if err != nil {
-			return fmt.Errorf("%w: invalid Port in address:%v", ErrSSHDConfigParseFailed, err)
+			return fmt.Errorf("%w: invalid Port in address:%v", ErrSSHDPortMalformed, err)
 		}
-		s.sshdPort = portTmp
+		state.ports = append(state.ports, portTmp)
 	}
 	return nil
 }
 
+// listenAddressPort returns the port of a ListenAddress entry, given its arguments. Besides the documented
+// `host:port` and `[ipv6]:port` forms, the port may also follow the address, separated by a space, e.g. `::1 1234`.
+// Unbracketed IPv6 addresses, such as `fe80::1%eth0`, cannot carry a port in the first form.
+func listenAddressPort(args []string) (string, bool) {
+	if _, port, err := net.SplitHostPort(args[0]); err == nil {
+		return port, true
+	}
+	if len(args) > 1 {
+		if _, err := strconv.Atoi(args[1]); err == nil {
+			return args[1], true
+		}
+	}
+	return "", false
+}
+
 func validPort(port int) bool {
 	return port > 0 && port <= 65535
 }
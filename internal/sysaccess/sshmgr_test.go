@@ -4,7 +4,11 @@ package sysaccess
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +17,7 @@ import (
 	"github.com/digitalocean/droplet-agent/internal/sysutil"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/mock/gomock"
 )
 
@@ -82,11 +87,11 @@ func TestSSHManager_parseSSHDConfig(t *testing.T) {
 			nil,
 		},
 		{
-			"should only fetch the first pattern",
+			"should prefer the pattern within the home directory",
 			nil,
 			"AuthorizedKeysFile /etc/ssh/sshd.conf/%u %h/second/ssh/keys",
 			nil,
-			"/etc/ssh/sshd.conf/%u",
+			"%h/second/ssh/keys",
 			defaultSSHDPort,
 			nil,
 		},
@@ -182,6 +187,60 @@ func TestSSHManager_parseSSHDConfig(t *testing.T) {
 			defaultSSHDPort,
 			nil,
 		},
+		{
+			"should support parsing port separated from the ListenAddress ipv6 address by a space",
+			nil,
+			"ListenAddress ::1 1234",
+			nil,
+			defaultAuthorizedKeysFile,
+			1234,
+			nil,
+		},
+		{
+			"should support parsing port separated from the ListenAddress bracketed ipv6 address by a space",
+			nil,
+			"ListenAddress [::1] 2222",
+			nil,
+			defaultAuthorizedKeysFile,
+			2222,
+			nil,
+		},
+		{
+			"should support parsing port separated from the ListenAddress ipv4 address by a space",
+			nil,
+			"ListenAddress 0.0.0.0 2222 # comment",
+			nil,
+			defaultAuthorizedKeysFile,
+			2222,
+			nil,
+		},
+		{
+			"should skip if ListenAddress unbracketed ipv6 with zone does not contain a port",
+			nil,
+			"ListenAddress fe80::1%eth0",
+			nil,
+			defaultAuthorizedKeysFile,
+			defaultSSHDPort,
+			nil,
+		},
+		{
+			"should support parsing port from ListenAddress with a routing domain",
+			nil,
+			"ListenAddress 0.0.0.0:1030 rdomain 5",
+			nil,
+			defaultAuthorizedKeysFile,
+			1030,
+			nil,
+		},
+		{
+			"should skip if ListenAddress with a routing domain does not contain a port",
+			nil,
+			"ListenAddress 192.168.0.1 rdomain 5",
+			nil,
+			defaultAuthorizedKeysFile,
+			defaultSSHDPort,
+			nil,
+		},
 		{
 			"take the first occurrence if multiple ListenAddress presented",
 			nil,
@@ -209,6 +268,77 @@ func TestSSHManager_parseSSHDConfig(t *testing.T) {
 			114,
 			nil,
 		},
+		{
+			"should parse the port from included files",
+			func(s *SSHManager) {
+				sysMgr := s.sysMgr.(*mocks.MocksysManager)
+				sysMgr.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{
+					"/etc/ssh/sshd_config.d/10-auth.conf",
+					"/etc/ssh/sshd_config.d/50-port.conf",
+				}, nil)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/sshd_config.d/10-auth.conf").Return([]byte("PasswordAuthentication no"), nil)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-port.conf").Return([]byte("Port 114\nPort 1030"), nil)
+			},
+			"Include /etc/ssh/sshd_config.d/*.conf\nPort 215\nAuthorizedKeysFile /etc/ssh/sshd.conf/%u",
+			nil,
+			"/etc/ssh/sshd.conf/%u",
+			114,
+			nil,
+		},
+		{
+			"should resolve relative Include paths against /etc/ssh",
+			func(s *SSHManager) {
+				sysMgr := s.sysMgr.(*mocks.MocksysManager)
+				sysMgr.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{"/etc/ssh/sshd_config.d/50-port.conf"}, nil)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-port.conf").Return([]byte("Port 114"), nil)
+			},
+			"Include sshd_config.d/*.conf # drop-in files",
+			nil,
+			defaultAuthorizedKeysFile,
+			114,
+			nil,
+		},
+		{
+			"should follow nested Include",
+			func(s *SSHManager) {
+				sysMgr := s.sysMgr.(*mocks.MocksysManager)
+				sysMgr.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{"/etc/ssh/sshd_config.d/50-nested.conf"}, nil)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-nested.conf").Return([]byte("Include /etc/ssh/nested/*.conf"), nil)
+				sysMgr.EXPECT().Glob("/etc/ssh/nested/*.conf").Return([]string{"/etc/ssh/nested/port.conf"}, nil)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/nested/port.conf").Return([]byte("ListenAddress 0.0.0.0:1030"), nil)
+			},
+			"Include /etc/ssh/sshd_config.d/*.conf",
+			nil,
+			defaultAuthorizedKeysFile,
+			1030,
+			nil,
+		},
+		{
+			"should stop following Include if nested too deep",
+			func(s *SSHManager) {
+				sysMgr := s.sysMgr.(*mocks.MocksysManager)
+				sysMgr.EXPECT().Glob("/etc/ssh/loop.conf").Return([]string{"/etc/ssh/loop.conf"}, nil).Times(maxSSHDConfigIncludeDepth)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/loop.conf").Return([]byte("Include /etc/ssh/loop.conf"), nil).Times(maxSSHDConfigIncludeDepth)
+			},
+			"Include /etc/ssh/loop.conf\nPort 114",
+			nil,
+			defaultAuthorizedKeysFile,
+			114,
+			nil,
+		},
+		{
+			"should skip included files that cannot be read",
+			func(s *SSHManager) {
+				sysMgr := s.sysMgr.(*mocks.MocksysManager)
+				sysMgr.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{"/etc/ssh/sshd_config.d/50-port.conf"}, nil)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-port.conf").Return(nil, errors.New("read-err"))
+			},
+			"Include /etc/ssh/sshd_config.d/*.conf\nPort 114",
+			nil,
+			defaultAuthorizedKeysFile,
+			114,
+			nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -237,199 +367,590 @@ func TestSSHManager_parseSSHDConfig(t *testing.T) {
 	}
 }
 
-func TestSSHManager_UpdateKeys(t *testing.T) {
+func TestSSHManager_SSHDConfigErrors(t *testing.T) {
 	log.Mute()
-	timeNow := time.Now()
-	username1 := "user1"
-	key1 := &SSHKey{
-		OSUser:    username1,
-		PublicKey: "public-key-1",
-		TTL:       123,
-	}
-	key11 := &SSHKey{
-		OSUser:    username1,
-		PublicKey: "public-key-11",
-		TTL:       123,
-	}
-	username2 := "user2"
-	key21 := &SSHKey{
-		OSUser:    username2,
-		PublicKey: "public-key-21",
-		TTL:       123,
-		expireAt:  timeNow.Add(time.Minute),
-	}
-	key21newExp := &SSHKey{
-		OSUser:    username2,
-		PublicKey: "public-key-21",
-		TTL:       123,
-		expireAt:  timeNow.Add(2 * time.Minute),
-	}
-
-	key22 := &SSHKey{
-		OSUser:    username2,
-		PublicKey: "public-key-22",
-		TTL:       123,
-	}
-	username3 := "user3"
-	key31 := &SSHKey{
-		OSUser:    username3,
-		PublicKey: "public-key-31",
-		Type:      SSHKeyTypeDroplet,
-	}
-
-	invalidKeyErr := errors.New("invalid-key")
-	failedUpdateErr := errors.New("failed-update")
-
 	tests := []struct {
 		name           string
-		prepare        func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater)
-		keys           []*SSHKey
-		wantErr        error
-		wantCachedKeys map[string][]*SSHKey
+		prepare        func(sysMgr *mocks.MocksysManager)
+		sshdCfg        string
+		sshdCfgReadErr error
+		wantParseErr   error
+		wantErrs       []error
 	}{
 		{
-			"should return error if keys is nil",
-			nil,
+			"should fail if sshd_config cannot be read",
 			nil,
-			ErrInvalidArgs,
+			"",
+			errors.New("read-err"),
+			ErrSSHDConfigUnreadable,
 			nil,
 		},
 		{
-			"should attempt to clear the keys if  ALL of the keys are invalid",
-			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
-				oldCachedKeys := map[string][]*SSHKey{
-					username1: {key11},
-					username2: {key22},
-				}
-				sshMgr.cachedKeys = oldCachedKeys
-				sshHpr.EXPECT().validateKey(key1).Return(invalidKeyErr)
-				sshHpr.EXPECT().validateKey(key11).Return(invalidKeyErr)
-				sshHpr.EXPECT().validateKey(key21).Return(invalidKeyErr)
-
-				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).Return(oldCachedKeys)
-
-				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{}).Return(nil)
-				updater.EXPECT().updateAuthorizedKeysFile(username2, []*SSHKey{}).Return(nil)
+			"should report included files that cannot be read",
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{"/etc/ssh/sshd_config.d/50-port.conf"}, nil)
+				sysMgr.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-port.conf").Return(nil, errors.New("read-err"))
 			},
-			[]*SSHKey{key1, key11, key21},
+			"Include /etc/ssh/sshd_config.d/*.conf",
 			nil,
-			map[string][]*SSHKey{},
+			nil,
+			[]error{ErrSSHDConfigUnreadable},
 		},
 		{
-			"should continue processing when SOME of the keys are invalid",
-			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
-				sshHpr.EXPECT().validateKey(key1).Return(invalidKeyErr)
-				sshHpr.EXPECT().validateKey(key11).Return(nil)
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key11}, nil).
-					Return(false)
-
-				sshHpr.EXPECT().removeExpiredKeys(nil).Return(nil)
-
-				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{key11}).Return(nil)
-				sshHpr.EXPECT().validateKey(key21).Return(invalidKeyErr)
-			},
-			[]*SSHKey{key1, key11, key21},
+			"should report malformed Port",
 			nil,
-			map[string][]*SSHKey{username1: {key11}},
+			"Port abc",
+			nil,
+			nil,
+			[]error{ErrSSHDPortMalformed},
 		},
 		{
-			"should group the keys by user and do not update keys for a user if unchanged",
-			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
-				oldCachedKeys := map[string][]*SSHKey{
-					username1: {key1},
-					username2: {key21, key22},
-				}
-				sshMgr.cachedKeys = oldCachedKeys
-				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil).Times(3)
-				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).Return(oldCachedKeys)
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key11}, sshMgr.cachedKeys[username1]).
-					Return(false)
-				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{key11}).Return(nil)
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key21newExp, key22}, sshMgr.cachedKeys[username2]).
-					Return(true)
-			},
-			[]*SSHKey{key11, key21newExp, key22},
+			"should report malformed ListenAddress",
 			nil,
-			map[string][]*SSHKey{
-				username1: {key11},
-				username2: {key21, key22},
-			},
+			"ListenAddress 0.0.0.0:abc",
+			nil,
+			nil,
+			[]error{ErrSSHDPortMalformed},
 		},
 		{
-			"should not cache keys for a user if failed to update key",
-			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
-				oldCachedKeys := map[string][]*SSHKey{
-					username1: {key1},
-				}
-				sshMgr.cachedKeys = oldCachedKeys
-				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil)
-				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).Return(oldCachedKeys)
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key11}, sshMgr.cachedKeys[username1]).
-					Return(false)
-				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{key11}).Return(failedUpdateErr)
-			},
-			[]*SSHKey{key11},
-			failedUpdateErr,
-			map[string][]*SSHKey{},
+			"should report malformed AuthorizedKeysFile",
+			nil,
+			"AuthorizedKeysFile # none",
+			nil,
+			nil,
+			[]error{ErrAuthorizedKeysFileMalformed},
 		},
 		{
-			"should work if metadata returned keys for a new user",
-			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
-				oldCachedKeys := map[string][]*SSHKey{
-					username1: {key1},
-				}
-				sshMgr.cachedKeys = oldCachedKeys
-				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil).Times(3)
-				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).Return(oldCachedKeys)
-
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key1}, sshMgr.cachedKeys[username1]).
-					Return(true)
-
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key21, key22}, nil).
-					Return(false)
-				updater.EXPECT().updateAuthorizedKeysFile(username2, []*SSHKey{key21, key22}).Return(nil)
-			},
-			[]*SSHKey{key1, key21, key22},
+			"should aggregate all the errors",
 			nil,
-			map[string][]*SSHKey{
-				username1: {key1},
-				username2: {key21, key22},
-			},
+			"Port abc\nAuthorizedKeysFile #",
+			nil,
+			nil,
+			[]error{ErrSSHDPortMalformed, ErrAuthorizedKeysFileMalformed},
 		},
 		{
-			"should work if metadata removed keys for an existing user",
-			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
-				oldCachedKeys := map[string][]*SSHKey{
-					username1: {key1},
-					username2: {key21, key22},
-				}
-				sshMgr.cachedKeys = oldCachedKeys
-				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil)
-				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).Return(oldCachedKeys)
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key1}, []*SSHKey{key1}).
-					Return(true)
-
-				updater.EXPECT().updateAuthorizedKeysFile(username2, []*SSHKey{}).Return(nil)
-			},
-			[]*SSHKey{key1},
+			"should return nil if sshd_config is valid",
+			nil,
+			"Port 22\nAuthorizedKeysFile .ssh/authorized_keys",
+			nil,
+			nil,
 			nil,
-			map[string][]*SSHKey{
-				username1: {key1},
-			},
 		},
-		{
-			"should proceed if encountered user not found error when removing keys for an user",
-			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
-				oldCachedKeys := map[string][]*SSHKey{
-					username1: {key1},
-					username2: {key21, key22},
-					username3: {key31},
-				}
-				sshMgr.cachedKeys = oldCachedKeys
-				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil)
-				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).Return(oldCachedKeys)
-				sshHpr.EXPECT().areSameKeys([]*SSHKey{key1}, []*SSHKey{key1}).
-					Return(true)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().ReadFile(gomock.Any()).Return([]byte(tt.sshdCfg), tt.sshdCfgReadErr)
+			if tt.prepare != nil {
+				tt.prepare(sysMgrMock)
+			}
+			s := &SSHManager{sysMgr: sysMgrMock}
+			s.sshHelper = &sshHelperImpl{mgr: s}
+
+			err := s.parseSSHDConfig()
+			if !errors.Is(err, tt.wantParseErr) {
+				t.Fatalf("parseSSHDConfig() error = %v, want %v", err, tt.wantParseErr)
+			}
+			if err != nil && !errors.Is(err, ErrSSHDConfigParseFailed) {
+				t.Errorf("parseSSHDConfig() error = %v, should also be %v", err, ErrSSHDConfigParseFailed)
+			}
+			got := s.SSHDConfigErrors()
+			if len(tt.wantErrs) == 0 {
+				if got != nil {
+					t.Errorf("SSHDConfigErrors() = %v, want nil", got)
+				}
+				return
+			}
+			var aggregated SSHDConfigErrors
+			if !errors.As(got, &aggregated) || len(aggregated) != len(tt.wantErrs) {
+				t.Fatalf("SSHDConfigErrors() = %v, want %d errors", got, len(tt.wantErrs))
+			}
+			for i, want := range tt.wantErrs {
+				if !errors.Is(aggregated[i], want) || !errors.Is(aggregated[i], ErrSSHDConfigParseFailed) {
+					t.Errorf("SSHDConfigErrors()[%d] = %v, want %v", i, aggregated[i], want)
+				}
+				if !errors.Is(got, want) {
+					t.Errorf("SSHDConfigErrors() = %v, should match %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSSHManager_parseSSHDConfig_includedFiles(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config").Return([]byte("Include sshd_config.d/*.conf"), nil)
+	sysMgrMock.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{
+		"/etc/ssh/sshd_config.d/10-auth.conf",
+		"/etc/ssh/sshd_config.d/50-port.conf",
+		"/etc/ssh/sshd_config.d/60-unreadable.conf",
+	}, nil)
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config.d/10-auth.conf").Return([]byte("PasswordAuthentication no"), nil)
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-port.conf").Return([]byte("Port 114"), nil)
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config.d/60-unreadable.conf").Return(nil, errors.New("read-err"))
+	s := &SSHManager{
+		sysMgr: sysMgrMock,
+	}
+	s.sshHelper = &sshHelperImpl{mgr: s}
+
+	if err := s.parseSSHDConfig(); err != nil {
+		t.Fatalf("parseSSHDConfig() unexpected error: %v", err)
+	}
+	want := []string{"/etc/ssh/sshd_config.d/10-auth.conf", "/etc/ssh/sshd_config.d/50-port.conf"}
+	if !reflect.DeepEqual(s.sshdIncludedFiles, want) {
+		t.Errorf("parseSSHDConfig() included files got = %v, want %v", s.sshdIncludedFiles, want)
+	}
+}
+
+func TestSSHManager_parseSSHDConfig_customConfigRelativeInclude(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+	sshdCfgFile := "/opt/sshd/sshd_config"
+	sysMgrMock.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Include sshd_config.d/*.conf"), nil)
+	// like sshd, the relative path is resolved against /etc/ssh, not against the directory of the config file
+	sysMgrMock.EXPECT().Glob("/etc/ssh/sshd_config.d/*.conf").Return([]string{"/etc/ssh/sshd_config.d/50-port.conf"}, nil)
+	sysMgrMock.EXPECT().ReadFile("/etc/ssh/sshd_config.d/50-port.conf").Return([]byte("Port 114"), nil)
+	s := &SSHManager{
+		sysMgr: sysMgrMock,
+	}
+	s.sshHelper = &sshHelperImpl{mgr: s, customSSHDCfgFile: sshdCfgFile}
+
+	if err := s.parseSSHDConfig(); err != nil {
+		t.Fatalf("parseSSHDConfig() unexpected error: %v", err)
+	}
+	if s.sshdPort != 114 {
+		t.Errorf("parseSSHDConfig() sshd port got = %d, want 114", s.sshdPort)
+	}
+	want := []string{"/etc/ssh/sshd_config.d/*.conf"}
+	if !reflect.DeepEqual(s.sshdIncludePatterns, want) {
+		t.Errorf("parseSSHDConfig() include patterns got = %v, want %v", s.sshdIncludePatterns, want)
+	}
+}
+
+func TestSSHManager_parseSSHDConfig_authorizedKeysCommand(t *testing.T) {
+	log.Mute()
+	tests := []struct {
+		name                   string
+		sshdCfg                string
+		wantCommand            string
+		wantKeysFileUnused     bool
+		wantAuthorizedKeysFile string
+	}{
+		{
+			"should mark the authorized_keys file unused if sshd only reads keys through the command",
+			"AuthorizedKeysFile none\nAuthorizedKeysCommand /usr/bin/fetch-keys %u # central keys\nAuthorizedKeysCommandUser nobody",
+			"/usr/bin/fetch-keys %u",
+			true,
+			defaultAuthorizedKeysFile,
+		},
+		{
+			"should keep using the authorized_keys file if set along with the command",
+			"AuthorizedKeysFile .ssh/authorized_keys\nAuthorizedKeysCommand /usr/bin/fetch-keys\nAuthorizedKeysCommandUser nobody",
+			"/usr/bin/fetch-keys",
+			false,
+			"%h/.ssh/authorized_keys",
+		},
+		{
+			"should keep using the default authorized_keys file if not set along with the command",
+			"AuthorizedKeysCommand /usr/bin/fetch-keys",
+			"/usr/bin/fetch-keys",
+			false,
+			defaultAuthorizedKeysFile,
+		},
+		{
+			"should ignore the command set to none",
+			"AuthorizedKeysFile none\nAuthorizedKeysCommand none",
+			"",
+			false,
+			defaultAuthorizedKeysFile,
+		},
+		{
+			"should ignore the command set within Match blocks",
+			"AuthorizedKeysFile none\nMatch User git\n\tAuthorizedKeysCommand /usr/bin/fetch-keys",
+			"",
+			false,
+			defaultAuthorizedKeysFile,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().ReadFile(gomock.Any()).Return([]byte(tt.sshdCfg), nil)
+			s := &SSHManager{
+				sysMgr: sysMgrMock,
+			}
+			s.sshHelper = &sshHelperImpl{mgr: s}
+
+			if err := s.parseSSHDConfig(); err != nil {
+				t.Fatalf("parseSSHDConfig() unexpected error: %v", err)
+			}
+			if s.authorizedKeysCommand != tt.wantCommand {
+				t.Errorf("parseSSHDConfig() AuthorizedKeysCommand got = [%v], want [%v]", s.authorizedKeysCommand, tt.wantCommand)
+			}
+			if s.authorizedKeysFileUnused != tt.wantKeysFileUnused {
+				t.Errorf("parseSSHDConfig() authorizedKeysFileUnused got = %v, want %v", s.authorizedKeysFileUnused, tt.wantKeysFileUnused)
+			}
+			if s.authorizedKeysFilePattern != tt.wantAuthorizedKeysFile {
+				t.Errorf("parseSSHDConfig() AuthorizedKeysFile got = [%v], want [%v]", s.authorizedKeysFilePattern, tt.wantAuthorizedKeysFile)
+			}
+		})
+	}
+}
+
+func TestSSHManager_parseSSHDConfig_multiplePatterns(t *testing.T) {
+	log.Mute()
+	tests := []struct {
+		name                 string
+		sshdCfg              string
+		wantPrimary          string
+		wantSecondaries      []string
+		wantMatchPrimary     string
+		wantMatchSecondaries []string
+	}{
+		{
+			"should write to the pattern within the home directory and read the others",
+			"AuthorizedKeysFile /etc/ssh/authorized_keys/%u .ssh/authorized_keys .ssh/authorized_keys2",
+			"%h/.ssh/authorized_keys",
+			[]string{"/etc/ssh/authorized_keys/%u", "%h/.ssh/authorized_keys2"},
+			"",
+			nil,
+		},
+		{
+			"should read the legacy authorized_keys2 file listed after authorized_keys",
+			"AuthorizedKeysFile .ssh/authorized_keys .ssh/authorized_keys2",
+			"%h/.ssh/authorized_keys",
+			[]string{"%h/.ssh/authorized_keys2"},
+			"",
+			nil,
+		},
+		{
+			"should write to the first pattern if none is within the home directory",
+			"AuthorizedKeysFile /etc/ssh/keys/%u /etc/ssh/central_keys # shared",
+			"/etc/ssh/keys/%u",
+			[]string{"/etc/ssh/central_keys"},
+			"",
+			nil,
+		},
+		{
+			"should keep the patterns of Match blocks apart",
+			"AuthorizedKeysFile .ssh/authorized_keys\nMatch User git\n\tAuthorizedKeysFile /etc/ssh/git_keys %h/.ssh/git_keys",
+			"%h/.ssh/authorized_keys",
+			nil,
+			"%h/.ssh/git_keys",
+			[]string{"/etc/ssh/git_keys"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().ReadFile(gomock.Any()).Return([]byte(tt.sshdCfg), nil)
+			s := &SSHManager{
+				sysMgr: sysMgrMock,
+			}
+			s.sshHelper = &sshHelperImpl{mgr: s}
+
+			if err := s.parseSSHDConfig(); err != nil {
+				t.Fatalf("parseSSHDConfig() unexpected error: %v", err)
+			}
+			if s.authorizedKeysFilePattern != tt.wantPrimary {
+				t.Errorf("parseSSHDConfig() AuthorizedKeysFile got = [%v], want [%v]", s.authorizedKeysFilePattern, tt.wantPrimary)
+			}
+			if !reflect.DeepEqual(s.authorizedKeysFileSecondaryPatterns, tt.wantSecondaries) {
+				t.Errorf("parseSSHDConfig() secondary patterns got = %v, want %v", s.authorizedKeysFileSecondaryPatterns, tt.wantSecondaries)
+			}
+			if tt.wantMatchPrimary == "" {
+				if len(s.authorizedKeysFileMatches) != 0 {
+					t.Errorf("parseSSHDConfig() unexpected Match blocks: %v", s.authorizedKeysFileMatches)
+				}
+				return
+			}
+			if len(s.authorizedKeysFileMatches) != 1 {
+				t.Fatalf("parseSSHDConfig() got %d Match blocks, want 1", len(s.authorizedKeysFileMatches))
+			}
+			m := s.authorizedKeysFileMatches[0]
+			if m.authorizedKeysFilePattern != tt.wantMatchPrimary {
+				t.Errorf("parseSSHDConfig() Match AuthorizedKeysFile got = [%v], want [%v]", m.authorizedKeysFilePattern, tt.wantMatchPrimary)
+			}
+			if !reflect.DeepEqual(m.authorizedKeysFileSecondaryPatterns, tt.wantMatchSecondaries) {
+				t.Errorf("parseSSHDConfig() Match secondary patterns got = %v, want %v", m.authorizedKeysFileSecondaryPatterns, tt.wantMatchSecondaries)
+			}
+		})
+	}
+}
+
+func TestSSHManager_UpdateKeys_authorizedKeysFileUnused(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	// no calls to the updater are expected
+	updaterMock := NewMockauthorizedKeysFileUpdater(mockCtl)
+	s := &SSHManager{
+		authorizedKeysFileUpdater: updaterMock,
+		authorizedKeysCommand:     "/usr/bin/fetch-keys",
+		authorizedKeysFileUnused:  true,
+		cachedKeys:                map[string][]*SSHKey{},
+	}
+	err := s.UpdateKeys([]*SSHKey{{OSUser: "root", PublicKey: "public-key-1", TTL: 123}})
+	if !errors.Is(err, ErrAuthorizedKeysFileUnused) {
+		t.Errorf("UpdateKeys() error = %v, want %v", err, ErrAuthorizedKeysFileUnused)
+	}
+}
+
+func TestSSHManager_parseSSHDConfig_customPort(t *testing.T) {
+	log.Mute()
+	tests := []struct {
+		name        string
+		customPort  int
+		sshdCfg     string
+		wantWarning bool
+	}{
+		{"should not warn if the custom port is in sshd_config", 2222, "Port 22\nPort 2222", false},
+		{"should not warn if the custom port is in a ListenAddress", 2222, "ListenAddress 0.0.0.0:2222", false},
+		{"should not warn if the custom port is the default one and sshd_config has no port", 22, "PasswordAuthentication no", false},
+		{"should warn if the custom port is not in sshd_config", 2223, "Port 2222", true},
+		{"should warn if the custom port is not the default one and sshd_config has no port", 2222, "PasswordAuthentication no", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sysMgrMock.EXPECT().ReadFile(gomock.Any()).Return([]byte(tt.sshdCfg), nil)
+			warned := false
+			s := &SSHManager{
+				sysMgr:   sysMgrMock,
+				sshdPort: tt.customPort,
+				logWarning: func(_ string, _ ...interface{}) {
+					warned = true
+				},
+			}
+			s.sshHelper = &sshHelperImpl{mgr: s}
+
+			if err := s.parseSSHDConfig(); err != nil {
+				t.Fatalf("parseSSHDConfig() unexpected error: %v", err)
+			}
+			if s.sshdPort != tt.customPort {
+				t.Errorf("parseSSHDConfig() should keep the custom port, got = [%v], want [%v]", s.sshdPort, tt.customPort)
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("parseSSHDConfig() warned = %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestSSHManager_UpdateKeys(t *testing.T) {
+	log.Mute()
+	// removeExpiredKeys returns a new map, like the real helper does, so the cache isn't aliased
+	copyKeys := func(keys map[string][]*SSHKey) map[string][]*SSHKey {
+		ret := make(map[string][]*SSHKey, len(keys))
+		for u, k := range keys {
+			ret[u] = k
+		}
+		return ret
+	}
+	timeNow := time.Now()
+	username1 := "user1"
+	key1 := &SSHKey{
+		OSUser:    username1,
+		PublicKey: "public-key-1",
+		TTL:       123,
+	}
+	key11 := &SSHKey{
+		OSUser:    username1,
+		PublicKey: "public-key-11",
+		TTL:       123,
+	}
+	username2 := "user2"
+	key21 := &SSHKey{
+		OSUser:    username2,
+		PublicKey: "public-key-21",
+		TTL:       123,
+		expireAt:  timeNow.Add(time.Minute),
+	}
+	key21newExp := &SSHKey{
+		OSUser:    username2,
+		PublicKey: "public-key-21",
+		TTL:       123,
+		expireAt:  timeNow.Add(2 * time.Minute),
+	}
+
+	key22 := &SSHKey{
+		OSUser:    username2,
+		PublicKey: "public-key-22",
+		TTL:       123,
+	}
+	username3 := "user3"
+	key31 := &SSHKey{
+		OSUser:    username3,
+		PublicKey: "public-key-31",
+		Type:      SSHKeyTypeDroplet,
+	}
+
+	invalidKeyErr := errors.New("invalid-key")
+	failedUpdateErr := errors.New("failed-update")
+
+	tests := []struct {
+		name           string
+		prepare        func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater)
+		keys           []*SSHKey
+		wantErr        error
+		wantCachedKeys map[string][]*SSHKey
+	}{
+		{
+			"should return error if keys is nil",
+			nil,
+			nil,
+			ErrInvalidArgs,
+			nil,
+		},
+		{
+			"should attempt to clear the keys if  ALL of the keys are invalid",
+			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
+				oldCachedKeys := map[string][]*SSHKey{
+					username1: {key11},
+					username2: {key22},
+				}
+				sshMgr.cachedKeys = oldCachedKeys
+				sshHpr.EXPECT().validateKey(key1).Return(invalidKeyErr)
+				sshHpr.EXPECT().validateKey(key11).Return(invalidKeyErr)
+				sshHpr.EXPECT().validateKey(key21).Return(invalidKeyErr)
+
+				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).DoAndReturn(copyKeys)
+
+				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{}).Return(nil)
+				updater.EXPECT().updateAuthorizedKeysFile(username2, []*SSHKey{}).Return(nil)
+			},
+			[]*SSHKey{key1, key11, key21},
+			nil,
+			map[string][]*SSHKey{},
+		},
+		{
+			"should continue processing when SOME of the keys are invalid",
+			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
+				sshHpr.EXPECT().validateKey(key1).Return(invalidKeyErr)
+				sshHpr.EXPECT().validateKey(key11).Return(nil)
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key11}, nil).
+					Return(false)
+
+				sshHpr.EXPECT().removeExpiredKeys(nil).Return(nil)
+
+				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{key11}).Return(nil)
+				sshHpr.EXPECT().validateKey(key21).Return(invalidKeyErr)
+			},
+			[]*SSHKey{key1, key11, key21},
+			nil,
+			map[string][]*SSHKey{username1: {key11}},
+		},
+		{
+			"should group the keys by user and do not update keys for a user if unchanged",
+			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
+				oldCachedKeys := map[string][]*SSHKey{
+					username1: {key1},
+					username2: {key21, key22},
+				}
+				sshMgr.cachedKeys = oldCachedKeys
+				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil).Times(3)
+				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).DoAndReturn(copyKeys)
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key11}, sshMgr.cachedKeys[username1]).
+					Return(false)
+				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{key11}).Return(nil)
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key21newExp, key22}, sshMgr.cachedKeys[username2]).
+					Return(true)
+			},
+			[]*SSHKey{key11, key21newExp, key22},
+			nil,
+			map[string][]*SSHKey{
+				username1: {key11},
+				username2: {key21, key22},
+			},
+		},
+		{
+			"should not cache keys for a user if failed to update key",
+			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
+				oldCachedKeys := map[string][]*SSHKey{
+					username1: {key1},
+				}
+				sshMgr.cachedKeys = oldCachedKeys
+				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil)
+				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).DoAndReturn(copyKeys)
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key11}, sshMgr.cachedKeys[username1]).
+					Return(false)
+				updater.EXPECT().updateAuthorizedKeysFile(username1, []*SSHKey{key11}).Return(failedUpdateErr)
+			},
+			[]*SSHKey{key11},
+			failedUpdateErr,
+			map[string][]*SSHKey{},
+		},
+		{
+			"should work if metadata returned keys for a new user",
+			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
+				oldCachedKeys := map[string][]*SSHKey{
+					username1: {key1},
+				}
+				sshMgr.cachedKeys = oldCachedKeys
+				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil).Times(3)
+				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).DoAndReturn(copyKeys)
+
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key1}, sshMgr.cachedKeys[username1]).
+					Return(true)
+
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key21, key22}, nil).
+					Return(false)
+				updater.EXPECT().updateAuthorizedKeysFile(username2, []*SSHKey{key21, key22}).Return(nil)
+			},
+			[]*SSHKey{key1, key21, key22},
+			nil,
+			map[string][]*SSHKey{
+				username1: {key1},
+				username2: {key21, key22},
+			},
+		},
+		{
+			"should work if metadata removed keys for an existing user",
+			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
+				oldCachedKeys := map[string][]*SSHKey{
+					username1: {key1},
+					username2: {key21, key22},
+				}
+				sshMgr.cachedKeys = oldCachedKeys
+				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil)
+				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).DoAndReturn(copyKeys)
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key1}, []*SSHKey{key1}).
+					Return(true)
+
+				updater.EXPECT().updateAuthorizedKeysFile(username2, []*SSHKey{}).Return(nil)
+			},
+			[]*SSHKey{key1},
+			nil,
+			map[string][]*SSHKey{
+				username1: {key1},
+			},
+		},
+		{
+			"should proceed if encountered user not found error when removing keys for an user",
+			func(sshMgr *SSHManager, sshHpr *MocksshHelper, updater *MockauthorizedKeysFileUpdater) {
+				oldCachedKeys := map[string][]*SSHKey{
+					username1: {key1},
+					username2: {key21, key22},
+					username3: {key31},
+				}
+				sshMgr.cachedKeys = oldCachedKeys
+				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil)
+				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).DoAndReturn(copyKeys)
+				sshHpr.EXPECT().areSameKeys([]*SSHKey{key1}, []*SSHKey{key1}).
+					Return(true)
 
 				updater.EXPECT().updateAuthorizedKeysFile(username2, []*SSHKey{}).Return(sysutil.ErrUserNotFound)
 				updater.EXPECT().updateAuthorizedKeysFile(username3, []*SSHKey{}).Return(nil)
@@ -450,7 +971,7 @@ func TestSSHManager_UpdateKeys(t *testing.T) {
 				}
 				sshMgr.cachedKeys = oldCachedKeys
 				sshHpr.EXPECT().validateKey(gomock.Any()).Return(nil)
-				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).Return(oldCachedKeys)
+				sshHpr.EXPECT().removeExpiredKeys(oldCachedKeys).DoAndReturn(copyKeys)
 				sshHpr.EXPECT().areSameKeys([]*SSHKey{key1}, []*SSHKey{key1}).
 					Return(true)
 
@@ -533,7 +1054,129 @@ func TestSSHManager_UpdateKeys(t *testing.T) {
 			}
 		})
 	}
-	// TODO: add another test for applying lock, maybe?
+}
+
+// parallelUpdater only completes the update of a user once the updates of all the given users have started
+type parallelUpdater struct {
+	authorizedKeysFileUpdater
+	started map[string]chan struct{}
+}
+
+func (u *parallelUpdater) updateAuthorizedKeysFile(osUsername string, _ []*SSHKey) error {
+	close(u.started[osUsername])
+	for user, started := range u.started {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			return fmt.Errorf("update for %s not started while updating %s", user, osUsername)
+		}
+	}
+	return nil
+}
+
+func TestSSHManager_UpdateKeys_parallelUsers(t *testing.T) {
+	log.Mute()
+	key1 := &SSHKey{OSUser: "user1", PublicKey: "public-key-1", TTL: 123}
+	key2 := &SSHKey{OSUser: "user2", PublicKey: "public-key-2", TTL: 123}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sshHelperMock := NewMocksshHelper(mockCtl)
+	sshHelperMock.EXPECT().validateKey(gomock.Any()).Return(nil).AnyTimes()
+	sshHelperMock.EXPECT().removeExpiredKeys(gomock.Any()).DoAndReturn(func(keys map[string][]*SSHKey) map[string][]*SSHKey {
+		return keys
+	}).AnyTimes()
+	sshHelperMock.EXPECT().areSameKeys(gomock.Any(), gomock.Any()).Return(false).AnyTimes()
+
+	s := &SSHManager{
+		sshHelper: sshHelperMock,
+		authorizedKeysFileUpdater: &parallelUpdater{started: map[string]chan struct{}{
+			"user1": make(chan struct{}),
+			"user2": make(chan struct{}),
+		}},
+	}
+	// neither update can complete if the users are updated one after the other
+	if err := s.UpdateKeys([]*SSHKey{key1, key2}); err != nil {
+		t.Errorf("UpdateKeys() unexpected error = %v", err)
+	}
+
+	want := map[string][]*SSHKey{"user1": {key1}, "user2": {key2}}
+	if !reflect.DeepEqual(s.cachedKeys, want) {
+		t.Errorf("UpdateKeys() got cached keys = %v, want %v", s.cachedKeys, want)
+	}
+}
+
+// recordingUpdater keeps the keys written for each user in memory, taking some time to write them
+type recordingUpdater struct {
+	authorizedKeysFileUpdater
+	lock    sync.Mutex
+	written map[string][]*SSHKey
+}
+
+func (u *recordingUpdater) updateAuthorizedKeysFile(osUsername string, keys []*SSHKey) error {
+	time.Sleep(10 * time.Millisecond)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if len(keys) == 0 {
+		delete(u.written, osUsername)
+	} else {
+		u.written[osUsername] = keys
+	}
+	return nil
+}
+
+func TestSSHManager_UpdateKeys_concurrentCalls(t *testing.T) {
+	log.Mute()
+	olderKeys := []*SSHKey{
+		{OSUser: "user1", PublicKey: "public-key-1", TTL: 123},
+		{OSUser: "user2", PublicKey: "public-key-2", TTL: 123},
+	}
+	newerKeys := []*SSHKey{
+		{OSUser: "user1", PublicKey: "public-key-3", TTL: 123},
+	}
+	wantOlder := map[string][]*SSHKey{"user1": olderKeys[:1], "user2": olderKeys[1:]}
+	wantNewer := map[string][]*SSHKey{"user1": newerKeys}
+
+	for i := 0; i != 10; i++ {
+		mockCtl := gomock.NewController(t)
+		sshHelperMock := NewMocksshHelper(mockCtl)
+		sshHelperMock.EXPECT().validateKey(gomock.Any()).Return(nil).AnyTimes()
+		sshHelperMock.EXPECT().removeExpiredKeys(gomock.Any()).DoAndReturn(func(keys map[string][]*SSHKey) map[string][]*SSHKey {
+			return keys
+		}).AnyTimes()
+		sshHelperMock.EXPECT().areSameKeys(gomock.Any(), gomock.Any()).DoAndReturn(func(a, b []*SSHKey) bool {
+			return reflect.DeepEqual(a, b)
+		}).AnyTimes()
+		updater := &recordingUpdater{written: make(map[string][]*SSHKey)}
+		s := &SSHManager{
+			sshHelper:                 sshHelperMock,
+			authorizedKeysFileUpdater: updater,
+		}
+
+		// two metadata updates handled at the same time, the newer one no longer has keys for user2 and arrives while
+		// the older one is being written
+		wg := sync.WaitGroup{}
+		for _, keys := range [][]*SSHKey{olderKeys, newerKeys} {
+			wg.Add(1)
+			go func(keys []*SSHKey) {
+				defer wg.Done()
+				if err := s.UpdateKeys(keys); err != nil {
+					t.Errorf("UpdateKeys() unexpected error = %v", err)
+				}
+			}(keys)
+			time.Sleep(2 * time.Millisecond)
+		}
+		wg.Wait()
+		mockCtl.Finish()
+
+		// whichever call completes last wins, but the keys of both calls must never be mixed
+		if !reflect.DeepEqual(s.cachedKeys, wantOlder) && !reflect.DeepEqual(s.cachedKeys, wantNewer) {
+			t.Fatalf("UpdateKeys() got cached keys = %v, want either %v or %v", s.cachedKeys, wantOlder, wantNewer)
+		}
+		if !reflect.DeepEqual(updater.written, s.cachedKeys) {
+			t.Fatalf("UpdateKeys() wrote keys = %v, want the cached keys %v", updater.written, s.cachedKeys)
+		}
+	}
 }
 
 func TestSSHManager_RemoveExpiredKeys(t *testing.T) {
@@ -670,13 +1313,13 @@ func TestSSHManager_WatchSSHDConfig(t *testing.T) {
 	watchFileErr := errors.New("failed-to-watch-file")
 	tests := []struct {
 		name    string
-		prepare func(sh *MocksshHelper, w *MockfsWatcher, evChan chan fsnotify.Event, errChan chan error)
+		prepare func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error)
 		trigger func(evChan chan fsnotify.Event, errChan chan error)
 		assert  func(t *testing.T, s *SSHManager, retChan <-chan bool, err error)
 	}{
 		{
 			"should return error if failed to create new fs watcher",
-			func(sh *MocksshHelper, w *MockfsWatcher, evChan chan fsnotify.Event, errChan chan error) {
+			func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
 				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
 				sh.EXPECT().newFSWatcher().Return(nil, nil, nil, newWatcherErr)
 			},
@@ -689,7 +1332,7 @@ func TestSSHManager_WatchSSHDConfig(t *testing.T) {
 		},
 		{
 			"should quit watcher thread and close returned channel if watcher closed",
-			func(sh *MocksshHelper, w *MockfsWatcher, evChan chan fsnotify.Event, errChan chan error) {
+			func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
 				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
 				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
 				w.EXPECT().Add(sshdCfgFile).Return(nil)
@@ -721,7 +1364,7 @@ func TestSSHManager_WatchSSHDConfig(t *testing.T) {
 		},
 		{
 			"should quit watcher thread and close returned channel if watcher error channel closed",
-			func(sh *MocksshHelper, w *MockfsWatcher, evChan chan fsnotify.Event, errChan chan error) {
+			func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
 				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
 				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
 				w.EXPECT().Add(sshdCfgFile).Return(nil)
@@ -742,62 +1385,304 @@ func TestSSHManager_WatchSSHDConfig(t *testing.T) {
 					}
 				default:
 
-				}
-				if !chanClosed {
-					t.Errorf("WatchSSHDConfig() did not close the returned channel")
-				}
-				if s.fsWatcher == nil {
-					t.Errorf("WatchSSHDConfig() did not properly save the fsWatcher to SSHManager object")
-				}
+				}
+				if !chanClosed {
+					t.Errorf("WatchSSHDConfig() did not close the returned channel")
+				}
+				if s.fsWatcher == nil {
+					t.Errorf("WatchSSHDConfig() did not properly save the fsWatcher to SSHManager object")
+				}
+			},
+		},
+		{
+			"should fall back to polling if failed to monitor sshd_config",
+			func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
+				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
+				w.EXPECT().Add(sshdCfgFile).Return(watchFileErr)
+				w.EXPECT().Close().Return(nil)
+				gomock.InOrder(
+					sysMgr.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Port 22"), nil),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
+					sysMgr.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Port 22"), nil),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
+					sysMgr.EXPECT().ReadFile(sshdCfgFile).Return(nil, errors.New("read-err")),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
+					sysMgr.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Port 1030"), nil),
+				)
+			},
+			func(evChan chan fsnotify.Event, errChan chan error) {},
+			func(t *testing.T, s *SSHManager, retChan <-chan bool, err error) {
+				if err != nil {
+					t.Errorf("WatchSSHDConfig() unexpected error: %v", err)
+					return
+				}
+				if s.fsWatcher != nil {
+					t.Errorf("WatchSSHDConfig() should not keep the failed fs watcher")
+				}
+				if r, ok := <-retChan; !ok || !r {
+					t.Errorf("WatchSSHDConfig() sshd_config modification not notified by the poller")
+				}
+				if _, ok := <-retChan; ok {
+					t.Errorf("WatchSSHDConfig() did not close the returned channel")
+				}
+			},
+		},
+		{
+			"return notify via the returned channel if sshd_config modified",
+			func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
+				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
+				w.EXPECT().Add(sshdCfgFile).Return(nil)
+
+				sh.EXPECT().sshdCfgModified(w, sshdCfgFile, &fsnotify.Event{
+					Name: sshdCfgFile,
+					Op:   fsnotify.Write,
+				}).Return(true).AnyTimes()
+			},
+			func(evChan chan fsnotify.Event, errChan chan error) {
+				evChan <- fsnotify.Event{
+					Name: sshdCfgFile,
+					Op:   fsnotify.Write,
+				}
+				close(evChan)
+			},
+			func(t *testing.T, s *SSHManager, retChan <-chan bool, err error) {
+				if err != nil {
+					t.Errorf("WatchSSHDConfig() unexpected error: %v", err)
+				}
+				select {
+				case r := <-retChan:
+					if r != true {
+						t.Errorf("WatchSSHDConfig() unexpected result")
+					}
+				default:
+					t.Errorf("WatchSSHDConfig() sshd_config modification not notified")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sshHelperMock := NewMocksshHelper(mockCtl)
+			fsWatcherMock := NewMockfsWatcher(mockCtl)
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			evChan := make(chan fsnotify.Event)
+			errChan := make(chan error)
+
+			if tt.prepare != nil {
+				tt.prepare(sshHelperMock, fsWatcherMock, sysMgrMock, evChan, errChan)
+			}
+
+			waitWatcherThread := make(chan bool)
+			s := &SSHManager{
+				sshHelper: sshHelperMock,
+				sysMgr:    sysMgrMock,
+				fsWatcherQuitHook: func() {
+					close(waitWatcherThread)
+				},
+				fsWatcherSetupTimeout: 50 * time.Millisecond,
+			}
+			got, err := s.WatchSSHDConfig()
+			if tt.trigger != nil {
+				go tt.trigger(evChan, errChan)
+			} else {
+				go close(waitWatcherThread)
+			}
+			<-waitWatcherThread
+			tt.assert(t, s, got, err)
+		})
+	}
+}
+
+func TestSSHManager_WatchSSHDConfig_includedFiles(t *testing.T) {
+	log.Mute()
+
+	sshdCfgFile := "/etc/ssh/sshd_config"
+	includedFile := "/etc/ssh/sshd_config.d/50-port.conf"
+	tests := []struct {
+		name       string
+		prepare    func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error)
+		trigger    func(evChan chan fsnotify.Event, errChan chan error)
+		wantNotify bool
+	}{
+		{
+			name: "should notify if an included file is modified",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
+				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
+				w.EXPECT().Add(sshdCfgFile).Return(nil)
+				w.EXPECT().Add(includedFile).Return(nil)
+			},
+			trigger: func(evChan chan fsnotify.Event, errChan chan error) {
+				evChan <- fsnotify.Event{Name: includedFile, Op: fsnotify.Write}
+				close(evChan)
+			},
+			wantNotify: true,
+		},
+		{
+			name: "should notify if an included file is removed",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
+				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
+				w.EXPECT().Add(sshdCfgFile).Return(nil)
+				w.EXPECT().Add(includedFile).Return(nil)
+			},
+			trigger: func(evChan chan fsnotify.Event, errChan chan error) {
+				evChan <- fsnotify.Event{Name: includedFile, Op: fsnotify.Remove}
+				close(evChan)
+			},
+			wantNotify: true,
+		},
+		{
+			name: "should ignore events not modifying the watched files",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
+				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
+				w.EXPECT().Add(sshdCfgFile).Return(nil)
+				w.EXPECT().Add(includedFile).Return(nil)
+			},
+			trigger: func(evChan chan fsnotify.Event, errChan chan error) {
+				evChan <- fsnotify.Event{Name: includedFile, Op: fsnotify.Chmod}
+				evChan <- fsnotify.Event{Name: "/etc/ssh/sshd_config.d/60-other.conf", Op: fsnotify.Write}
+				close(evChan)
+			},
+			wantNotify: false,
+		},
+		{
+			name: "should poll included files if failed to monitor them",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager, evChan chan fsnotify.Event, errChan chan error) {
+				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
+				w.EXPECT().Add(sshdCfgFile).Return(nil)
+				w.EXPECT().Add(includedFile).Return(errors.New("failed-to-watch-file"))
+				w.EXPECT().Close().Return(nil)
+				gomock.InOrder(
+					sysMgr.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Include sshd_config.d/*.conf"), nil),
+					sysMgr.EXPECT().ReadFile(includedFile).Return([]byte("Port 22"), nil),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
+					sysMgr.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Include sshd_config.d/*.conf"), nil),
+					sysMgr.EXPECT().ReadFile(includedFile).Return([]byte("Port 22"), nil),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
+					sysMgr.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Include sshd_config.d/*.conf"), nil),
+					sysMgr.EXPECT().ReadFile(includedFile).Return([]byte("Port 1030"), nil),
+				)
+			},
+			wantNotify: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sshHelperMock := NewMocksshHelper(mockCtl)
+			fsWatcherMock := NewMockfsWatcher(mockCtl)
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			evChan := make(chan fsnotify.Event)
+			errChan := make(chan error)
+
+			tt.prepare(sshHelperMock, fsWatcherMock, sysMgrMock, evChan, errChan)
+
+			s := &SSHManager{
+				sshHelper:             sshHelperMock,
+				sysMgr:                sysMgrMock,
+				sshdIncludedFiles:     []string{includedFile},
+				fsWatcherSetupTimeout: 50 * time.Millisecond,
+			}
+			got, err := s.WatchSSHDConfig()
+			if err != nil {
+				t.Fatalf("WatchSSHDConfig() unexpected error: %v", err)
+			}
+			if tt.trigger != nil {
+				go tt.trigger(evChan, errChan)
+			}
+			notified := false
+			for r := range got {
+				notified = notified || r
+			}
+			if notified != tt.wantNotify {
+				t.Errorf("WatchSSHDConfig() notified = %v, want %v", notified, tt.wantNotify)
+			}
+		})
+	}
+}
+
+func TestSSHManager_WatchSSHDConfig_newIncludedFiles(t *testing.T) {
+	log.Mute()
+
+	sshdCfgFile := "/etc/ssh/sshd_config"
+	includeDir := "/etc/ssh/sshd_config.d"
+	includedFile := "/etc/ssh/sshd_config.d/50-port.conf"
+	newFile := "/etc/ssh/sshd_config.d/99-new.conf"
+	watcherClosed := make(chan struct{})
+	tests := []struct {
+		name          string
+		prepare       func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager)
+		trigger       func(evChan chan fsnotify.Event)
+		wantNotify    bool
+		watcherClosed chan struct{} // closed once the watcher is closed, if it is closed asynchronously
+	}{
+		{
+			name: "should notify if a new file matching the Include is created",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager) {
+				w.EXPECT().Add(includeDir).Return(nil)
+			},
+			trigger: func(evChan chan fsnotify.Event) {
+				evChan <- fsnotify.Event{Name: newFile, Op: fsnotify.Create}
+				close(evChan)
 			},
+			wantNotify: true,
 		},
 		{
-			"return error if failed to monitor sshd_config",
-			func(sh *MocksshHelper, w *MockfsWatcher, evChan chan fsnotify.Event, errChan chan error) {
-				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
-				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
-				w.EXPECT().Add(sshdCfgFile).Return(watchFileErr)
-				w.EXPECT().Close().Return(nil)
+			name: "should ignore new files not matching the Include",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager) {
+				w.EXPECT().Add(includeDir).Return(nil)
 			},
-			nil,
-			func(t *testing.T, s *SSHManager, retChan <-chan bool, err error) {
-				if err == nil || !errors.Is(err, watchFileErr) {
-					t.Errorf("WatchSSHDConfig() unexpected error. want %v, got %v", watchFileErr, err)
-				}
+			trigger: func(evChan chan fsnotify.Event) {
+				evChan <- fsnotify.Event{Name: includeDir + "/README", Op: fsnotify.Create}
+				evChan <- fsnotify.Event{Name: newFile, Op: fsnotify.Chmod}
+				close(evChan)
 			},
+			wantNotify: false,
 		},
 		{
-			"return notify via the returned channel if sshd_config modified",
-			func(sh *MocksshHelper, w *MockfsWatcher, evChan chan fsnotify.Event, errChan chan error) {
-				sh.EXPECT().sshdConfigFile().Return(sshdCfgFile)
-				sh.EXPECT().newFSWatcher().Return(w, evChan, errChan, nil)
-				w.EXPECT().Add(sshdCfgFile).Return(nil)
-
-				sh.EXPECT().sshdCfgModified(w, sshdCfgFile, &fsnotify.Event{
-					Name: sshdCfgFile,
-					Op:   fsnotify.Write,
-				}).Return(true).AnyTimes()
+			name: "should keep watching the files if the Include directory cannot be watched",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager) {
+				w.EXPECT().Add(includeDir).Return(errors.New("no such file or directory"))
 			},
-			func(evChan chan fsnotify.Event, errChan chan error) {
-				evChan <- fsnotify.Event{
-					Name: sshdCfgFile,
-					Op:   fsnotify.Write,
-				}
+			trigger: func(evChan chan fsnotify.Event) {
+				evChan <- fsnotify.Event{Name: includedFile, Op: fsnotify.Write}
 				close(evChan)
 			},
-			func(t *testing.T, s *SSHManager, retChan <-chan bool, err error) {
-				if err != nil {
-					t.Errorf("WatchSSHDConfig() unexpected error: %v", err)
-				}
-				select {
-				case r := <-retChan:
-					if r != true {
-						t.Errorf("WatchSSHDConfig() unexpected result")
-					}
-				default:
-					t.Errorf("WatchSSHDConfig() sshd_config modification not notified")
-				}
+			wantNotify: true,
+		},
+		{
+			name: "should poll for new files if watching the Include directory timed out",
+			prepare: func(sh *MocksshHelper, w *MockfsWatcher, sysMgr *mocks.MocksysManager) {
+				blockAdd := make(chan struct{})
+				w.EXPECT().Add(includeDir).DoAndReturn(func(_ string) error {
+					<-blockAdd
+					return nil
+				})
+				w.EXPECT().Close().DoAndReturn(func() error {
+					close(blockAdd)
+					close(watcherClosed)
+					return nil
+				})
+				sysMgr.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Include sshd_config.d/*.conf"), nil).Times(3)
+				sysMgr.EXPECT().ReadFile(includedFile).Return([]byte("Port 22"), nil).Times(3)
+				gomock.InOrder(
+					sysMgr.EXPECT().Glob(includeDir+"/*.conf").Return([]string{includedFile}, nil),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
+					sysMgr.EXPECT().Glob(includeDir+"/*.conf").Return([]string{includedFile}, nil),
+					sysMgr.EXPECT().Sleep(defaultFileCheckInterval),
+					sysMgr.EXPECT().Glob(includeDir+"/*.conf").Return([]string{includedFile, newFile}, nil),
+				)
 			},
+			wantNotify:    true,
+			watcherClosed: watcherClosed,
 		},
 	}
 	for _, tt := range tests {
@@ -806,32 +1691,163 @@ func TestSSHManager_WatchSSHDConfig(t *testing.T) {
 			defer mockCtl.Finish()
 			sshHelperMock := NewMocksshHelper(mockCtl)
 			fsWatcherMock := NewMockfsWatcher(mockCtl)
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
 			evChan := make(chan fsnotify.Event)
 			errChan := make(chan error)
 
-			if tt.prepare != nil {
-				tt.prepare(sshHelperMock, fsWatcherMock, evChan, errChan)
-			}
+			sshHelperMock.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+			sshHelperMock.EXPECT().newFSWatcher().Return(fsWatcherMock, evChan, errChan, nil)
+			fsWatcherMock.EXPECT().Add(sshdCfgFile).Return(nil)
+			fsWatcherMock.EXPECT().Add(includedFile).Return(nil)
+			tt.prepare(sshHelperMock, fsWatcherMock, sysMgrMock)
 
-			waitWatcherThread := make(chan bool)
 			s := &SSHManager{
-				sshHelper: sshHelperMock,
-				fsWatcherQuitHook: func() {
-					close(waitWatcherThread)
-				},
+				sshHelper:             sshHelperMock,
+				sysMgr:                sysMgrMock,
+				sshdIncludedFiles:     []string{includedFile},
+				sshdIncludePatterns:   []string{includeDir + "/*.conf"},
+				fsWatcherSetupTimeout: 50 * time.Millisecond,
 			}
 			got, err := s.WatchSSHDConfig()
+			if err != nil {
+				t.Fatalf("WatchSSHDConfig() unexpected error: %v", err)
+			}
 			if tt.trigger != nil {
-				go tt.trigger(evChan, errChan)
-			} else {
-				go close(waitWatcherThread)
+				go tt.trigger(evChan)
+			}
+			notified := false
+			for r := range got {
+				notified = notified || r
+			}
+			if notified != tt.wantNotify {
+				t.Errorf("WatchSSHDConfig() notified = %v, want %v", notified, tt.wantNotify)
+			}
+			if tt.watcherClosed != nil {
+				<-tt.watcherClosed
 			}
-			<-waitWatcherThread
-			tt.assert(t, s, got, err)
 		})
 	}
 }
 
+func TestSSHManager_WatchSSHDConfig_newIncludedFileCreated(t *testing.T) {
+	log.Mute()
+	dir := t.TempDir()
+	includeDir := filepath.Join(dir, "sshd_config.d")
+	sshdCfgFile := filepath.Join(dir, "sshd_config")
+	if err := os.Mkdir(includeDir, 0700); err != nil {
+		t.Fatalf("failed to create %s: %v", includeDir, err)
+	}
+	if err := os.WriteFile(sshdCfgFile, []byte("Include "+includeDir+"/*.conf\nPort 22\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", sshdCfgFile, err)
+	}
+	s, err := NewSSHManager(WithCustomSSHDCfg(sshdCfgFile), WithMetricsRegisterer(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewSSHManager() unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+	got, err := s.WatchSSHDConfig()
+	if err != nil {
+		t.Fatalf("WatchSSHDConfig() unexpected error: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(includeDir, "99-new.conf"), []byte("Port 2222\n"), 0600); err != nil {
+		t.Fatalf("failed to write the new included file: %v", err)
+	}
+	select {
+	case r := <-got:
+		if !r {
+			t.Errorf("WatchSSHDConfig() unexpected result")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("WatchSSHDConfig() new included file not notified")
+	}
+}
+
+func TestSSHManager_WatchSSHDConfig_watcherStuck(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sshHelperMock := NewMocksshHelper(mockCtl)
+	fsWatcherMock := NewMockfsWatcher(mockCtl)
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+
+	sshdCfgFile := "/etc/ssh/sshd_config"
+	releaseAdd := make(chan struct{})
+	addReturned := make(chan struct{})
+	watcherClosed := make(chan struct{})
+	sshHelperMock.EXPECT().sshdConfigFile().Return(sshdCfgFile)
+	sshHelperMock.EXPECT().newFSWatcher().Return(fsWatcherMock, make(chan fsnotify.Event), make(chan error), nil)
+	fsWatcherMock.EXPECT().Add(sshdCfgFile).DoAndReturn(func(_ string) error {
+		<-releaseAdd
+		close(addReturned)
+		return nil
+	})
+	// like fsnotify, closing the watcher waits for the pending Add to return
+	fsWatcherMock.EXPECT().Close().DoAndReturn(func() error {
+		<-addReturned
+		close(watcherClosed)
+		return nil
+	})
+	gomock.InOrder(
+		sysMgrMock.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Port 22"), nil),
+		sysMgrMock.EXPECT().Sleep(defaultFileCheckInterval),
+		sysMgrMock.EXPECT().ReadFile(sshdCfgFile).Return([]byte("Port 1030"), nil),
+	)
+
+	s := &SSHManager{
+		sshHelper:             sshHelperMock,
+		sysMgr:                sysMgrMock,
+		fsWatcherSetupTimeout: 50 * time.Millisecond,
+	}
+	watching := make(chan (<-chan bool), 1)
+	go func() {
+		got, err := s.WatchSSHDConfig()
+		if err != nil {
+			t.Errorf("WatchSSHDConfig() unexpected error: %v", err)
+		}
+		watching <- got
+	}()
+	var got <-chan bool
+	select {
+	case got = <-watching:
+	case <-time.After(5 * time.Second):
+		close(releaseAdd)
+		t.Fatalf("WatchSSHDConfig() blocked on closing the stuck watcher")
+	}
+	if r, ok := <-got; !ok || !r {
+		t.Errorf("WatchSSHDConfig() sshd_config modification not notified by the poller")
+	}
+
+	close(releaseAdd)
+	select {
+	case <-watcherClosed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("WatchSSHDConfig() did not close the stuck watcher")
+	}
+}
+
+func TestSSHManager_Close(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	fsWatcherMock := NewMockfsWatcher(mockCtl)
+	fsWatcherMock.EXPECT().Close().Return(nil).Times(1)
+
+	s := &SSHManager{
+		fsWatcher:       fsWatcherMock,
+		sshdCfgPollQuit: make(chan struct{}),
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Errorf("Close() unexpected error: %v", err)
+		}
+	}
+	select {
+	case <-s.sshdCfgPollQuit:
+	default:
+		t.Errorf("Close() did not stop the polling")
+	}
+}
+
 func TestSSHManager_RemoveDOTTYKeys(t *testing.T) {
 	log.Mute()
 	user1 := "user1"
@@ -905,3 +1921,300 @@ func TestSSHManager_RemoveDOTTYKeys(t *testing.T) {
 		})
 	}
 }
+
+func TestSSHManager_RevokeKeys(t *testing.T) {
+	log.Mute()
+	user1 := "user1"
+	user2 := "user2"
+	user3 := "user3"
+	dotty11 := &SSHKey{OSUser: user1, PublicKey: "public-key-11", ActorEmail: "actor1@email.com", Type: SSHKeyTypeDOTTY, fingerprint: "SHA256:fpt-11"}
+	dotty12 := &SSHKey{OSUser: user1, PublicKey: "public-key-12", ActorEmail: "actor2@email.com", Type: SSHKeyTypeDOTTY, fingerprint: "SHA256:fpt-12"}
+	droplet13 := &SSHKey{OSUser: user1, PublicKey: "public-key-13", Type: SSHKeyTypeDroplet, fingerprint: "SHA256:fpt-13"}
+	dotty21 := &SSHKey{OSUser: user2, PublicKey: "public-key-21", ActorEmail: "actor1@email.com", Type: SSHKeyTypeDOTTY, fingerprint: "SHA256:fpt-21"}
+	dotty31 := &SSHKey{OSUser: user3, PublicKey: "public-key-31", ActorEmail: "actor2@email.com", Type: SSHKeyTypeDOTTY, fingerprint: "SHA256:fpt-31"}
+	updateErr := errors.New("update-failed")
+
+	tests := []struct {
+		name           string
+		fingerprints   []string
+		cachedKeys     map[string][]*SSHKey
+		prepare        func(updater *MockauthorizedKeysFileUpdater)
+		wantErr        error
+		wantCachedKeys map[string][]*SSHKey
+	}{
+		{
+			"should revoke keys by fingerprint across multiple users",
+			[]string{"SHA256:fpt-11", "SHA256:fpt-21"},
+			map[string][]*SSHKey{
+				user1: {dotty11, dotty12, droplet13},
+				user2: {dotty21},
+				user3: {dotty31},
+			},
+			func(updater *MockauthorizedKeysFileUpdater) {
+				updater.EXPECT().updateAuthorizedKeysFile(user1, []*SSHKey{dotty12, droplet13}).Return(nil)
+				updater.EXPECT().updateAuthorizedKeysFile(user2, []*SSHKey{}).Return(nil)
+			},
+			nil,
+			map[string][]*SSHKey{
+				user1: {dotty12, droplet13},
+				user3: {dotty31},
+			},
+		},
+		{
+			"should revoke keys by actor email across multiple users",
+			[]string{"actor2@email.com"},
+			map[string][]*SSHKey{
+				user1: {dotty11, dotty12},
+				user2: {dotty21},
+				user3: {dotty31},
+			},
+			func(updater *MockauthorizedKeysFileUpdater) {
+				updater.EXPECT().updateAuthorizedKeysFile(user1, []*SSHKey{dotty11}).Return(nil)
+				updater.EXPECT().updateAuthorizedKeysFile(user3, []*SSHKey{}).Return(nil)
+			},
+			nil,
+			map[string][]*SSHKey{
+				user1: {dotty11},
+				user2: {dotty21},
+			},
+		},
+		{
+			"should never revoke droplet keys",
+			[]string{"SHA256:fpt-13"},
+			map[string][]*SSHKey{
+				user1: {dotty11, droplet13},
+			},
+			nil,
+			nil,
+			map[string][]*SSHKey{
+				user1: {dotty11, droplet13},
+			},
+		},
+		{
+			"should keep the cached keys if failed to update authorized_keys file",
+			[]string{"SHA256:fpt-11", "SHA256:fpt-21"},
+			map[string][]*SSHKey{
+				user1: {dotty11, dotty12},
+				user2: {dotty21},
+			},
+			func(updater *MockauthorizedKeysFileUpdater) {
+				updater.EXPECT().updateAuthorizedKeysFile(user1, []*SSHKey{dotty12}).Return(updateErr)
+				updater.EXPECT().updateAuthorizedKeysFile(user2, []*SSHKey{}).Return(nil)
+			},
+			updateErr,
+			map[string][]*SSHKey{
+				user1: {dotty11, dotty12},
+			},
+		},
+		{
+			"should do nothing if no key is revoked",
+			nil,
+			map[string][]*SSHKey{
+				user1: {dotty11},
+			},
+			nil,
+			nil,
+			map[string][]*SSHKey{
+				user1: {dotty11},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			updaterMock := NewMockauthorizedKeysFileUpdater(mockCtl)
+
+			s := &SSHManager{
+				authorizedKeysFileUpdater: updaterMock,
+				cachedKeys:                tt.cachedKeys,
+			}
+			if tt.prepare != nil {
+				tt.prepare(updaterMock)
+			}
+			if err := s.RevokeKeys(tt.fingerprints); (err != nil || tt.wantErr != nil) && !errors.Is(err, tt.wantErr) {
+				t.Errorf("RevokeKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tt.wantCachedKeys, s.cachedKeys) {
+				t.Errorf("RevokeKeys() cached keys = %v, want %v", s.cachedKeys, tt.wantCachedKeys)
+			}
+		})
+	}
+}
+
+func TestSSHManager_UpdateKeys_revokedKeys(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	sshHelperMock := NewMocksshHelper(mockCtl)
+	updaterMock := NewMockauthorizedKeysFileUpdater(mockCtl)
+
+	revoked := &SSHKey{OSUser: "user1", PublicKey: "public-key-1", ActorEmail: "actor@email.com", Type: SSHKeyTypeDOTTY, fingerprint: "SHA256:fpt-1"}
+	kept := &SSHKey{OSUser: "user1", PublicKey: "public-key-2", ActorEmail: "actor2@email.com", Type: SSHKeyTypeDOTTY, fingerprint: "SHA256:fpt-2"}
+	s := &SSHManager{
+		sshHelper:                 sshHelperMock,
+		authorizedKeysFileUpdater: updaterMock,
+		cachedKeys:                map[string][]*SSHKey{},
+		revokedKeys:               map[string]bool{"actor@email.com": true},
+	}
+	sshHelperMock.EXPECT().validateKey(revoked).Return(nil)
+	sshHelperMock.EXPECT().validateKey(kept).Return(nil)
+	sshHelperMock.EXPECT().removeExpiredKeys(gomock.Any()).Return(map[string][]*SSHKey{})
+	sshHelperMock.EXPECT().areSameKeys([]*SSHKey{kept}, nil).Return(false)
+	updaterMock.EXPECT().updateAuthorizedKeysFile("user1", []*SSHKey{kept}).Return(nil)
+
+	if err := s.UpdateKeys([]*SSHKey{revoked, kept}); err != nil {
+		t.Fatalf("UpdateKeys() unexpected error = %v", err)
+	}
+	if want := map[string][]*SSHKey{"user1": {kept}}; !reflect.DeepEqual(want, s.cachedKeys) {
+		t.Errorf("UpdateKeys() cached keys = %v, want %v", s.cachedKeys, want)
+	}
+}
+
+func TestSSHManager_FixSSHDirPermissions(t *testing.T) {
+	log.Mute()
+	user := &sysutil.User{Name: "user1", UID: 1000, GID: 1000, HomeDir: "/home/user1"}
+	keysFile := "/home/user1/.ssh/authorized_keys"
+	fixErr := errors.New("fix-error")
+
+	tests := []struct {
+		name     string
+		keysFile string
+		prepare  func(sysMgr *mocks.MocksysManager)
+		wantErr  error
+	}{
+		{
+			"should fix the permissions of the .ssh dir",
+			keysFile,
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(true, nil)
+			},
+			nil,
+		},
+		{
+			"should succeed if the permissions are already correct",
+			keysFile,
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, nil)
+			},
+			nil,
+		},
+		{
+			"should leave keys files outside of the .ssh dir untouched",
+			"/etc/ssh/authorized_keys/user1",
+			nil,
+			nil,
+		},
+		{
+			"should return the error if failed to fix the permissions",
+			keysFile,
+			func(sysMgr *mocks.MocksysManager) {
+				sysMgr.EXPECT().EnsureSSHDirPermissions(keysFile, user).Return(false, fixErr)
+			},
+			fixErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtl := gomock.NewController(t)
+			defer mockCtl.Finish()
+			sysMgrMock := mocks.NewMocksysManager(mockCtl)
+			sshHelperMock := NewMocksshHelper(mockCtl)
+			sysMgrMock.EXPECT().GetUserByName(user.Name).Return(user, nil)
+			sshHelperMock.EXPECT().authorizedKeysFile(user).Return(tt.keysFile)
+			if tt.prepare != nil {
+				tt.prepare(sysMgrMock)
+			}
+
+			s := &SSHManager{sshHelper: sshHelperMock, sysMgr: sysMgrMock}
+			if err := s.FixSSHDirPermissions(user.Name); !errors.Is(err, tt.wantErr) {
+				t.Errorf("FixSSHDirPermissions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSSHManager_UpdateKeys_dryRun(t *testing.T) {
+	log.Mute()
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+
+	sysMgrMock := mocks.NewMocksysManager(mockCtl)
+	user := &sysutil.User{Name: "root", HomeDir: "/root"}
+	sysMgrMock.EXPECT().GetUserByName("root").Return(user, nil)
+	sysMgrMock.EXPECT().ReadFile("/root/.ssh/authorized_keys").Return([]byte("# customer key\n"), nil)
+
+	s := &SSHManager{
+		sysMgr:                    sysMgrMock,
+		authorizedKeysFilePattern: defaultAuthorizedKeysFile,
+		cachedKeys:                make(map[string][]*SSHKey),
+		dryRun:                    true,
+	}
+	s.sshHelper = &sshHelperImpl{mgr: s, timeNow: time.Now}
+	s.authorizedKeysFileUpdater = &updaterImpl{sshMgr: s}
+
+	key := &SSHKey{
+		OSUser:    "root",
+		PublicKey: "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBHRjqHzBANlihrvlhyecJecbR4yV5ufOgl9fllxDFpDGMMDd6Pb+ypR/noxmQwa9ik8Z3ki9e1UAIeQ8K5R3kpE=",
+		TTL:       60,
+		Type:      SSHKeyTypeDOTTY,
+	}
+	if err := s.UpdateKeys([]*SSHKey{key}); err != nil {
+		t.Fatalf("UpdateKeys() unexpected error = %v", err)
+	}
+	want := map[string][]*SSHKey{"root": {key}}
+	if !reflect.DeepEqual(s.cachedKeys, want) {
+		t.Errorf("UpdateKeys() should still update the cached keys in dry run, got %v, want %v", s.cachedKeys, want)
+	}
+}
+
+func TestSSHManager_ListManagedKeys(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour)
+	tests := []struct {
+		name       string
+		cachedKeys map[string][]*SSHKey
+		want       []KeyInfo
+	}{
+		{
+			"should return an empty list if no keys are cached",
+			map[string][]*SSHKey{},
+			[]KeyInfo{},
+		},
+		{
+			"should list the keys of all users, sorted by user",
+			map[string][]*SSHKey{
+				"user2": {
+					{OSUser: "user2", PublicKey: "key-21", ActorEmail: "actor2@email.com", TTL: 60, Type: SSHKeyTypeDOTTY, fingerprint: "fp-21", expireAt: expireAt},
+				},
+				"root": {
+					{OSUser: "root", PublicKey: "key-11", ActorEmail: "actor1@email.com", TTL: 60, Type: SSHKeyTypeDOTTY, fingerprint: "fp-11", expireAt: expireAt},
+					{OSUser: "root", PublicKey: "key-12", Type: SSHKeyTypeDroplet, fingerprint: "fp-12"},
+				},
+			},
+			[]KeyInfo{
+				{OSUser: "root", ActorEmail: "actor1@email.com", Fingerprint: "fp-11", ExpireAt: expireAt, Type: SSHKeyTypeDOTTY},
+				{OSUser: "root", Fingerprint: "fp-12", Type: SSHKeyTypeDroplet},
+				{OSUser: "user2", ActorEmail: "actor2@email.com", Fingerprint: "fp-21", ExpireAt: expireAt, Type: SSHKeyTypeDOTTY},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SSHManager{cachedKeys: tt.cachedKeys}
+			got := s.ListManagedKeys()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListManagedKeys() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				got[i].OSUser = "modified"
+			}
+			for _, keys := range tt.cachedKeys {
+				for _, k := range keys {
+					if k.OSUser == "modified" {
+						t.Errorf("ListManagedKeys() should not expose the cached keys")
+					}
+				}
+			}
+		})
+	}
+}
@@ -20,6 +20,12 @@ var (
 	ErrCreateFileFailed = fmt.Errorf("failed to create file")
 	// ErrRunCmdFailed is returned when a command is failed to run
 	ErrRunCmdFailed = fmt.Errorf("failed to run command")
+	// ErrGetFileOwnerFailed indicates the owner of a file cannot be determined
+	ErrGetFileOwnerFailed = fmt.Errorf("failed to get file owner")
+	// ErrFixPermissionsFailed indicates the mode or the owner of a file cannot be corrected
+	ErrFixPermissionsFailed = fmt.Errorf("failed to fix file permissions")
+	// ErrUnsafePath indicates a file is reached through a symlink, or through a directory that others can write to
+	ErrUnsafePath = fmt.Errorf("unsafe path")
 )
 
 // User struct contains information of a user
@@ -40,6 +46,12 @@ type CmdResult struct {
 
 type osOperator interface {
 	getpwnam(username string) (*User, error)
+	getgroups(user *User) ([]string, error)
 	mkdir(dir string, user *User, perm os.FileMode) error
 	createFileForWrite(file string, user *User, perm os.FileMode) (io.WriteCloser, error)
+	fileOwner(name string) (int, error)
+	freeSpace(path string) (uint64, error)
+	ensureSSHDirPermissions(file string, user *User) (bool, error)
+	readFileNoFollow(file string, user *User) ([]byte, error)
+	replaceFileNoFollow(file string, user *User, content []byte, perm os.FileMode) error
 }
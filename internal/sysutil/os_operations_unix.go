@@ -6,11 +6,17 @@
 package sysutil
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func newOSOperator() osOperator {
@@ -22,7 +28,10 @@ func newOSOperator() osOperator {
 		osOpenFile: func(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
 			return os.OpenFile(name, flag, perm)
 		},
-		osRemove: os.Remove,
+		osRemove:        os.Remove,
+		getentFn:        runGetent,
+		fchownFn:        unix.Fchown,
+		copyAttributeFn: copyFileAttribute,
 	}
 }
 
@@ -32,6 +41,12 @@ const (
 	passwdIdxGID     = 3
 	passwdIdxHomeDir = 5
 	passwdIdxShell   = 6
+
+	groupIdxName    = 0
+	groupIdxGID     = 2
+	groupIdxMembers = 3
+
+	getentExitKeyNotFound = 2
 )
 
 type osOperatorImpl struct {
@@ -41,9 +56,31 @@ type osOperatorImpl struct {
 	osChown    func(name string, uid, gid int) error
 	osOpenFile func(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
 	osRemove   func(name string) error
+	getentFn   func(database, key string) ([]byte, error) // nil disables the getent fallback
+	fchownFn   func(fd, uid, gid int) error
+
+	copyAttributeFn func(from, to string) error
 }
 
+// getpwnam looks up the user in /etc/passwd. If the user is not found there, e.g. when it's provided by LDAP/SSSD, or
+// its home directory is missing, the entry returned by `getent passwd` is used instead.
 func (o *osOperatorImpl) getpwnam(username string) (*User, error) {
+	entry, err := o.getpwnamFromFile(username)
+	if (err == nil && entry.HomeDir != "") || o.getentFn == nil {
+		return entry, err
+	}
+	fallback, gErr := o.getpwnamFromGetent(username)
+	if gErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		// keep the incomplete entry from /etc/passwd
+		return entry, nil
+	}
+	return fallback, nil
+}
+
+func (o *osOperatorImpl) getpwnamFromFile(username string) (*User, error) {
 	content, err := o.readFileFn("/etc/passwd")
 	if err != nil {
 		return nil, fmt.Errorf("%w: error getting user info for:%s. error: %v", ErrGetUserFailed, username, err)
@@ -65,6 +102,81 @@ func (o *osOperatorImpl) getpwnam(username string) (*User, error) {
 	return nil, fmt.Errorf("%w: user %s not found", ErrUserNotFound, username)
 }
 
+// getpwnamFromGetent looks up the user through the name service switch with `getent passwd`.
+// The user name is validated before running the command, and so is the returned entry before it's trusted.
+func (o *osOperatorImpl) getpwnamFromGetent(username string) (*User, error) {
+	if !validUsername(username) {
+		return nil, fmt.Errorf("%w: invalid user name [%s]", ErrGetUserFailed, username)
+	}
+	out, err := o.getentFn("passwd", username)
+	if err != nil {
+		return nil, fmt.Errorf("%w: getent passwd failed for:%s. error: %v", ErrGetUserFailed, username, err)
+	}
+	content := strings.TrimSpace(string(out))
+	if content == "" {
+		return nil, fmt.Errorf("%w: user %s not found by getent", ErrUserNotFound, username)
+	}
+	if strings.Contains(content, "\n") {
+		return nil, fmt.Errorf("%w: getent returned multiple entries for:%s", ErrGetUserFailed, username)
+	}
+	entry, err := parseLine(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: getent returned an invalid entry for:%s. error: %v", ErrGetUserFailed, username, err)
+	}
+	if entry.Name != username || !filepath.IsAbs(entry.HomeDir) {
+		return nil, fmt.Errorf("%w: getent returned an unexpected entry for:%s", ErrGetUserFailed, username)
+	}
+	return entry, nil
+}
+
+// runGetent runs `getent <database> <key>` and returns its output, which is empty if the key is not found
+func runGetent(database, key string) ([]byte, error) {
+	out, err := exec.Command("getent", database, key).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == getentExitKeyNotFound {
+		return nil, nil
+	}
+	return out, err
+}
+
+// validUsername tells whether the user name is safe to be passed to a command, it must not be mistaken for an option
+func validUsername(username string) bool {
+	if username == "" || strings.HasPrefix(username, "-") {
+		return false
+	}
+	return !strings.ContainsAny(username, ":/\\ \t\n\r\x00")
+}
+
+// getgroups returns the names of the groups the user belongs to, including its primary group
+func (o *osOperatorImpl) getgroups(user *User) ([]string, error) {
+	content, err := o.readFileFn("/etc/group")
+	if err != nil {
+		return nil, fmt.Errorf("%w: error getting groups for:%s. error: %v", ErrGetUserFailed, user.Name, err)
+	}
+	var groups []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.Split(line, ":")
+		if len(items) != 4 {
+			continue
+		}
+		if gid, err := strconv.Atoi(items[groupIdxGID]); err == nil && gid == user.GID {
+			groups = append(groups, items[groupIdxName])
+			continue
+		}
+		for _, member := range strings.Split(items[groupIdxMembers], ",") {
+			if strings.TrimSpace(member) == user.Name {
+				groups = append(groups, items[groupIdxName])
+				break
+			}
+		}
+	}
+	return groups, nil
+}
+
 func (o *osOperatorImpl) mkdir(dir string, user *User, perm os.FileMode) error {
 	if _, err := o.osStatFn(dir); err != nil {
 		if os.IsNotExist(err) {
@@ -96,6 +208,277 @@ func (o *osOperatorImpl) createFileForWrite(file string, user *User, perm os.Fil
 	return f, nil
 }
 
+func (o *osOperatorImpl) fileOwner(name string) (int, error) {
+	info, err := o.osStatFn(name)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("%w: owner of %s unavailable", ErrGetFileOwnerFailed, name)
+	}
+	return int(stat.Uid), nil
+}
+
+func (o *osOperatorImpl) freeSpace(path string) (uint64, error) {
+	stat := &syscall.Statfs_t{}
+	if err := syscall.Statfs(path, stat); err != nil {
+		return 0, err
+	}
+	// the blocks available to unprivileged users, the ones reserved for root are not counted
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil //nolint:unconvert
+}
+
+// ensureSSHDirPermissions makes sure the directory containing the given authorized_keys file has mode 0700, and the
+// file has mode 0600, both owned by the user. It returns whether anything had to be corrected.
+// Since this runs as root on paths controlled by the user, nothing is resolved through symlinks: every component of
+// the directory is opened with O_NOFOLLOW, and the directory and the file are only changed through their descriptors.
+// It refuses to touch a directory or a file owned by another non-root user. A symlinked or missing file is left as is.
+func (o *osOperatorImpl) ensureSSHDirPermissions(file string, user *User) (bool, error) {
+	dirFd, err := openDirNoFollow(filepath.Dir(filepath.Clean(file)), nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: failed to open the directory of %s: %v", ErrFixPermissionsFailed, file, err)
+	}
+	defer func() { _ = unix.Close(dirFd) }()
+	changed, err := o.ensureFdPermissions(dirFd, unix.S_IFDIR, user, 0700)
+	if err != nil {
+		return changed, fmt.Errorf("%w: directory of %s: %v", ErrFixPermissionsFailed, file, err)
+	}
+
+	fileFd, err := unix.Openat(dirFd, filepath.Base(file), unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ELOOP) {
+			return changed, nil
+		}
+		return changed, fmt.Errorf("%w: failed to open %s: %v", ErrFixPermissionsFailed, file, err)
+	}
+	defer func() { _ = unix.Close(fileFd) }()
+	fileChanged, err := o.ensureFdPermissions(fileFd, unix.S_IFREG, user, 0600)
+	if err != nil {
+		return changed || fileChanged, fmt.Errorf("%w: %s: %v", ErrFixPermissionsFailed, file, err)
+	}
+	return changed || fileChanged, nil
+}
+
+// ensureFdPermissions fixes the mode and the owner of an opened file of the given type
+func (o *osOperatorImpl) ensureFdPermissions(fd int, fileType uint32, user *User, perm uint32) (bool, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return false, err
+	}
+	if uint32(stat.Mode)&unix.S_IFMT != fileType { //nolint:unconvert
+		if fileType == unix.S_IFREG {
+			// e.g. a FIFO, there is nothing sshd could read keys from anyway
+			return false, nil
+		}
+		return false, errors.New("unexpected file type")
+	}
+	if int(stat.Uid) != user.UID && stat.Uid != 0 {
+		return false, fmt.Errorf("refusing to change a file owned by uid %d", stat.Uid)
+	}
+	if fileType == unix.S_IFREG && stat.Nlink != 1 {
+		// a hard link may point to a file of another user, e.g. root's authorized_keys
+		return false, fmt.Errorf("refusing to change a file with %d hard links", stat.Nlink)
+	}
+	changed := false
+	if uint32(stat.Mode)&0o7777 != perm { //nolint:unconvert
+		if err := unix.Fchmod(fd, perm); err != nil {
+			return false, fmt.Errorf("chmod failed: %v", err)
+		}
+		changed = true
+	}
+	if int(stat.Uid) != user.UID || int(stat.Gid) != user.GID {
+		if err := o.fchownFn(fd, user.UID, user.GID); err != nil {
+			return changed, fmt.Errorf("chown failed: %v", err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// readFileNoFollow reads the given file, which must be a regular file owned by the user. Since this runs as root on a
+// path controlled by the user, the directories are opened as by openSafeDir, and the file itself without following
+// symlinks.
+func (o *osOperatorImpl) readFileNoFollow(file string, user *User) ([]byte, error) {
+	file = filepath.Clean(file)
+	dirFd, err := openSafeDir(filepath.Dir(file), user)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: file, Err: err}
+	}
+	defer func() { _ = unix.Close(dirFd) }()
+	fd, err := unix.Openat(dirFd, filepath.Base(file), unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ELOOP) {
+			err = fmt.Errorf("%w: %s is a symlink", ErrUnsafePath, file)
+		}
+		return nil, &os.PathError{Op: "open", Path: file, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), file)
+	defer func() { _ = f.Close() }()
+	if err := checkUserFile(fd, file, user); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(f)
+}
+
+// replaceFileNoFollow atomically replaces the content of the given file with a new file owned by the user. An existing
+// file must be a regular file owned by the user. The directories are opened as by openSafeDir, and the new file is
+// created, renamed and synced relative to the descriptor of its directory, so no symlink is followed at any point.
+func (o *osOperatorImpl) replaceFileNoFollow(file string, user *User, content []byte, perm os.FileMode) (retErr error) {
+	file = filepath.Clean(file)
+	dirFd, err := openSafeDir(filepath.Dir(file), user)
+	if err != nil {
+		if errors.Is(err, ErrUnsafePath) {
+			return err
+		}
+		return fmt.Errorf("%w: failed to open the directory of %s: %v", ErrCreateFileFailed, file, err)
+	}
+	defer func() { _ = unix.Close(dirFd) }()
+	name := filepath.Base(file)
+	const openFlags = unix.O_NOFOLLOW | unix.O_NONBLOCK | unix.O_NOCTTY | unix.O_CLOEXEC
+	srcFd, err := unix.Openat(dirFd, name, unix.O_RDONLY|openFlags, 0)
+	switch {
+	case errors.Is(err, unix.ENOENT):
+		srcFd = -1
+	case errors.Is(err, unix.ELOOP):
+		return fmt.Errorf("%w: %s is a symlink", ErrUnsafePath, file)
+	case err != nil:
+		return fmt.Errorf("%w: failed to open %s: %v", ErrCreateFileFailed, file, err)
+	default:
+		defer func() { _ = unix.Close(srcFd) }()
+		if err := checkUserFile(srcFd, file, user); err != nil {
+			return err
+		}
+	}
+
+	tmpName := name + ".dotty"
+	// a tmp file left behind by a crash would make O_EXCL fail
+	_ = unix.Unlinkat(dirFd, tmpName, 0)
+	tmpFd, err := unix.Openat(dirFd, tmpName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|openFlags, uint32(perm.Perm()))
+	if err != nil {
+		return fmt.Errorf("%w: open file failed: %v", ErrCreateFileFailed, err)
+	}
+	tmpFile := os.NewFile(uintptr(tmpFd), filepath.Join(filepath.Dir(file), tmpName))
+	defer func() {
+		_ = tmpFile.Close()
+		if retErr != nil {
+			_ = unix.Unlinkat(dirFd, tmpName, 0)
+		}
+	}()
+	if err := o.fchownFn(tmpFd, user.UID, user.GID); err != nil {
+		return fmt.Errorf("%w: failed to set owner: %v", ErrCreateFileFailed, err)
+	}
+	if _, err := tmpFile.Write(content); err != nil {
+		return fmt.Errorf("%w: write failed: %v", ErrCreateFileFailed, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("%w: sync failed: %v", ErrCreateFileFailed, err)
+	}
+	if srcFd != -1 {
+		// the descriptors are reached through /proc, so that the attributes are copied without resolving the paths
+		if err := o.copyAttributeFn(fdPath(srcFd), fdPath(tmpFd)); err != nil {
+			return fmt.Errorf("%w: failed to apply file attribute: %v", ErrCreateFileFailed, err)
+		}
+	}
+	if err := unix.Renameat(dirFd, tmpName, dirFd, name); err != nil {
+		return fmt.Errorf("%w: rename failed: %v", ErrCreateFileFailed, err)
+	}
+	// persist the rename itself
+	if err := unix.Fsync(dirFd); err != nil {
+		return fmt.Errorf("%w: failed to sync the directory of %s: %v", ErrCreateFileFailed, file, err)
+	}
+	return nil
+}
+
+// checkUserFile makes sure an opened file is a regular file owned by the user
+func checkUserFile(fd int, file string, user *User) error {
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return err
+	}
+	if uint32(stat.Mode)&unix.S_IFMT != unix.S_IFREG { //nolint:unconvert
+		return fmt.Errorf("%w: %s is not a regular file", ErrUnsafePath, file)
+	}
+	if int(stat.Uid) != user.UID {
+		return fmt.Errorf("%w: %s is owned by uid %d instead of user %s", ErrUnsafePath, file, stat.Uid, user.Name)
+	}
+	return nil
+}
+
+// fdPath returns the path an opened file can be reached through without resolving its own path
+func fdPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+// openSafeDir opens the given absolute directory like openDirNoFollow, and makes sure each of its components is owned
+// by root or the user, and is not writable by group or others, as sshd's StrictModes requires. Otherwise, someone
+// else could replace a component between the checks and the use of the directory. A root-owned directory with the
+// sticky bit, e.g. /tmp, is allowed, since others cannot rename or remove the entries they do not own there.
+func openSafeDir(dir string, user *User) (int, error) {
+	return openDirNoFollow(dir, func(fd int, path string) error {
+		var stat unix.Stat_t
+		if err := unix.Fstat(fd, &stat); err != nil {
+			return err
+		}
+		if stat.Uid != 0 && int(stat.Uid) != user.UID {
+			return fmt.Errorf("%w: %s is owned by uid %d", ErrUnsafePath, path, stat.Uid)
+		}
+		if uint32(stat.Mode)&0o022 != 0 && (stat.Uid != 0 || uint32(stat.Mode)&unix.S_ISVTX == 0) { //nolint:unconvert
+			return fmt.Errorf("%w: %s is writable by group or others", ErrUnsafePath, path)
+		}
+		return nil
+	})
+}
+
+// openDirNoFollow opens the given absolute directory, failing if any of its components is a symlink. If check is not
+// nil, it's called with each component opened, starting from the root directory.
+func openDirNoFollow(dir string, check func(fd int, path string) error) (int, error) {
+	if !filepath.IsAbs(dir) {
+		return -1, fmt.Errorf("%s is not an absolute path", dir)
+	}
+	const flags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+	fd, err := unix.Open("/", flags, 0)
+	if err != nil {
+		return -1, err
+	}
+	checkDir := func(fd int, path string) error {
+		if check == nil {
+			return nil
+		}
+		if err := check(fd, path); err != nil {
+			_ = unix.Close(fd)
+			return err
+		}
+		return nil
+	}
+	if err := checkDir(fd, "/"); err != nil {
+		return -1, err
+	}
+	path := "/"
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" {
+			continue
+		}
+		next, err := unix.Openat(fd, name, flags, 0)
+		_ = unix.Close(fd)
+		if err != nil {
+			if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) {
+				return -1, fmt.Errorf("%w: %s is not a directory or is reached through a symlink", ErrUnsafePath, dir)
+			}
+			return -1, err
+		}
+		fd = next
+		path = filepath.Join(path, name)
+		if err := checkDir(fd, path); err != nil {
+			return -1, err
+		}
+	}
+	return fd, nil
+}
+
 func parseLine(line string) (*User, error) {
 	ret := &User{}
 	items := strings.Split(line, ":")
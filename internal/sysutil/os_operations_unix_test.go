@@ -8,6 +8,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -103,6 +104,185 @@ lp:x:7:7:lp:/var/spool/lpd:/usr/sbin/nologin`,
 	}
 }
 
+func Test_osOperatorImpl_getpwnam_getentFallback(t *testing.T) {
+	passwdRaw := `
+root:x:0:0:root:/root:/bin/bash
+nohome:x:1002:1002:::/bin/bash`
+	ldapUser := &User{Name: "ldapuser", UID: 5000, GID: 5000, HomeDir: "/net/home/ldapuser", Shell: "/bin/bash"}
+	tests := []struct {
+		name       string
+		username   string
+		getentOut  string
+		getentErr  error
+		wantGetent bool
+		want       *User
+		wantErr    error
+	}{
+		{
+			"should not run getent if the user is found with a home directory",
+			"root",
+			"",
+			nil,
+			false,
+			&User{Name: "root", UID: 0, GID: 0, HomeDir: "/root", Shell: "/bin/bash"},
+			nil,
+		},
+		{
+			"should use getent if the user is not in the passwd file",
+			"ldapuser",
+			"ldapuser:*:5000:5000:LDAP User:/net/home/ldapuser:/bin/bash\n",
+			nil,
+			true,
+			ldapUser,
+			nil,
+		},
+		{
+			"should use getent if the home directory is missing",
+			"nohome",
+			"nohome:x:1002:1002::/home/nohome:/bin/bash",
+			nil,
+			true,
+			&User{Name: "nohome", UID: 1002, GID: 1002, HomeDir: "/home/nohome", Shell: "/bin/bash"},
+			nil,
+		},
+		{
+			"should keep the incomplete entry if getent fails",
+			"nohome",
+			"",
+			errors.New("getent-error"),
+			true,
+			&User{Name: "nohome", UID: 1002, GID: 1002, HomeDir: "", Shell: "/bin/bash"},
+			nil,
+		},
+		{
+			"should return ErrUserNotFound if getent does not find the user either",
+			"ldapuser",
+			"",
+			nil,
+			true,
+			nil,
+			ErrUserNotFound,
+		},
+		{
+			"should reject an entry of another user",
+			"ldapuser",
+			"other:*:5000:5000::/net/home/other:/bin/bash",
+			nil,
+			true,
+			nil,
+			ErrUserNotFound,
+		},
+		{
+			"should reject multiple entries",
+			"ldapuser",
+			"ldapuser:*:5000:5000::/net/home/ldapuser:/bin/bash\nldapuser:*:5001:5001::/tmp:/bin/bash",
+			nil,
+			true,
+			nil,
+			ErrUserNotFound,
+		},
+		{
+			"should reject a relative home directory",
+			"ldapuser",
+			"ldapuser:*:5000:5000::home/ldapuser:/bin/bash",
+			nil,
+			true,
+			nil,
+			ErrUserNotFound,
+		},
+		{
+			"should not run getent with an invalid user name",
+			"-s",
+			"",
+			nil,
+			false,
+			nil,
+			ErrUserNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotGetent := false
+			o := &osOperatorImpl{
+				readFileFn: func(filename string) ([]byte, error) {
+					return []byte(passwdRaw), nil
+				},
+				getentFn: func(database, key string) ([]byte, error) {
+					gotGetent = true
+					if database != "passwd" || key != tt.username {
+						t.Errorf("getpwnam() ran getent with unexpected args: %s %s", database, key)
+					}
+					return []byte(tt.getentOut), tt.getentErr
+				},
+			}
+			got, err := o.getpwnam(tt.username)
+			if (err != nil || tt.wantErr != nil) && !errors.Is(err, tt.wantErr) {
+				t.Errorf("getpwnam() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getpwnam() got = %v, want %v", got, tt.want)
+			}
+			if gotGetent != tt.wantGetent {
+				t.Errorf("getpwnam() ran getent = %v, want %v", gotGetent, tt.wantGetent)
+			}
+		})
+	}
+}
+
+func Test_osOperatorImpl_getgroups(t *testing.T) {
+	user := &User{Name: "hlee", UID: 1000, GID: 1001}
+	tests := []struct {
+		name        string
+		groupRaw    string
+		readFileErr error
+		want        []string
+		wantErr     error
+	}{
+		{
+			"should return ErrGetUserFailed if failed to read group file",
+			"",
+			errors.New("read-error"),
+			nil,
+			ErrGetUserFailed,
+		},
+		{
+			"should include both the primary group and the supplementary groups",
+			`
+root:x:0:
+# staff:x:50:hlee
+invalid line
+sudo:x:27:ubuntu,hlee
+hlee:x:1001:
+docker:x:999:ubuntu
+admin:x:110: ubuntu , hlee `,
+			nil,
+			[]string{"sudo", "hlee", "admin"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &osOperatorImpl{
+				readFileFn: func(filename string) ([]byte, error) {
+					if filename != "/etc/group" {
+						t.Errorf("getgroups() read unexpected file: %s", filename)
+					}
+					return []byte(tt.groupRaw), tt.readFileErr
+				},
+			}
+			got, err := o.getgroups(user)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("getgroups() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getgroups() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_osOperatorImpl_mkdir(t *testing.T) {
 	type fields struct {
 		osStatErr  error
@@ -320,3 +500,421 @@ func Test_osOperatorImpl_createFileForWrite(t *testing.T) {
 		})
 	}
 }
+
+func Test_osOperatorImpl_fileOwner(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte("content"), 0600); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	o := &osOperatorImpl{osStatFn: os.Stat}
+
+	uid, err := o.fileOwner(file)
+	if err != nil {
+		t.Errorf("fileOwner() unexpected error = %v", err)
+	}
+	if uid != os.Getuid() {
+		t.Errorf("fileOwner() got = %v, want %v", uid, os.Getuid())
+	}
+	if _, err := o.fileOwner(file + ".missing"); !os.IsNotExist(err) {
+		t.Errorf("fileOwner() error = %v, want not exist", err)
+	}
+}
+
+func Test_osOperatorImpl_freeSpace(t *testing.T) {
+	o := &osOperatorImpl{}
+	free, err := o.freeSpace(t.TempDir())
+	if err != nil {
+		t.Fatalf("freeSpace() unexpected error = %v", err)
+	}
+	if free == 0 {
+		t.Errorf("freeSpace() = 0, want the free space of the temp dir")
+	}
+	if _, err := o.freeSpace(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("freeSpace() should fail for a missing path")
+	}
+}
+
+func Test_osOperatorImpl_ensureSSHDirPermissions(t *testing.T) {
+	currentUser := &User{UID: os.Getuid(), GID: os.Getgid()}
+	// the files created by the test are owned by the current user, unless it's root, in which case they are handed
+	// over to another non-root user, so that a third user can be refused either way
+	otherUID := os.Getuid() + 1
+	thirdUser := &User{UID: otherUID + 1, GID: os.Getgid()}
+	handOver := func(names ...string) {
+		if os.Getuid() != 0 {
+			return
+		}
+		for _, name := range names {
+			_ = os.Lchown(name, otherUID, os.Getgid())
+		}
+	}
+	tests := []struct {
+		name        string
+		prepare     func(base string) (keysFile string, protected []string)
+		user        *User
+		wantChanged bool
+		wantErr     bool
+		wantChown   bool
+		wantDirPerm os.FileMode
+		wantPerm    os.FileMode
+	}{
+		{
+			"should fix a group/world writable dir and file",
+			func(base string) (string, []string) {
+				sshDir := filepath.Join(base, "home", ".ssh")
+				_ = os.MkdirAll(sshDir, 0700)
+				_ = os.Chmod(sshDir, 0777)
+				_ = os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte("content"), 0666)
+				_ = os.Chmod(filepath.Join(sshDir, "authorized_keys"), 0666)
+				return filepath.Join(sshDir, "authorized_keys"), nil
+			},
+			currentUser,
+			true,
+			false,
+			false,
+			0700,
+			0600,
+		},
+		{
+			"should leave a dir and a file already correct untouched",
+			func(base string) (string, []string) {
+				sshDir := filepath.Join(base, "home", ".ssh")
+				_ = os.MkdirAll(sshDir, 0700)
+				_ = os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte("content"), 0600)
+				return filepath.Join(sshDir, "authorized_keys"), nil
+			},
+			currentUser,
+			false,
+			false,
+			false,
+			0700,
+			0600,
+		},
+		{
+			"should fix the group of the dir and the file",
+			func(base string) (string, []string) {
+				sshDir := filepath.Join(base, "home", ".ssh")
+				_ = os.MkdirAll(sshDir, 0700)
+				_ = os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte("content"), 0600)
+				return filepath.Join(sshDir, "authorized_keys"), nil
+			},
+			&User{UID: os.Getuid(), GID: os.Getgid() + 1},
+			true,
+			false,
+			true,
+			0700,
+			0600,
+		},
+		{
+			"should ignore a missing dir",
+			func(base string) (string, []string) {
+				return filepath.Join(base, "home", ".ssh", "authorized_keys"), nil
+			},
+			currentUser,
+			false,
+			false,
+			false,
+			0,
+			0,
+		},
+		{
+			"should leave a symlinked authorized_keys untouched",
+			func(base string) (string, []string) {
+				sshDir := filepath.Join(base, "home", ".ssh")
+				_ = os.MkdirAll(sshDir, 0700)
+				target := filepath.Join(base, "target")
+				_ = os.WriteFile(target, []byte("content"), 0644)
+				_ = os.Symlink(target, filepath.Join(sshDir, "authorized_keys"))
+				return filepath.Join(sshDir, "authorized_keys"), []string{target}
+			},
+			currentUser,
+			false,
+			false,
+			false,
+			0700,
+			0,
+		},
+		{
+			"should refuse a symlinked .ssh dir",
+			func(base string) (string, []string) {
+				victimDir := filepath.Join(base, "root", ".ssh")
+				_ = os.MkdirAll(victimDir, 0755)
+				_ = os.Chmod(victimDir, 0755)
+				_ = os.WriteFile(filepath.Join(victimDir, "authorized_keys"), []byte("content"), 0644)
+				_ = os.MkdirAll(filepath.Join(base, "home"), 0700)
+				_ = os.Symlink(victimDir, filepath.Join(base, "home", ".ssh"))
+				return filepath.Join(base, "home", ".ssh", "authorized_keys"), []string{victimDir, filepath.Join(victimDir, "authorized_keys")}
+			},
+			currentUser,
+			false,
+			true,
+			false,
+			0,
+			0,
+		},
+		{
+			"should refuse a symlinked parent dir",
+			func(base string) (string, []string) {
+				victimDir := filepath.Join(base, "root", ".ssh")
+				_ = os.MkdirAll(victimDir, 0755)
+				_ = os.Chmod(victimDir, 0755)
+				_ = os.WriteFile(filepath.Join(victimDir, "authorized_keys"), []byte("content"), 0644)
+				_ = os.Symlink(filepath.Join(base, "root"), filepath.Join(base, "home"))
+				return filepath.Join(base, "home", ".ssh", "authorized_keys"), []string{victimDir, filepath.Join(victimDir, "authorized_keys")}
+			},
+			currentUser,
+			false,
+			true,
+			false,
+			0,
+			0,
+		},
+		{
+			"should refuse files owned by another non-root user",
+			func(base string) (string, []string) {
+				sshDir := filepath.Join(base, "home", ".ssh")
+				_ = os.MkdirAll(sshDir, 0700)
+				_ = os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte("content"), 0644)
+				handOver(sshDir, filepath.Join(sshDir, "authorized_keys"))
+				return filepath.Join(sshDir, "authorized_keys"), []string{filepath.Join(sshDir, "authorized_keys")}
+			},
+			thirdUser,
+			false,
+			true,
+			false,
+			0,
+			0,
+		},
+		{
+			"should refuse a hard linked authorized_keys",
+			func(base string) (string, []string) {
+				sshDir := filepath.Join(base, "home", ".ssh")
+				_ = os.MkdirAll(sshDir, 0700)
+				target := filepath.Join(base, "target")
+				_ = os.WriteFile(target, []byte("content"), 0644)
+				_ = os.Link(target, filepath.Join(sshDir, "authorized_keys"))
+				return filepath.Join(sshDir, "authorized_keys"), []string{target}
+			},
+			currentUser,
+			false,
+			true,
+			false,
+			0700,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatalf("failed to resolve the temp dir: %v", err)
+			}
+			keysFile, protected := tt.prepare(base)
+			protectedModes := make(map[string]os.FileMode)
+			for _, name := range protected {
+				info, err := os.Stat(name)
+				if err != nil {
+					t.Fatalf("failed to stat %s: %v", name, err)
+				}
+				protectedModes[name] = info.Mode()
+			}
+			gotChown := false
+			o := &osOperatorImpl{
+				fchownFn: func(_, uid, gid int) error {
+					gotChown = true
+					if uid != tt.user.UID || gid != tt.user.GID {
+						t.Errorf("ensureSSHDirPermissions() chown to %d:%d, want %d:%d", uid, gid, tt.user.UID, tt.user.GID)
+					}
+					return nil
+				},
+			}
+			changed, err := o.ensureSSHDirPermissions(keysFile, tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ensureSSHDirPermissions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrFixPermissionsFailed) {
+				t.Errorf("ensureSSHDirPermissions() error = %v, want %v", err, ErrFixPermissionsFailed)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("ensureSSHDirPermissions() changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if gotChown != tt.wantChown {
+				t.Errorf("ensureSSHDirPermissions() chown = %v, want %v", gotChown, tt.wantChown)
+			}
+			for name, mode := range protectedModes {
+				if info, err := os.Stat(name); err != nil || info.Mode() != mode {
+					t.Errorf("ensureSSHDirPermissions() should not touch %s", name)
+				}
+			}
+			for name, want := range map[string]os.FileMode{filepath.Dir(keysFile): tt.wantDirPerm, keysFile: tt.wantPerm} {
+				if want == 0 {
+					continue
+				}
+				info, err := os.Lstat(name)
+				if err != nil {
+					t.Fatalf("failed to stat %s: %v", name, err)
+				}
+				if info.Mode().Perm() != want {
+					t.Errorf("ensureSSHDirPermissions() %s perm = %v, want %v", name, info.Mode().Perm(), want)
+				}
+			}
+		})
+	}
+}
+
+func Test_osOperatorImpl_replaceFileNoFollow(t *testing.T) {
+	currentUser := &User{Name: "user1", UID: os.Getuid(), GID: os.Getgid()}
+	tests := []struct {
+		name    string
+		prepare func(base string) (file string, protected []string)
+		user    *User
+		wantErr error
+	}{
+		{
+			"should replace the file",
+			func(base string) (string, []string) {
+				_ = os.MkdirAll(filepath.Join(base, "keys"), 0755)
+				_ = os.WriteFile(filepath.Join(base, "keys", "user1"), []byte("old\n"), 0644)
+				return filepath.Join(base, "keys", "user1"), nil
+			},
+			currentUser,
+			nil,
+		},
+		{
+			"should create a missing file",
+			func(base string) (string, []string) {
+				_ = os.MkdirAll(filepath.Join(base, "keys"), 0755)
+				return filepath.Join(base, "keys", "user1"), nil
+			},
+			currentUser,
+			nil,
+		},
+		{
+			"should refuse a directory swapped for a symlink",
+			func(base string) (string, []string) {
+				// the file is resolved first, then the user replaces its directory with a link to another one
+				victim := filepath.Join(base, "etc", "user1")
+				_ = os.MkdirAll(filepath.Join(base, "etc"), 0755)
+				_ = os.WriteFile(victim, []byte("victim\n"), 0644)
+				_ = os.MkdirAll(filepath.Join(base, "home", "keys"), 0755)
+				_ = os.WriteFile(filepath.Join(base, "home", "keys", "user1"), []byte("old\n"), 0644)
+				_ = os.Rename(filepath.Join(base, "home", "keys"), filepath.Join(base, "home", "moved"))
+				_ = os.Symlink(filepath.Join(base, "etc"), filepath.Join(base, "home", "keys"))
+				return filepath.Join(base, "home", "keys", "user1"), []string{victim}
+			},
+			currentUser,
+			ErrUnsafePath,
+		},
+		{
+			"should refuse a symlinked file",
+			func(base string) (string, []string) {
+				victim := filepath.Join(base, "victim")
+				_ = os.WriteFile(victim, []byte("victim\n"), 0644)
+				_ = os.MkdirAll(filepath.Join(base, "keys"), 0755)
+				_ = os.Symlink(victim, filepath.Join(base, "keys", "user1"))
+				return filepath.Join(base, "keys", "user1"), []string{victim}
+			},
+			currentUser,
+			ErrUnsafePath,
+		},
+		{
+			"should refuse a directory writable by others",
+			func(base string) (string, []string) {
+				_ = os.MkdirAll(filepath.Join(base, "keys"), 0755)
+				_ = os.Chmod(filepath.Join(base, "keys"), 0777)
+				_ = os.WriteFile(filepath.Join(base, "keys", "user1"), []byte("old\n"), 0644)
+				return filepath.Join(base, "keys", "user1"), []string{filepath.Join(base, "keys", "user1")}
+			},
+			currentUser,
+			ErrUnsafePath,
+		},
+		{
+			"should refuse a file owned by another user",
+			func(base string) (string, []string) {
+				_ = os.MkdirAll(filepath.Join(base, "keys"), 0755)
+				_ = os.WriteFile(filepath.Join(base, "keys", "user1"), []byte("old\n"), 0644)
+				return filepath.Join(base, "keys", "user1"), []string{filepath.Join(base, "keys", "user1")}
+			},
+			&User{Name: "user2", UID: os.Getuid() + 1, GID: os.Getgid()},
+			ErrUnsafePath,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatalf("failed to resolve the temp dir: %v", err)
+			}
+			file, protected := tt.prepare(base)
+			protectedContent := make(map[string]string)
+			for _, name := range protected {
+				content, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", name, err)
+				}
+				protectedContent[name] = string(content)
+			}
+			o := &osOperatorImpl{
+				fchownFn:        func(_, _, _ int) error { return nil },
+				copyAttributeFn: func(_, _ string) error { return nil },
+			}
+			err = o.replaceFileNoFollow(file, tt.user, []byte("new\n"), 0600)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("replaceFileNoFollow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for name, want := range protectedContent {
+				if content, err := os.ReadFile(name); err != nil || string(content) != want {
+					t.Errorf("replaceFileNoFollow() should not touch %s", name)
+				}
+				if _, err := os.Lstat(filepath.Join(filepath.Dir(name), filepath.Base(file)+".dotty")); !os.IsNotExist(err) {
+					t.Errorf("replaceFileNoFollow() should not leave a tmp file next to %s", name)
+				}
+			}
+			if err != nil {
+				return
+			}
+			info, err := os.Lstat(file)
+			if err != nil {
+				t.Fatalf("failed to stat %s: %v", file, err)
+			}
+			if info.Mode() != 0600 {
+				t.Errorf("replaceFileNoFollow() mode = %v, want %v", info.Mode(), os.FileMode(0600))
+			}
+			if content, _ := os.ReadFile(file); string(content) != "new\n" {
+				t.Errorf("replaceFileNoFollow() content = %q, want %q", content, "new\n")
+			}
+			if _, err := os.Lstat(file + ".dotty"); !os.IsNotExist(err) {
+				t.Errorf("replaceFileNoFollow() left the tmp file behind")
+			}
+		})
+	}
+}
+
+func Test_osOperatorImpl_readFileNoFollow(t *testing.T) {
+	currentUser := &User{Name: "user1", UID: os.Getuid(), GID: os.Getgid()}
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to resolve the temp dir: %v", err)
+	}
+	_ = os.MkdirAll(filepath.Join(base, "keys"), 0755)
+	_ = os.WriteFile(filepath.Join(base, "keys", "user1"), []byte("content"), 0644)
+	_ = os.Symlink(filepath.Join(base, "keys"), filepath.Join(base, "link"))
+	_ = os.Symlink(filepath.Join(base, "keys", "user1"), filepath.Join(base, "keys", "link"))
+
+	o := &osOperatorImpl{}
+	if content, err := o.readFileNoFollow(filepath.Join(base, "keys", "user1"), currentUser); err != nil || string(content) != "content" {
+		t.Errorf("readFileNoFollow() = %q, %v, want %q", content, err, "content")
+	}
+	if _, err := o.readFileNoFollow(filepath.Join(base, "keys", "missing"), currentUser); !os.IsNotExist(err) {
+		t.Errorf("readFileNoFollow() error = %v, want not exist", err)
+	}
+	for _, file := range []string{filepath.Join(base, "link", "user1"), filepath.Join(base, "keys", "link")} {
+		if _, err := o.readFileNoFollow(file, currentUser); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("readFileNoFollow(%s) error = %v, want %v", file, err, ErrUnsafePath)
+		}
+	}
+	otherUser := &User{Name: "user2", UID: os.Getuid() + 1, GID: os.Getgid()}
+	if _, err := o.readFileNoFollow(filepath.Join(base, "keys", "user1"), otherUser); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("readFileNoFollow() error = %v, want %v", err, ErrUnsafePath)
+	}
+}
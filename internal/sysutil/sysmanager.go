@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 )
 
@@ -29,16 +30,69 @@ func (s *SysManager) ReadFile(filename string) ([]byte, error) {
 	return os.ReadFile(filename)
 }
 
+// Glob returns the names of all files matching pattern
+func (s *SysManager) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
 // RenameFile renames a file
 func (s *SysManager) RenameFile(oldpath, newpath string) error {
 	return os.Rename(oldpath, newpath)
 }
 
+// EvalSymlinks returns the path name after the evaluation of any symbolic links
+func (s *SysManager) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+// FileOwnerUID returns the uid of the owner of a file
+func (s *SysManager) FileOwnerUID(name string) (int, error) {
+	return s.fileOwner(name)
+}
+
+// SyncDir flushes the entries of a directory to disk, e.g. to persist a file renamed into it
+func (s *SysManager) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	return d.Sync()
+}
+
+// FreeSpace returns the free space, in bytes, of the filesystem the given path is on
+func (s *SysManager) FreeSpace(path string) (uint64, error) {
+	return s.freeSpace(path)
+}
+
+// EnsureSSHDirPermissions makes sure an authorized_keys file has mode 0600 and the directory containing it has mode
+// 0700, both owned by the user, without following symlinks. It returns whether anything had to be corrected.
+func (s *SysManager) EnsureSSHDirPermissions(file string, user *User) (bool, error) {
+	return s.ensureSSHDirPermissions(file, user)
+}
+
+// ReadFileNoFollow reads a file owned by the user, refusing to follow symlinks or to go through a directory that is not
+// owned by root or the user, or that others can write to
+func (s *SysManager) ReadFileNoFollow(file string, user *User) ([]byte, error) {
+	return s.readFileNoFollow(file, user)
+}
+
+// ReplaceFileNoFollow atomically replaces the content of a file owned by the user with a new file owned by the user,
+// with the same restrictions as ReadFileNoFollow
+func (s *SysManager) ReplaceFileNoFollow(file string, user *User, content []byte, perm os.FileMode) error {
+	return s.replaceFileNoFollow(file, user, content, perm)
+}
+
 // GetUserByName gets an OS user info
 func (s *SysManager) GetUserByName(username string) (*User, error) {
 	return s.getpwnam(username)
 }
 
+// GetUserGroups gets the names of the groups an OS user belongs to
+func (s *SysManager) GetUserGroups(user *User) ([]string, error) {
+	return s.getgroups(user)
+}
+
 // RemoveFile removes a file
 func (s *SysManager) RemoveFile(name string) error {
 	return os.Remove(name)
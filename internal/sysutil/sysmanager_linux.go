@@ -10,6 +10,10 @@ import (
 // CopyFileAttribute copies a file's attribute to another
 // In Linux, this is specifically designed to apply the selinux labels of a file to another
 func (s *SysManager) CopyFileAttribute(from, to string) error {
+	return copyFileAttribute(from, to)
+}
+
+func copyFileAttribute(from, to string) error {
 	if !selinux.GetEnabled() {
 		return nil
 	}